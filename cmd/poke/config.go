@@ -17,6 +17,55 @@ type Config struct {
 	Storage    Storage     `yaml:"storage"`
 	Connectors []Connector `yaml:"connectors"`
 	Web        Web         `yaml:"web"`
+	OAuth2     OAuth2      `yaml:"oauth2"`
+	Sessions   Sessions    `yaml:"sessions"`
+
+	RefreshTokens RefreshTokens `yaml:"refreshTokens"`
+}
+
+// OAuth2 describes enabled OAuth2 extensions.
+type OAuth2 struct {
+	// ID of the connector used to validate credentials for the resource owner
+	// password credentials grant. If empty, the grant is disabled.
+	PasswordConnector string `yaml:"passwordConnector"`
+
+	// External issuers whose ID Tokens can be exchanged through the token
+	// exchange grant.
+	TrustedIssuers []TrustedIssuer `yaml:"trustedIssuers"`
+
+	// Issue access tokens to all clients as JWTs instead of opaque values.
+	JWTAccessTokens bool `yaml:"jwtAccessTokens"`
+
+	// Initial access token clients present to register themselves. If empty,
+	// dynamic client registration is disabled.
+	RegistrationToken string `yaml:"registrationToken"`
+}
+
+// Sessions configures the lifetimes of end user login sessions. Values are
+// durations such as "30m" or "12h". If empty, the server's defaults are used.
+type Sessions struct {
+	IdleTimeout     string `yaml:"idleTimeout"`
+	AbsoluteTimeout string `yaml:"absoluteTimeout"`
+}
+
+// RefreshTokens configures refresh token rotation and expiry. Values are
+// durations such as "3s" or "720h". If empty, the server's defaults are used.
+type RefreshTokens struct {
+	// How long a client may retry with a refresh token which has just been
+	// rotated.
+	ReuseInterval string `yaml:"reuseInterval"`
+
+	// How long a refresh token may go unused, and how long refresh tokens may be
+	// used after the end user authorized the client. If empty, refresh tokens
+	// don't expire.
+	IdleTimeout      string `yaml:"idleTimeout"`
+	AbsoluteLifetime string `yaml:"absoluteLifetime"`
+}
+
+// TrustedIssuer is the config format for an external token issuer.
+type TrustedIssuer struct {
+	Issuer  string `yaml:"issuer"`
+	JWKSURL string `yaml:"jwksURL"`
 }
 
 // Web is the config format for the HTTP server.
@@ -72,6 +121,16 @@ type Connector struct {
 	ID   string `yaml:"id"`
 
 	Config ConnectorConfig `yaml:"config"`
+
+	ClaimMappings []ClaimMapping `yaml:"claimMappings"`
+}
+
+// ClaimMapping issues an attribute provided by a connector as a claim. Scope is
+// the scope clients must request to receive the claim, "profile" if empty.
+type ClaimMapping struct {
+	Claim     string `yaml:"claim"`
+	Attribute string `yaml:"attribute"`
+	Scope     string `yaml:"scope"`
 }
 
 // ConnectorConfig is a configuration that can open a connector.
@@ -86,6 +145,8 @@ func (c *Connector) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		Type string `yaml:"type"`
 		Name string `yaml:"name"`
 		ID   string `yaml:"id"`
+
+		ClaimMappings []ClaimMapping `yaml:"claimMappings"`
 	}
 	if err := unmarshal(&connectorMetadata); err != nil {
 		return err
@@ -93,6 +154,7 @@ func (c *Connector) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	c.Type = connectorMetadata.Type
 	c.Name = connectorMetadata.Name
 	c.ID = connectorMetadata.ID
+	c.ClaimMappings = connectorMetadata.ClaimMappings
 
 	switch c.Type {
 	case "mock":
@@ -103,6 +165,14 @@ func (c *Connector) UnmarshalYAML(unmarshal func(interface{}) error) error {
 			return err
 		}
 		c.Config = &config.Config
+	case "mockPassword":
+		var config struct {
+			Config mock.PasswordConfig `yaml:"config"`
+		}
+		if err := unmarshal(&config); err != nil {
+			return err
+		}
+		c.Config = &config.Config
 	case "ldap":
 		var config struct {
 			Config ldap.Config `yaml:"config"`
@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"time"
 
 	yaml "gopkg.in/yaml.v2"
 
@@ -77,6 +78,13 @@ func serve(cmd *cobra.Command, args []string) error {
 			DisplayName: conn.Name,
 			Connector:   c,
 		}
+		for _, m := range conn.ClaimMappings {
+			connectors[i].ClaimMappings = append(connectors[i].ClaimMappings, server.ClaimMapping{
+				Claim:     m.Claim,
+				Attribute: m.Attribute,
+				Scope:     m.Scope,
+			})
+		}
 	}
 
 	s, err := c.Storage.Config.Open()
@@ -84,10 +92,60 @@ func serve(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("initializing storage: %v", err)
 	}
 
+	trustedIssuers := make([]server.TrustedIssuer, len(c.OAuth2.TrustedIssuers))
+	for i, issuer := range c.OAuth2.TrustedIssuers {
+		trustedIssuers[i] = server.TrustedIssuer{
+			Issuer:  issuer.Issuer,
+			JWKSURL: issuer.JWKSURL,
+		}
+	}
+
+	parseDuration := func(field, val string) (time.Duration, error) {
+		if val == "" {
+			return 0, nil
+		}
+		d, err := time.ParseDuration(val)
+		if err != nil {
+			return 0, fmt.Errorf("parse %s: %v", field, err)
+		}
+		return d, nil
+	}
+	sessionIdleTimeout, err := parseDuration("sessions.idleTimeout", c.Sessions.IdleTimeout)
+	if err != nil {
+		return err
+	}
+	sessionAbsoluteTimeout, err := parseDuration("sessions.absoluteTimeout", c.Sessions.AbsoluteTimeout)
+	if err != nil {
+		return err
+	}
+	refreshTokenReuseInterval, err := parseDuration("refreshTokens.reuseInterval", c.RefreshTokens.ReuseInterval)
+	if err != nil {
+		return err
+	}
+	refreshTokenIdleTimeout, err := parseDuration("refreshTokens.idleTimeout", c.RefreshTokens.IdleTimeout)
+	if err != nil {
+		return err
+	}
+	refreshTokenAbsoluteLifetime, err := parseDuration("refreshTokens.absoluteLifetime", c.RefreshTokens.AbsoluteLifetime)
+	if err != nil {
+		return err
+	}
+
 	serverConfig := server.Config{
-		Issuer:     c.Issuer,
-		Connectors: connectors,
-		Storage:    s,
+		Issuer:            c.Issuer,
+		Connectors:        connectors,
+		Storage:           s,
+		PasswordConnector: c.OAuth2.PasswordConnector,
+		TrustedIssuers:    trustedIssuers,
+		JWTAccessTokens:   c.OAuth2.JWTAccessTokens,
+		RegistrationToken: c.OAuth2.RegistrationToken,
+
+		SessionIdleTimeout:     sessionIdleTimeout,
+		SessionAbsoluteTimeout: sessionAbsoluteTimeout,
+
+		RefreshTokenReuseInterval:    refreshTokenReuseInterval,
+		RefreshTokenIdleTimeout:      refreshTokenIdleTimeout,
+		RefreshTokenAbsoluteLifetime: refreshTokenAbsoluteLifetime,
 	}
 
 	serv, err := server.New(serverConfig)
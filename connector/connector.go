@@ -2,6 +2,7 @@
 package connector
 
 import (
+	"errors"
 	"net/http"
 
 	"github.com/ericchiang/poke/storage"
@@ -26,7 +27,29 @@ type CallbackConnector interface {
 	HandleCallback(r *http.Request) (identity storage.Identity, state string, err error)
 }
 
+// LoginHintConnector is an optional interface for callback based connectors which
+// can pass a hint about the end user's login on to the upstream provider.
+type LoginHintConnector interface {
+	LoginURLWithHint(callbackURL, state, loginHint string) (string, error)
+}
+
 // GroupsConnector is an optional interface for connectors which can map a user to groups.
 type GroupsConnector interface {
 	Groups(identity storage.Identity) ([]string, error)
 }
+
+// ErrRevoked is returned by a RefreshConnector when the end user can no longer
+// login through the connector, for example because they've been removed from
+// the upstream provider.
+var ErrRevoked = errors.New("connector: identity revoked upstream")
+
+// RefreshConnector is an optional interface for connectors which can check an
+// identity with the upstream provider when a client uses a refresh token.
+//
+// Refresh receives the identity stored with the refresh token, including its
+// ConnectorData, and returns the updated identity. Groups are updated through the
+// GroupsConnector interface afterwards. If Refresh returns ErrRevoked, the
+// refresh token is revoked. Other errors are treated as temporary failures.
+type RefreshConnector interface {
+	Refresh(identity storage.Identity) (storage.Identity, error)
+}
@@ -2,9 +2,11 @@ package github
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 
@@ -50,6 +52,8 @@ type connectorData struct {
 
 var _ connector.CallbackConnector = (*githubConnector)(nil)
 var _ connector.GroupsConnector = (*githubConnector)(nil)
+var _ connector.LoginHintConnector = (*githubConnector)(nil)
+var _ connector.RefreshConnector = (*githubConnector)(nil)
 
 type githubConnector struct {
 	redirectURI  string
@@ -70,6 +74,14 @@ func (c *githubConnector) LoginURL(callbackURL, state string) (string, error) {
 	return c.oauth2Config.AuthCodeURL(state), nil
 }
 
+// LoginURLWithHint suggests a GitHub username for the end user to login as.
+func (c *githubConnector) LoginURLWithHint(callbackURL, state, loginHint string) (string, error) {
+	if c.redirectURI != callbackURL {
+		return "", fmt.Errorf("expected callback URL did not match the URL in the config")
+	}
+	return c.oauth2Config.AuthCodeURL(state, oauth2.SetAuthURLParam("login", loginHint)), nil
+}
+
 type oauth2Error struct {
 	error            string
 	errorDescription string
@@ -92,27 +104,9 @@ func (c *githubConnector) HandleCallback(r *http.Request) (identity storage.Iden
 		return identity, "", fmt.Errorf("github: failed to get token: %v", err)
 	}
 
-	resp, err := c.oauth2Config.Client(c.ctx, token).Get(baseURL + "/user")
+	user, err := c.user(c.oauth2Config.Client(c.ctx, token))
 	if err != nil {
-		return identity, "", fmt.Errorf("github: get URL %v", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return identity, "", fmt.Errorf("github: read body: %v", err)
-		}
-		return identity, "", fmt.Errorf("%s: %s", resp.Status, body)
-	}
-	var user struct {
-		Name  string `json:"name"`
-		Login string `json:"login"`
-		ID    int    `json:"id"`
-		Email string `json:"email"`
-	}
-	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
-		return identity, "", fmt.Errorf("failed to decode response: %v", err)
+		return identity, "", err
 	}
 
 	data := connectorData{AccessToken: token.AccessToken}
@@ -121,39 +115,151 @@ func (c *githubConnector) HandleCallback(r *http.Request) (identity storage.Iden
 		return identity, "", fmt.Errorf("marshal connector data: %v", err)
 	}
 
-	username := user.Name
-	if username == "" {
-		username = user.Login
-	}
 	identity = storage.Identity{
 		UserID:        strconv.Itoa(user.ID),
-		Username:      username,
+		Username:      user.username(),
 		Email:         user.Email,
 		EmailVerified: true,
+		Claims:        user.claims(),
 		ConnectorData: connData,
 	}
 	return identity, q.Get("state"), nil
 }
 
-func (c *githubConnector) Groups(identity storage.Identity) ([]string, error) {
-	var data connectorData
-	if err := json.Unmarshal(identity.ConnectorData, &data); err != nil {
-		return nil, fmt.Errorf("decode connector data: %v", err)
+// errUnauthorized is returned when GitHub rejects the access token, for example
+// because the end user has revoked the application's access.
+var errUnauthorized = errors.New("github: access token rejected")
+
+type user struct {
+	Name  string `json:"name"`
+	Login string `json:"login"`
+	ID    int    `json:"id"`
+	Email string `json:"email"`
+
+	AvatarURL string `json:"avatar_url"`
+	HTMLURL   string `json:"html_url"`
+	Blog      string `json:"blog"`
+	Location  string `json:"location"`
+}
+
+func (u user) username() string {
+	if u.Name == "" {
+		return u.Login
 	}
-	token := &oauth2.Token{AccessToken: data.AccessToken}
-	resp, err := c.oauth2Config.Client(c.ctx, token).Get(baseURL + "/user/teams")
+	return u.Name
+}
+
+// claims returns the attributes of the user which can be mapped to claims,
+// using the names of the GitHub API.
+func (u user) claims() map[string]interface{} {
+	claims := make(map[string]interface{})
+	attrs := map[string]string{
+		"login":      u.Login,
+		"name":       u.Name,
+		"avatar_url": u.AvatarURL,
+		"html_url":   u.HTMLURL,
+		"blog":       u.Blog,
+		"location":   u.Location,
+	}
+	for name, value := range attrs {
+		if value != "" {
+			claims[name] = value
+		}
+	}
+	return claims
+}
+
+// get makes a request to the GitHub API and decodes the response into v.
+func get(client *http.Client, path string, v interface{}) error {
+	resp, err := client.Get(baseURL + path)
 	if err != nil {
-		return nil, fmt.Errorf("github: get teams: %v", err)
+		return fmt.Errorf("github: get URL %v", err)
 	}
 	defer resp.Body.Close()
+
 	if resp.StatusCode != http.StatusOK {
 		body, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
-			return nil, fmt.Errorf("github: read body: %v", err)
+			return fmt.Errorf("github: read body: %v", err)
+		}
+		if resp.StatusCode == http.StatusUnauthorized {
+			return errUnauthorized
+		}
+		return &apiError{resp.StatusCode, fmt.Sprintf("%s: %s", resp.Status, body)}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode response: %v", err)
+	}
+	return nil
+}
+
+type apiError struct {
+	statusCode int
+	message    string
+}
+
+func (e *apiError) Error() string { return e.message }
+
+func (c *githubConnector) user(client *http.Client) (user, error) {
+	var u user
+	err := get(client, "/user", &u)
+	return u, err
+}
+
+// Refresh checks that the end user hasn't revoked the application's access and,
+// if the connector is restricted to an org, that they're still a member. Changes
+// to the end user's profile are picked up.
+func (c *githubConnector) Refresh(identity storage.Identity) (storage.Identity, error) {
+	var data connectorData
+	if err := json.Unmarshal(identity.ConnectorData, &data); err != nil {
+		return identity, fmt.Errorf("decode connector data: %v", err)
+	}
+	client := c.oauth2Config.Client(c.ctx, &oauth2.Token{AccessToken: data.AccessToken})
+
+	u, err := c.user(client)
+	if err != nil {
+		if err == errUnauthorized {
+			return identity, connector.ErrRevoked
+		}
+		return identity, err
+	}
+	if strconv.Itoa(u.ID) != identity.UserID {
+		return identity, connector.ErrRevoked
+	}
+
+	if c.org != "" {
+		// https://developer.github.com/v3/orgs/members/#get-your-organization-membership
+		var membership struct {
+			State string `json:"state"`
+		}
+		err := get(client, "/user/memberships/orgs/"+url.PathEscape(c.org), &membership)
+		if apiErr, ok := err.(*apiError); ok && apiErr.statusCode == http.StatusNotFound {
+			return identity, connector.ErrRevoked
+		}
+		if err != nil {
+			if err == errUnauthorized {
+				return identity, connector.ErrRevoked
+			}
+			return identity, err
+		}
+		if membership.State != "active" {
+			return identity, connector.ErrRevoked
 		}
-		return nil, fmt.Errorf("%s: %s", resp.Status, body)
 	}
 
+	identity.Username = u.username()
+	identity.Email = u.Email
+	identity.Claims = u.claims()
+	return identity, nil
+}
+
+func (c *githubConnector) Groups(identity storage.Identity) ([]string, error) {
+	var data connectorData
+	if err := json.Unmarshal(identity.ConnectorData, &data); err != nil {
+		return nil, fmt.Errorf("decode connector data: %v", err)
+	}
+	token := &oauth2.Token{AccessToken: data.AccessToken}
+
 	// https://developer.github.com/v3/orgs/teams/#response-12
 	var teams []struct {
 		Name string `json:"name"`
@@ -161,8 +267,8 @@ func (c *githubConnector) Groups(identity storage.Identity) ([]string, error) {
 			Login string `json:"login"`
 		} `json:"organization"`
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&teams); err != nil {
-		return nil, fmt.Errorf("github: unmarshal groups: %v", err)
+	if err := get(c.oauth2Config.Client(c.ctx, token), "/user/teams", &teams); err != nil {
+		return nil, fmt.Errorf("github: get teams: %v", err)
 	}
 	groups := []string{}
 	for _, team := range teams {
@@ -15,6 +15,11 @@ import (
 type Config struct {
 	Host   string `yaml:"host"`
 	BindDN string `yaml:"bindDN"`
+
+	// A service account used to look up end users when refreshing their tokens,
+	// since the end user's password isn't available.
+	ServiceAccountDN       string `yaml:"serviceAccountDN"`
+	ServiceAccountPassword string `yaml:"serviceAccountPassword"`
 }
 
 // Open returns an authentication strategy using LDAP.
@@ -25,6 +30,9 @@ func (c *Config) Open() (connector.Connector, error) {
 	if c.BindDN == "" {
 		return nil, errors.New("missing bindDN paramater")
 	}
+	if c.ServiceAccountDN == "" || c.ServiceAccountPassword == "" {
+		return nil, errors.New("missing serviceAccountDN or serviceAccountPassword parameter")
+	}
 	return &ldapConnector{*c}, nil
 }
 
@@ -43,15 +51,90 @@ func (c *ldapConnector) do(f func(c *ldap.Conn) error) error {
 	return f(conn)
 }
 
-func (c *ldapConnector) Login(username, password string) (storage.Identity, error) {
+var _ connector.PasswordConnector = (*ldapConnector)(nil)
+var _ connector.RefreshConnector = (*ldapConnector)(nil)
+
+func (c *ldapConnector) userDN(username string) string {
+	return fmt.Sprintf("uid=%s,%s", username, c.BindDN)
+}
+
+// entryUserID returns a stable ID for an end user's entry: its "entryUUID" if
+// the server provides it, otherwise its "uid".
+func entryUserID(entry *ldap.Entry) string {
+	if id := entry.GetAttributeValue("entryUUID"); id != "" {
+		return id
+	}
+	return entry.GetAttributeValue("uid")
+}
+
+// Login binds as the end user, then reads their entry for a stable user ID.
+func (c *ldapConnector) Login(username, password string) (storage.Identity, bool, error) {
+	if password == "" {
+		// An empty password is an unauthenticated bind, which servers accept.
+		return storage.Identity{}, false, nil
+	}
+	var entry *ldap.Entry
 	err := c.do(func(conn *ldap.Conn) error {
-		return conn.Bind(fmt.Sprintf("uid=%s,%s", username, c.BindDN), password)
+		if err := conn.Bind(c.userDN(username), password); err != nil {
+			return err
+		}
+		req := ldap.NewSearchRequest(c.userDN(username), ldap.ScopeBaseObject,
+			ldap.NeverDerefAliases, 1, 0, false, "(objectClass=*)", []string{"entryUUID", "uid"}, nil)
+		resp, err := conn.Search(req)
+		if err != nil {
+			return fmt.Errorf("search for user: %v", err)
+		}
+		if len(resp.Entries) != 1 {
+			return fmt.Errorf("search for user: expected 1 entry, got %d", len(resp.Entries))
+		}
+		entry = resp.Entries[0]
+		return nil
 	})
 	if err != nil {
-		return storage.Identity{}, err
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return storage.Identity{}, false, nil
+		}
+		return storage.Identity{}, false, err
 	}
 
-	return storage.Identity{Username: username}, nil
+	userID := entryUserID(entry)
+	if userID == "" {
+		return storage.Identity{}, false, fmt.Errorf("entry %q has no entryUUID or uid", entry.DN)
+	}
+	return storage.Identity{UserID: userID, Username: username}, true, nil
+}
+
+// Refresh binds as the service account and checks the end user's entry still
+// exists in the directory. An entry for the same username but a different user
+// ID belongs to a new user, so the original end user is also considered gone.
+func (c *ldapConnector) Refresh(identity storage.Identity) (storage.Identity, error) {
+	var entry *ldap.Entry
+	err := c.do(func(conn *ldap.Conn) error {
+		if err := conn.Bind(c.ServiceAccountDN, c.ServiceAccountPassword); err != nil {
+			return fmt.Errorf("bind as service account: %v", err)
+		}
+		req := ldap.NewSearchRequest(c.userDN(identity.Username), ldap.ScopeBaseObject,
+			ldap.NeverDerefAliases, 1, 0, false, "(objectClass=*)", []string{"entryUUID", "uid"}, nil)
+		resp, err := conn.Search(req)
+		if err != nil {
+			return err
+		}
+		if len(resp.Entries) != 1 {
+			return fmt.Errorf("expected 1 entry, got %d", len(resp.Entries))
+		}
+		entry = resp.Entries[0]
+		return nil
+	})
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+			return identity, connector.ErrRevoked
+		}
+		return identity, fmt.Errorf("search for user: %v", err)
+	}
+	if entryUserID(entry) != identity.UserID {
+		return identity, connector.ErrRevoked
+	}
+	return identity, nil
 }
 
 func (c *ldapConnector) Close() error {
@@ -2,6 +2,7 @@
 package mock
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -13,10 +14,33 @@ import (
 // New returns a mock connector which requires no user interaction. It always returns
 // the same (fake) identity.
 func New() connector.Connector {
-	return mockConnector{}
+	return mockConnector{claims: newClaims()}
 }
 
-type mockConnector struct{}
+type mockConnector struct {
+	claims map[string]interface{}
+}
+
+// newClaims returns the attributes of the fake identity which can be mapped to
+// claims. Each connector gets its own copy so callers can't affect each other.
+func newClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"login":     "kilgore",
+		"givenName": "Kilgore",
+		"sn":        "Trout",
+		"locale":    "en-US",
+	}
+}
+
+// copyClaims returns a copy of a connector's claims for a new identity, so
+// changes to one identity's claims don't leak into the next login.
+func copyClaims(claims map[string]interface{}) map[string]interface{} {
+	c := make(map[string]interface{}, len(claims))
+	for k, v := range claims {
+		c[k] = v
+	}
+	return c
+}
 
 func (m mockConnector) Close() error { return nil }
 
@@ -37,6 +61,7 @@ func (m mockConnector) HandleCallback(r *http.Request) (storage.Identity, string
 		Username:      "Kilgore Trout",
 		Email:         "kilgore@kilgore.trout",
 		EmailVerified: true,
+		Claims:        copyClaims(m.claims),
 	}, r.URL.Query().Get("state"), nil
 }
 
@@ -44,6 +69,10 @@ func (m mockConnector) Groups(identity storage.Identity) ([]string, error) {
 	return []string{"authors"}, nil
 }
 
+func (m mockConnector) Refresh(identity storage.Identity) (storage.Identity, error) {
+	return identity, nil
+}
+
 // Config holds the configuration parameters for the mock connector.
 type Config struct{}
 
@@ -51,3 +80,56 @@ type Config struct{}
 func (c *Config) Open() (connector.Connector, error) {
 	return New(), nil
 }
+
+// NewPasswordConnector returns a mock connector which accepts a single username
+// and password combination.
+func NewPasswordConnector(username, password string) connector.Connector {
+	return passwordConnector{username, password, newClaims()}
+}
+
+type passwordConnector struct {
+	username string
+	password string
+	claims   map[string]interface{}
+}
+
+func (p passwordConnector) Close() error { return nil }
+
+func (p passwordConnector) Login(username, password string) (storage.Identity, bool, error) {
+	if username != p.username || password != p.password {
+		return storage.Identity{}, false, nil
+	}
+	return storage.Identity{
+		UserID:        "0-385-28089-0",
+		Username:      "Kilgore Trout",
+		Email:         "kilgore@kilgore.trout",
+		EmailVerified: true,
+		Claims:        copyClaims(p.claims),
+	}, true, nil
+}
+
+func (p passwordConnector) Groups(identity storage.Identity) ([]string, error) {
+	return []string{"authors"}, nil
+}
+
+func (p passwordConnector) Refresh(identity storage.Identity) (storage.Identity, error) {
+	return identity, nil
+}
+
+// PasswordConfig holds the configuration parameters for the mock password connector.
+type PasswordConfig struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// Open returns an authentication strategy which prompts for a predefined username
+// and password.
+func (c *PasswordConfig) Open() (connector.Connector, error) {
+	if c.Username == "" {
+		return nil, errors.New("no username supplied")
+	}
+	if c.Password == "" {
+		return nil, errors.New("no password supplied")
+	}
+	return NewPasswordConnector(c.Username, c.Password), nil
+}
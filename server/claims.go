@@ -0,0 +1,146 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/ericchiang/poke/storage"
+)
+
+// Connectors provide attributes of the end user beyond the standard identity
+// fields, such as their given name or avatar. Claim mappings choose which of
+// these attributes are added to ID tokens and user info responses, under which
+// claim names, and which scope a client needs to receive them.
+//
+// See: http://openid.net/specs/openid-connect-core-1_0.html#StandardClaims
+
+// ClaimMapping adds an attribute provided by a connector to the claims issued
+// for end users who logged in through it.
+type ClaimMapping struct {
+	// Claim is the name of the issued claim, such as "given_name" or
+	// "preferred_username".
+	Claim string
+	// Attribute is the key of the value in the identity's claims, as provided by
+	// the connector.
+	Attribute string
+	// Scope the client must be granted for the claim to be issued. Defaults to
+	// "profile".
+	Scope string
+}
+
+// Claims which are always issued by the server.
+var baseClaims = []string{
+	"acr", "aud", "auth_time", "email", "email_verified", "exp", "groups", "iat", "iss", "name", "sub",
+}
+
+// Claims which are set by the server and can't be mapped from attributes.
+var reservedClaims = map[string]bool{
+	"iss":            true,
+	"sub":            true,
+	"aud":            true,
+	"exp":            true,
+	"iat":            true,
+	"nbf":            true,
+	"jti":            true,
+	"azp":            true,
+	"nonce":          true,
+	"at_hash":        true,
+	"c_hash":         true,
+	"auth_time":      true,
+	"acr":            true,
+	"email":          true,
+	"email_verified": true,
+	"groups":         true,
+	"sid":            true,
+}
+
+// validateClaimMappings checks the claim mappings of a connector, returning a
+// copy with defaults applied.
+func validateClaimMappings(mappings []ClaimMapping) ([]ClaimMapping, error) {
+	validated := make([]ClaimMapping, len(mappings))
+	seen := make(map[string]bool)
+	for i, m := range mappings {
+		if m.Claim == "" || m.Attribute == "" {
+			return nil, fmt.Errorf("claim mappings require a claim and an attribute")
+		}
+		if reservedClaims[m.Claim] {
+			return nil, fmt.Errorf("claim %q can't be mapped", m.Claim)
+		}
+		if seen[m.Claim] {
+			return nil, fmt.Errorf("claim %q is mapped more than once", m.Claim)
+		}
+		seen[m.Claim] = true
+
+		switch m.Scope {
+		case "":
+			m.Scope = scopeProfile
+		case scopeOpenID, scopeEmail, scopeProfile, scopeGroups:
+		default:
+			return nil, fmt.Errorf("claim %q requires unsupported scope %q", m.Claim, m.Scope)
+		}
+		validated[i] = m
+	}
+	return validated, nil
+}
+
+// mappedClaims returns the claims mapped from the attributes of an identity
+// which are covered by the granted scopes.
+func (s *Server) mappedClaims(connectorID string, identity storage.Identity, scopes []string) map[string]interface{} {
+	mappings := s.connectors[connectorID].ClaimMappings
+	if len(mappings) == 0 || len(identity.Claims) == 0 {
+		return nil
+	}
+	granted := make(map[string]bool, len(scopes))
+	for _, scope := range scopes {
+		granted[scope] = true
+	}
+	claims := make(map[string]interface{})
+	for _, m := range mappings {
+		if !granted[m.Scope] {
+			continue
+		}
+		if v, ok := identity.Claims[m.Attribute]; ok {
+			claims[m.Claim] = v
+		}
+	}
+	return claims
+}
+
+// marshalClaims serializes a struct of claims with additional claims. The
+// additional claims take precedence.
+func marshalClaims(v interface{}, extra map[string]interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil || len(extra) == 0 {
+		return data, err
+	}
+	var claims map[string]json.RawMessage
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return nil, err
+	}
+	for name, value := range extra {
+		if claims[name], err = json.Marshal(value); err != nil {
+			return nil, fmt.Errorf("claim %q: %v", name, err)
+		}
+	}
+	return json.Marshal(claims)
+}
+
+// claimsSupported lists the claims the server may issue, for discovery.
+func (s *Server) claimsSupported() []string {
+	claims := append([]string{}, baseClaims...)
+	seen := make(map[string]bool)
+	for _, claim := range baseClaims {
+		seen[claim] = true
+	}
+	for _, conn := range s.connectors {
+		for _, m := range conn.ClaimMappings {
+			if !seen[m.Claim] {
+				seen[m.Claim] = true
+				claims = append(claims, m.Claim)
+			}
+		}
+	}
+	sort.Strings(claims)
+	return claims
+}
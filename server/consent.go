@@ -0,0 +1,167 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/ericchiang/poke/storage"
+)
+
+// Consents remember the scopes an end user has approved for a client. Once a
+// client has been approved, the end user isn't prompted again unless the client
+// requests additional scopes or forces the approval prompt. End users can
+// withdraw their consent for a client through the consent page.
+
+// hasConsent determines if the end user has already approved all the scopes of
+// an authorization request.
+func (s *Server) hasConsent(authReq storage.AuthRequest) (bool, error) {
+	consent, err := s.storage.GetConsent(authReq.ConnectorID, authReq.Identity.UserID, authReq.ClientID)
+	if err != nil {
+		if err == storage.ErrNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	granted := make(map[string]bool, len(consent.Scopes))
+	for _, scope := range consent.Scopes {
+		granted[scope] = true
+	}
+	for _, scope := range authReq.Scopes {
+		if !granted[scope] {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// recordConsent adds the scopes of an approved authorization request to the end
+// user's consent for the client.
+func (s *Server) recordConsent(authReq storage.AuthRequest) error {
+	connectorID, userID, clientID := authReq.ConnectorID, authReq.Identity.UserID, authReq.ClientID
+	updater := func(old storage.Consent) (storage.Consent, error) {
+		for _, scope := range authReq.Scopes {
+			if !contains(old.Scopes, scope) {
+				old.Scopes = append(old.Scopes, scope)
+			}
+		}
+		old.LastUpdated = s.now()
+		return old, nil
+	}
+
+	err := s.storage.UpdateConsent(connectorID, userID, clientID, updater)
+	if err != storage.ErrNotFound {
+		return err
+	}
+	err = s.storage.CreateConsent(storage.Consent{
+		ConnectorID: connectorID,
+		UserID:      userID,
+		ClientID:    clientID,
+		Scopes:      authReq.Scopes,
+		LastUpdated: s.now(),
+	})
+	if err == storage.ErrAlreadyExists {
+		// Created by a concurrent approval.
+		return s.storage.UpdateConsent(connectorID, userID, clientID, updater)
+	}
+	return err
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// consentCSRFToken returns the token the consent page's forms must post for a
+// session. It's derived from the session ID, which only the end user's browser
+// holds, so other sites can't forge it.
+func consentCSRFToken(session storage.Session) string {
+	h := sha256.Sum256([]byte("consent:" + session.ID))
+	return base64.RawURLEncoding.EncodeToString(h[:])
+}
+
+// handleConsent lets an end user with a session list the clients they've
+// approved and withdraw their consent. Withdrawing consent also revokes the
+// client's refresh tokens for the end user.
+func (s *Server) handleConsent(w http.ResponseWriter, r *http.Request) {
+	session, ok := s.session(r)
+	if !ok {
+		s.renderError(w, http.StatusUnauthorized, errAccessDenied, "Login to manage the applications you've approved.")
+		return
+	}
+	connectorID, userID := session.ConnectorID, session.Identity.UserID
+
+	switch r.Method {
+	case "GET":
+		consents, err := s.storage.ListConsents()
+		if err != nil {
+			log.Printf("Failed to list consents: %v", err)
+			s.renderError(w, http.StatusInternalServerError, errServerError, "")
+			return
+		}
+		var infos []consentInfo
+		for _, consent := range consents {
+			if consent.ConnectorID != connectorID || consent.UserID != userID {
+				continue
+			}
+			info := consentInfo{
+				ClientID:   consent.ClientID,
+				ClientName: consent.ClientID,
+				Scopes:     strings.Join(consent.Scopes, " "),
+			}
+			client, err := s.storage.GetClient(consent.ClientID)
+			if err != nil {
+				if err != storage.ErrNotFound {
+					log.Printf("Failed to get client %q: %v", consent.ClientID, err)
+				}
+			} else if client.Name != "" {
+				info.ClientName = client.Name
+			}
+			infos = append(infos, info)
+		}
+		renderConsentTmpl(w, infos, consentCSRFToken(session))
+	case "POST":
+		// The session cookie isn't sent on cross-site POSTs by most browsers, but
+		// check the form's token in case it is.
+		token := r.PostFormValue("csrf_token")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(consentCSRFToken(session))) != 1 {
+			s.renderError(w, http.StatusForbidden, errAccessDenied, "Invalid form submission.")
+			return
+		}
+		clientID := r.PostFormValue("client_id")
+		if err := s.storage.DeleteConsent(connectorID, userID, clientID); err != nil && err != storage.ErrNotFound {
+			log.Printf("Failed to delete consent: %v", err)
+			s.renderError(w, http.StatusInternalServerError, errServerError, "")
+			return
+		}
+		s.revokeUserRefreshTokens(connectorID, userID, clientID)
+		http.Redirect(w, r, s.absPath("/consent"), http.StatusSeeOther)
+	default:
+		s.notFound(w, r)
+	}
+}
+
+// revokeUserRefreshTokens deletes the refresh tokens a client holds for an end
+// user. Failures are logged.
+func (s *Server) revokeUserRefreshTokens(connectorID, userID, clientID string) {
+	refreshTokens, err := s.storage.ListRefreshTokens()
+	if err != nil {
+		log.Printf("Failed to list refresh tokens: %v", err)
+		return
+	}
+	for _, refresh := range refreshTokens {
+		if refresh.ClientID != clientID || refresh.ConnectorID != connectorID || refresh.Identity.UserID != userID {
+			continue
+		}
+		if err := s.storage.DeleteRefresh(refresh.RefreshToken); err != nil && err != storage.ErrNotFound {
+			log.Printf("Failed to delete refresh token: %v", err)
+		}
+	}
+}
@@ -0,0 +1,374 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ericchiang/poke/storage"
+)
+
+// The device flow lets clients without a browser, such as CLIs, request tokens.
+// The client polls the token endpoint while the end user authorizes it on a
+// different device.
+//
+// See: https://tools.ietf.org/html/rfc8628
+
+const (
+	deviceRequestValidFor   = 5 * time.Minute
+	devicePollInterval      = 5 * time.Second
+	deviceSlowDownIncrement = 5 * time.Second
+)
+
+// Letters used for user codes. Vowels are omitted to avoid spelling words, and
+// the code is case insensitive.
+//
+// See: https://tools.ietf.org/html/rfc8628#section-6.1
+const userCodeCharset = "BCDFGHJKLMNPQRSTVWXZ"
+
+// newUserCode returns a random user code of the form "XXXX-XXXX".
+func newUserCode() string {
+	code := make([]byte, 8)
+	max := big.NewInt(int64(len(userCodeCharset)))
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			panic(err)
+		}
+		code[i] = userCodeCharset[n.Int64()]
+	}
+	return string(code[:4]) + "-" + string(code[4:])
+}
+
+// normalizeUserCode converts user input into the canonical form of a user code.
+// End users may type it in lower case or without the dash.
+func normalizeUserCode(userCode string) string {
+	userCode = strings.ToUpper(userCode)
+	userCode = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(userCodeCharset, r) {
+			return r
+		}
+		return -1
+	}, userCode)
+	if len(userCode) != 8 {
+		return userCode
+	}
+	return userCode[:4] + "-" + userCode[4:]
+}
+
+// handleDeviceCode handles the device authorization endpoint.
+//
+// See: https://tools.ietf.org/html/rfc8628#section-3.1
+func (s *Server) handleDeviceCode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		s.notFound(w, r)
+		return
+	}
+	client, ok := s.authenticateClient(w, r)
+	if !ok {
+		return
+	}
+
+	scopes := strings.Split(r.PostFormValue("scope"), " ")
+	hasOpenIDScope, unrecognized, invalidScopes, err := validateScopes(s.storage, client.ID, scopes)
+	if err != nil {
+		tokenErr(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+	switch {
+	case !hasOpenIDScope:
+		tokenErr(w, errInvalidScope, `Missing required scope(s) ["openid"].`, http.StatusBadRequest)
+		return
+	case len(unrecognized) > 0:
+		tokenErr(w, errInvalidScope, fmt.Sprintf("Unrecognized scope(s) %q", unrecognized), http.StatusBadRequest)
+		return
+	case len(invalidScopes) > 0:
+		tokenErr(w, errInvalidScope, fmt.Sprintf("Client can't request scope(s) %q", invalidScopes), http.StatusBadRequest)
+		return
+	}
+
+	expiry := s.now().Add(deviceRequestValidFor)
+	deviceReq := storage.DeviceRequest{
+		UserCode:   newUserCode(),
+		DeviceCode: storage.NewNonce(),
+		ClientID:   client.ID,
+		Scopes:     scopes,
+		Expiry:     expiry,
+	}
+	deviceToken := storage.DeviceToken{
+		DeviceCode:   deviceReq.DeviceCode,
+		ClientID:     client.ID,
+		Status:       storage.DeviceTokenPending,
+		PollInterval: devicePollInterval,
+		Expiry:       expiry,
+	}
+	if err := s.storage.CreateDeviceRequest(deviceReq); err != nil {
+		log.Printf("Failed to create device request: %v", err)
+		tokenErr(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+	if err := s.storage.CreateDeviceToken(deviceToken); err != nil {
+		log.Printf("Failed to create device token: %v", err)
+		tokenErr(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+
+	resp := struct {
+		DeviceCode              string `json:"device_code"`
+		UserCode                string `json:"user_code"`
+		VerificationURI         string `json:"verification_uri"`
+		VerificationURIComplete string `json:"verification_uri_complete"`
+		ExpiresIn               int    `json:"expires_in"`
+		Interval                int    `json:"interval"`
+	}{
+		deviceReq.DeviceCode,
+		deviceReq.UserCode,
+		s.absURL("/device"),
+		s.absURL("/device") + "?" + url.Values{"user_code": {deviceReq.UserCode}}.Encode(),
+		int(deviceRequestValidFor.Seconds()),
+		int(devicePollInterval.Seconds()),
+	}
+	data, err := json.Marshal(resp)
+	if err != nil {
+		log.Printf("failed to marshal device code response: %v", err)
+		tokenErr(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
+
+// handleDeviceVerification lets the end user enter a user code, then sends them
+// through the same login and approval screens as the authorization endpoint.
+func (s *Server) handleDeviceVerification(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		renderDeviceTmpl(w, r.URL.String(), normalizeUserCode(r.FormValue("user_code")), "")
+	case "POST":
+		userCode := normalizeUserCode(r.FormValue("user_code"))
+		deviceReq, err := s.storage.GetDeviceRequest(userCode)
+		if err != nil || s.now().After(deviceReq.Expiry) {
+			if err != nil && err != storage.ErrNotFound {
+				log.Printf("Failed to get device request: %v", err)
+				s.renderError(w, http.StatusInternalServerError, errServerError, "")
+				return
+			}
+			renderDeviceTmpl(w, r.URL.String(), userCode, "Invalid or expired user code.")
+			return
+		}
+
+		// The code is returned to the device callback rather than a client. The
+		// user code is used as the state to find the device request again.
+		authReq := storage.AuthRequest{
+			ID:            storage.NewNonce(),
+			ClientID:      deviceReq.ClientID,
+			ResponseTypes: []string{responseTypeCode},
+			Scopes:        deviceReq.Scopes,
+			RedirectURI:   s.absURL("/device/callback"),
+			State:         deviceReq.UserCode,
+			Expiry:        s.now().Add(authRequestValidFor),
+		}
+		if err := s.storage.CreateAuthRequest(authReq); err != nil {
+			log.Printf("Failed to create authorization request: %v", err)
+			s.renderError(w, http.StatusInternalServerError, errServerError, "")
+			return
+		}
+		s.redirectToLogin(w, r, authReq)
+	default:
+		s.notFound(w, r)
+	}
+}
+
+// handleDeviceCallback exchanges the code issued after the end user approves the
+// device and stores the tokens for the device to collect.
+func (s *Server) handleDeviceCallback(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if errType := q.Get("error"); errType != "" {
+		s.renderError(w, http.StatusBadRequest, errType, q.Get("error_description"))
+		return
+	}
+
+	deviceReq, err := s.storage.GetDeviceRequest(q.Get("state"))
+	if err != nil || s.now().After(deviceReq.Expiry) {
+		if err != nil && err != storage.ErrNotFound {
+			log.Printf("Failed to get device request: %v", err)
+			s.renderError(w, http.StatusInternalServerError, errServerError, "")
+			return
+		}
+		s.renderError(w, http.StatusBadRequest, errInvalidRequest, "Invalid or expired user code.")
+		return
+	}
+
+	authCode, err := s.storage.GetAuthCode(q.Get("code"))
+	if err != nil || s.now().After(authCode.Expiry) || authCode.ClientID != deviceReq.ClientID ||
+		authCode.RedirectURI != s.absURL("/device/callback") {
+		if err != nil && err != storage.ErrNotFound {
+			log.Printf("Failed to get auth code: %v", err)
+			s.renderError(w, http.StatusInternalServerError, errServerError, "")
+			return
+		}
+		s.renderError(w, http.StatusBadRequest, errInvalidRequest, "Invalid or expired code parameter.")
+		return
+	}
+
+	client, err := s.storage.GetClient(deviceReq.ClientID)
+	if err != nil {
+		log.Printf("Failed to get client %q: %v", deviceReq.ClientID, err)
+		s.renderError(w, http.StatusInternalServerError, errServerError, "")
+		return
+	}
+	resp, err := s.exchangeAuthCode(client, authCode, "")
+	if err != nil {
+		s.renderError(w, http.StatusInternalServerError, errServerError, "")
+		return
+	}
+	data, err := json.Marshal(resp)
+	if err != nil {
+		log.Printf("Failed to marshal token response: %v", err)
+		s.renderError(w, http.StatusInternalServerError, errServerError, "")
+		return
+	}
+
+	updater := func(t storage.DeviceToken) (storage.DeviceToken, error) {
+		if t.Status != storage.DeviceTokenPending {
+			return t, fmt.Errorf("device token is %s", t.Status)
+		}
+		t.Status = storage.DeviceTokenComplete
+		t.Token = string(data)
+		return t, nil
+	}
+	if err := s.storage.UpdateDeviceToken(deviceReq.DeviceCode, updater); err != nil {
+		log.Printf("Failed to update device token: %v", err)
+		s.renderError(w, http.StatusInternalServerError, errServerError, "")
+		return
+	}
+	if err := s.storage.DeleteDeviceRequest(deviceReq.UserCode); err != nil {
+		log.Printf("Failed to delete device request: %v", err)
+	}
+	renderDeviceSuccessTmpl(w)
+}
+
+// isDeviceAuthRequest returns if an authorization request was created to
+// authorize a device, rather than by a client.
+func (s *Server) isDeviceAuthRequest(authReq storage.AuthRequest) bool {
+	return authReq.RedirectURI == s.absURL("/device/callback")
+}
+
+// denyDevice ends a device flow the end user refused to authorize, so the
+// device stops polling. The denial is recorded here rather than at the device
+// callback, where anyone knowing the user code could forge it.
+func (s *Server) denyDevice(w http.ResponseWriter, authReq storage.AuthRequest) {
+	if err := s.storage.DeleteAuthRequest(authReq.ID); err != nil && err != storage.ErrNotFound {
+		log.Printf("Failed to delete authorization request: %v", err)
+	}
+	deviceReq, err := s.storage.GetDeviceRequest(authReq.State)
+	if err != nil {
+		if err != storage.ErrNotFound {
+			log.Printf("Failed to get device request: %v", err)
+			s.renderError(w, http.StatusInternalServerError, errServerError, "")
+			return
+		}
+		s.renderError(w, http.StatusBadRequest, errInvalidRequest, "Invalid or expired user code.")
+		return
+	}
+	updater := func(t storage.DeviceToken) (storage.DeviceToken, error) {
+		if t.Status != storage.DeviceTokenPending {
+			return t, fmt.Errorf("device token is %s", t.Status)
+		}
+		t.Status = storage.DeviceTokenDenied
+		return t, nil
+	}
+	if err := s.storage.UpdateDeviceToken(deviceReq.DeviceCode, updater); err != nil {
+		log.Printf("Failed to update device token: %v", err)
+		s.renderError(w, http.StatusInternalServerError, errServerError, "")
+		return
+	}
+	if err := s.storage.DeleteDeviceRequest(deviceReq.UserCode); err != nil {
+		log.Printf("Failed to delete device request: %v", err)
+	}
+	s.renderError(w, http.StatusForbidden, errAccessDenied, "The device was not authorized.")
+}
+
+// handle a device access token request https://tools.ietf.org/html/rfc8628#section-3.4
+func (s *Server) handleDeviceToken(w http.ResponseWriter, r *http.Request, client storage.Client) {
+	deviceCode := r.PostFormValue("device_code")
+	if deviceCode == "" {
+		tokenErr(w, errInvalidRequest, "No device_code in request.", http.StatusBadRequest)
+		return
+	}
+
+	deviceToken, err := s.storage.GetDeviceToken(deviceCode)
+	if err != nil || deviceToken.ClientID != client.ID {
+		if err != nil && err != storage.ErrNotFound {
+			log.Printf("failed to get device token: %v", err)
+			tokenErr(w, errServerError, "", http.StatusInternalServerError)
+		} else {
+			tokenErr(w, errInvalidGrant, "Invalid device_code.", http.StatusBadRequest)
+		}
+		return
+	}
+
+	now := s.now()
+	if now.After(deviceToken.Expiry) {
+		tokenErr(w, errExpiredToken, "", http.StatusBadRequest)
+		return
+	}
+
+	if deviceToken.Status == storage.DeviceTokenDenied {
+		// The denial is only reported once.
+		if err := s.storage.DeleteDeviceToken(deviceCode); err != nil && err != storage.ErrNotFound {
+			log.Printf("failed to delete device token: %v", err)
+		}
+		tokenErr(w, errAccessDenied, "The end user denied the request.", http.StatusBadRequest)
+		return
+	}
+
+	if deviceToken.Status == storage.DeviceTokenComplete {
+		var resp accessTokenResponse
+		if err := json.Unmarshal([]byte(deviceToken.Token), &resp); err != nil {
+			log.Printf("failed to unmarshal device token response: %v", err)
+			tokenErr(w, errServerError, "", http.StatusInternalServerError)
+			return
+		}
+		// Tokens can only be collected once.
+		if err := s.storage.DeleteDeviceToken(deviceCode); err != nil {
+			if err != storage.ErrNotFound {
+				log.Printf("failed to delete device token: %v", err)
+				tokenErr(w, errServerError, "", http.StatusInternalServerError)
+			} else {
+				tokenErr(w, errInvalidGrant, "Invalid device_code.", http.StatusBadRequest)
+			}
+			return
+		}
+		s.writeTokenResponse(w, resp)
+		return
+	}
+
+	slowDown := false
+	updater := func(t storage.DeviceToken) (storage.DeviceToken, error) {
+		if now.Before(t.LastRequestTime.Add(t.PollInterval)) {
+			slowDown = true
+			t.PollInterval += deviceSlowDownIncrement
+		}
+		t.LastRequestTime = now
+		return t, nil
+	}
+	if err := s.storage.UpdateDeviceToken(deviceCode, updater); err != nil {
+		log.Printf("failed to update device token: %v", err)
+		tokenErr(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+	if slowDown {
+		tokenErr(w, errSlowDown, "", http.StatusBadRequest)
+		return
+	}
+	tokenErr(w, errAuthorizationPending, "", http.StatusBadRequest)
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"log"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/ericchiang/poke/storage"
+)
+
+// garbageCollector periodically removes expired objects from storage.
+type garbageCollector struct {
+	storage.Storage
+
+	cancel context.CancelFunc
+}
+
+func storageWithGC(s storage.Storage, frequency time.Duration, now func() time.Time) storage.Storage {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		ticker := time.NewTicker(frequency)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				result, err := s.GarbageCollect(now())
+				if err != nil {
+					log.Printf("garbage collection failed: %v", err)
+				}
+				if !result.IsEmpty() {
+					log.Printf("garbage collection deleted auth requests=%d auth codes=%d device requests=%d device tokens=%d client assertions=%d access tokens=%d sessions=%d refresh tokens=%d",
+						result.AuthRequests, result.AuthCodes, result.DeviceRequests, result.DeviceTokens,
+						result.ClientAssertions, result.AccessTokens, result.Sessions, result.RefreshTokens)
+				}
+			}
+		}
+	}()
+	return garbageCollector{s, cancel}
+}
+
+func (g garbageCollector) Close() error {
+	g.cancel()
+	return g.Storage.Close()
+}
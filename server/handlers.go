@@ -2,6 +2,7 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -63,30 +64,74 @@ type discovery struct {
 	Auth          string   `json:"authorization_endpoint"`
 	Token         string   `json:"token_endpoint"`
 	Keys          string   `json:"jwks_uri"`
+	DeviceAuth    string   `json:"device_authorization_endpoint"`
+	Introspect    string   `json:"introspection_endpoint"`
+	Revoke        string   `json:"revocation_endpoint"`
+	UserInfo      string   `json:"userinfo_endpoint"`
+	UserInfoAlgs  []string `json:"userinfo_signing_alg_values_supported"`
+	Register      string   `json:"registration_endpoint,omitempty"`
+	PAR           string   `json:"pushed_authorization_request_endpoint"`
+	RequirePAR    bool     `json:"require_pushed_authorization_requests"`
+	EndSession    string   `json:"end_session_endpoint"`
+	Backchannel   bool     `json:"backchannel_logout_supported"`
 	ResponseTypes []string `json:"response_types_supported"`
+	ResponseModes []string `json:"response_modes_supported"`
 	Subjects      []string `json:"subject_types_supported"`
 	IDTokenAlgs   []string `json:"id_token_signing_alg_values_supported"`
 	Scopes        []string `json:"scopes_supported"`
 	AuthMethods   []string `json:"token_endpoint_auth_methods_supported"`
+	AuthAlgs      []string `json:"token_endpoint_auth_signing_alg_values_supported"`
 	Claims        []string `json:"claims_supported"`
+
+	RequestParameter    bool     `json:"request_parameter_supported"`
+	RequestURIParameter bool     `json:"request_uri_parameter_supported"`
+	RequestObjectAlgs   []string `json:"request_object_signing_alg_values_supported"`
+
+	BackchannelSession bool `json:"backchannel_logout_session_supported"`
+
+	GrantTypes           []string `json:"grant_types_supported"`
+	CodeChallengeMethods []string `json:"code_challenge_methods_supported"`
 }
 
 func (s *Server) handleDiscovery(w http.ResponseWriter, r *http.Request) {
 	// TODO(ericchiang): Cache this
+	alg, err := s.signingAlg()
+	if err != nil {
+		log.Printf("failed to get signing algorithm: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
 	d := discovery{
 		Issuer:        s.issuerURL.String(),
 		Auth:          s.absURL("/auth"),
 		Token:         s.absURL("/token"),
 		Keys:          s.absURL("/keys"),
-		ResponseTypes: []string{"code"},
+		DeviceAuth:    s.absURL("/device/code"),
+		Introspect:    s.absURL("/token/introspect"),
+		Revoke:        s.absURL("/token/revoke"),
+		UserInfo:      s.absURL("/userinfo"),
+		UserInfoAlgs:  []string{string(alg)},
+		PAR:           s.absURL("/par"),
+		EndSession:    s.absURL("/logout"),
+		Backchannel:   true,
+		ResponseTypes: supportedResponseTypes,
 		Subjects:      []string{"public"},
-		IDTokenAlgs:   []string{string(jose.RS256)},
+		ResponseModes: supportedResponseModes,
+		IDTokenAlgs:   []string{string(alg)},
 		Scopes:        []string{"openid", "email", "profile"},
-		AuthMethods:   []string{"client_secret_basic"},
-		Claims: []string{
-			"aud", "email", "email_verified", "exp", "family_name", "given_name",
-			"iat", "iss", "locale", "name", "sub",
-		},
+		AuthMethods:   supportedAuthMethods,
+		AuthAlgs:      supportedAuthSigningAlgs,
+		Claims:        s.claimsSupported(),
+
+		RequestParameter:     true,
+		RequestURIParameter:  true,
+		RequestObjectAlgs:    supportedRequestObjectSigningAlgs,
+		GrantTypes:           supportedGrantTypes,
+		CodeChallengeMethods: supportedCodeChallengeMethods,
+		BackchannelSession:   true,
+	}
+	if s.registrationToken != "" {
+		d.Register = s.absURL("/register")
 	}
 	data, err := json.MarshalIndent(d, "", "  ")
 	if err != nil {
@@ -99,20 +144,55 @@ func (s *Server) handleDiscovery(w http.ResponseWriter, r *http.Request) {
 	w.Write(data)
 }
 
+// How long the end user has to log in and approve an authorization request.
+const authRequestValidFor = 24 * time.Hour
+
 // handleAuthorization handles the OAuth2 auth endpoint.
 func (s *Server) handleAuthorization(w http.ResponseWriter, r *http.Request) {
-	authReq, err := parseAuthorizationRequest(s.storage, r)
-	if err != nil {
-		s.renderError(w, http.StatusInternalServerError, err.Type, err.Description)
-		return
+	var authReq storage.AuthRequest
+	if strings.HasPrefix(r.FormValue("request_uri"), parRequestURIPrefix) {
+		var err *authErr
+		if authReq, err = s.pushedAuthRequest(r); err != nil {
+			status := http.StatusBadRequest
+			if err.Type == errServerError {
+				status = http.StatusInternalServerError
+			}
+			s.renderError(w, status, err.Type, err.Description)
+			return
+		}
+	} else {
+		if err := s.resolveRequestObject(r); err != nil {
+			s.renderError(w, http.StatusBadRequest, err.Type, err.Description)
+			return
+		}
+		var err *authErr
+		if authReq, err = parseAuthorizationRequest(s.storage, r); err != nil {
+			s.renderError(w, http.StatusInternalServerError, err.Type, err.Description)
+			return
+		}
+		client, gerr := s.storage.GetClient(authReq.ClientID)
+		if gerr != nil {
+			log.Printf("Failed to get client: %v", gerr)
+			s.renderError(w, http.StatusInternalServerError, errServerError, "")
+			return
+		}
+		if client.RequirePushedAuthorizationRequests {
+			s.renderError(w, http.StatusBadRequest, errInvalidRequest, "Client must use pushed authorization requests.")
+			return
+		}
 	}
+	authReq.Expiry = s.now().Add(authRequestValidFor)
 	if err := s.storage.CreateAuthRequest(authReq); err != nil {
 		log.Printf("Failed to create authorization request: %v", err)
 		s.renderError(w, http.StatusInternalServerError, errServerError, "")
 		return
 	}
-	state := authReq.ID
+	s.redirectToLogin(w, r, authReq)
+}
 
+// redirectToConnectors sends the end user to login with a connector, or lets
+// them choose one if there are multiple.
+func (s *Server) redirectToConnectors(w http.ResponseWriter, r *http.Request, state string) {
 	if len(s.connectors) == 1 {
 		for id := range s.connectors {
 			http.Redirect(w, r, s.absPath("/auth", id)+"?state="+state, http.StatusFound)
@@ -141,14 +221,21 @@ func (s *Server) handleConnectorLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// TODO(ericchiang): cache user identity.
-
 	state := r.FormValue("state")
 	switch r.Method {
 	case "GET":
+		loginHint := s.loginHint(state)
 		switch conn := conn.Connector.(type) {
 		case connector.CallbackConnector:
-			callbackURL, err := conn.LoginURL(s.absURL("/callback", connID), state)
+			var (
+				callbackURL string
+				err         error
+			)
+			if hintConn, ok := conn.(connector.LoginHintConnector); ok && loginHint != "" {
+				callbackURL, err = hintConn.LoginURLWithHint(s.absURL("/callback", connID), state, loginHint)
+			} else {
+				callbackURL, err = conn.LoginURL(s.absURL("/callback", connID), state)
+			}
 			if err != nil {
 				log.Printf("Connector %q returned error when creating callback: %v", connID, err)
 				s.renderError(w, http.StatusInternalServerError, errServerError, "")
@@ -156,7 +243,7 @@ func (s *Server) handleConnectorLogin(w http.ResponseWriter, r *http.Request) {
 			}
 			http.Redirect(w, r, callbackURL, http.StatusFound)
 		case connector.PasswordConnector:
-			renderPasswordTmpl(w, state, r.URL.String(), "")
+			renderPasswordTmpl(w, state, r.URL.String(), loginHint, "")
 		default:
 			s.notFound(w, r)
 		}
@@ -177,7 +264,12 @@ func (s *Server) handleConnectorLogin(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		if !ok {
-			renderPasswordTmpl(w, state, r.URL.String(), "Invalid credentials")
+			renderPasswordTmpl(w, state, r.URL.String(), username, "Invalid credentials")
+			return
+		}
+		if identity.UserID == "" {
+			log.Printf("Connector %q returned an identity without a user ID", connID)
+			s.renderError(w, http.StatusInternalServerError, errServerError, "")
 			return
 		}
 
@@ -190,12 +282,28 @@ func (s *Server) handleConnectorLogin(w http.ResponseWriter, r *http.Request) {
 			identity.Groups = groups
 		}
 
+		identity.AuthTime = s.now()
+		if identity, err = s.startSession(w, r, identity, connID); err != nil {
+			log.Printf("Failed to create session: %v", err)
+		}
 		s.redirectToApproval(w, r, identity, connID, state)
 	default:
 		s.notFound(w, r)
 	}
 }
 
+// loginHint returns the login hint of an authorization request, if any.
+func (s *Server) loginHint(authReqID string) string {
+	authReq, err := s.storage.GetAuthRequest(authReqID)
+	if err != nil {
+		if err != storage.ErrNotFound {
+			log.Printf("Failed to get auth request: %v", err)
+		}
+		return ""
+	}
+	return authReq.LoginHint
+}
+
 func (s *Server) handleConnectorCallback(w http.ResponseWriter, r *http.Request) {
 	connID := mux.Vars(r)["connector"]
 	conn, ok := s.connectors[connID]
@@ -223,11 +331,19 @@ func (s *Server) handleConnectorCallback(w http.ResponseWriter, r *http.Request)
 	if ok {
 		identity.Groups = groups
 	}
+	identity.AuthTime = s.now()
+	if identity, err = s.startSession(w, r, identity, connID); err != nil {
+		log.Printf("Failed to create session: %v", err)
+	}
 	s.redirectToApproval(w, r, identity, connID, state)
 }
 
 func (s *Server) redirectToApproval(w http.ResponseWriter, r *http.Request, identity storage.Identity, connectorID, state string) {
 	updater := func(a storage.AuthRequest) (storage.AuthRequest, error) {
+		// Requested authentication context classes are echoed as the "acr" claim.
+		if len(a.ACRValues) > 0 {
+			identity.ACR = a.ACRValues[0]
+		}
 		a.Identity = &identity
 		a.ConnectorID = connectorID
 		return a, nil
@@ -241,8 +357,7 @@ func (s *Server) redirectToApproval(w http.ResponseWriter, r *http.Request, iden
 }
 
 func (s *Server) groups(identity storage.Identity, authReqID string, conn connector.Connector) ([]string, bool, error) {
-	groupsConn, ok := conn.(connector.GroupsConnector)
-	if !ok {
+	if _, ok := conn.(connector.GroupsConnector); !ok {
 		return nil, false, nil
 	}
 	authReq, err := s.storage.GetAuthRequest(authReqID)
@@ -250,8 +365,18 @@ func (s *Server) groups(identity storage.Identity, authReqID string, conn connec
 		log.Printf("get auth request: %v", err)
 		return nil, false, err
 	}
+	return groupsForScopes(identity, authReq.Scopes, conn)
+}
+
+// groupsForScopes queries the connector for the user's groups if the connector
+// supports it and the "groups" scope was requested.
+func groupsForScopes(identity storage.Identity, scopes []string, conn connector.Connector) ([]string, bool, error) {
+	groupsConn, ok := conn.(connector.GroupsConnector)
+	if !ok {
+		return nil, false, nil
+	}
 	reqGroups := func() bool {
-		for _, scope := range authReq.Scopes {
+		for _, scope := range scopes {
 			if scope == scopeGroups {
 				return true
 			}
@@ -284,6 +409,21 @@ func (s *Server) handleApproval(w http.ResponseWriter, r *http.Request) {
 			s.sendCodeResponse(w, r, authReq, *authReq.Identity)
 			return
 		}
+		// Device requests are always approved explicitly. A remembered consent
+		// would let anyone who tricks the end user into entering a user code
+		// authorize their own device. See RFC 8628 section 5.4.
+		if !authReq.ForceApprovalPrompt && !s.isDeviceAuthRequest(authReq) {
+			ok, err := s.hasConsent(authReq)
+			if err != nil {
+				log.Printf("Failed to get consent: %v", err)
+				s.renderError(w, http.StatusInternalServerError, errServerError, "")
+				return
+			}
+			if ok {
+				s.sendCodeResponse(w, r, authReq, *authReq.Identity)
+				return
+			}
+		}
 		client, err := s.storage.GetClient(authReq.ClientID)
 		if err != nil {
 			log.Printf("Failed to get client %q: %v", authReq.ClientID, err)
@@ -293,15 +433,23 @@ func (s *Server) handleApproval(w http.ResponseWriter, r *http.Request) {
 		renderApprovalTmpl(w, authReq.ID, *authReq.Identity, client, authReq.Scopes)
 	case "POST":
 		if r.FormValue("approval") != "approve" {
-			s.renderError(w, http.StatusInternalServerError, "approval rejected", "")
+			if s.isDeviceAuthRequest(authReq) {
+				s.denyDevice(w, authReq)
+				return
+			}
+			s.authReqErr(w, r, authReq, errAccessDenied, "End user denied the request.")
 			return
 		}
+		if err := s.recordConsent(authReq); err != nil {
+			// The end user will just be asked to approve the client again.
+			log.Printf("Failed to record consent: %v", err)
+		}
 		s.sendCodeResponse(w, r, authReq, *authReq.Identity)
 	}
 }
 
 func (s *Server) sendCodeResponse(w http.ResponseWriter, r *http.Request, authReq storage.AuthRequest, identity storage.Identity) {
-	if authReq.Expiry.After(s.now()) {
+	if s.now().After(authReq.Expiry) {
 		s.renderError(w, http.StatusBadRequest, errInvalidRequest, "Authorization request period has expired.")
 		return
 	}
@@ -315,55 +463,217 @@ func (s *Server) sendCodeResponse(w http.ResponseWriter, r *http.Request, authRe
 		}
 		return
 	}
-	code := storage.AuthCode{
-		ID:          storage.NewNonce(),
-		ClientID:    authReq.ClientID,
-		ConnectorID: authReq.ConnectorID,
-		Nonce:       authReq.Nonce,
-		Scopes:      authReq.Scopes,
-		Identity:    *authReq.Identity,
-		Expiry:      s.now().Add(time.Minute * 5),
-		RedirectURI: authReq.RedirectURI,
+	s.touchSession(r, authReq.ClientID)
+
+	var (
+		// Was the initial request using the implicit or hybrid flow instead of
+		// the "normal" code flow?
+		implicitOrHybrid = false
+
+		// Only present in hybrid or code flow. code.ID == "" if this is not set.
+		code storage.AuthCode
+
+		// ID token returned immediately if the response_type includes "id_token".
+		// Only valid for implicit and hybrid flows.
+		wantIDToken = false
+		idToken     string
+
+		// Access token returned immediately if the response_type includes "token".
+		accessToken       string
+		accessTokenExpiry time.Time
+	)
+
+	for _, responseType := range authReq.ResponseTypes {
+		switch responseType {
+		case responseTypeCode:
+			code = storage.AuthCode{
+				ID:          storage.NewNonce(),
+				ClientID:    authReq.ClientID,
+				ConnectorID: authReq.ConnectorID,
+				Nonce:       authReq.Nonce,
+				Scopes:      authReq.Scopes,
+				Identity:    *authReq.Identity,
+				Expiry:      s.now().Add(time.Minute * 5),
+				RedirectURI: authReq.RedirectURI,
+
+				CodeChallenge:       authReq.CodeChallenge,
+				CodeChallengeMethod: authReq.CodeChallengeMethod,
+			}
+			if err := s.storage.CreateAuthCode(code); err != nil {
+				log.Printf("Failed to create auth code: %v", err)
+				s.renderError(w, http.StatusInternalServerError, errServerError, "")
+				return
+			}
+		case responseTypeToken:
+			implicitOrHybrid = true
+			client, err := s.storage.GetClient(authReq.ClientID)
+			if err != nil {
+				log.Printf("Failed to get client %q: %v", authReq.ClientID, err)
+				s.renderError(w, http.StatusInternalServerError, errServerError, "")
+				return
+			}
+			if accessToken, accessTokenExpiry, err = s.newAccessToken(client, authReq.ConnectorID, identity, authReq.Scopes, ""); err != nil {
+				log.Printf("Failed to create access token: %v", err)
+				s.renderError(w, http.StatusInternalServerError, errServerError, "")
+				return
+			}
+		case responseTypeIDToken:
+			implicitOrHybrid = true
+			wantIDToken = true
+		}
 	}
-	if err := s.storage.CreateAuthCode(code); err != nil {
-		log.Printf("Failed to create auth code: %v", err)
-		s.renderError(w, http.StatusInternalServerError, errServerError, "")
-		return
+
+	if wantIDToken {
+		// The ID Token binds the code and access token issued in the same response.
+		// See: http://openid.net/specs/openid-connect-core-1_0.html#HybridIDToken
+		var err error
+		idToken, _, err = s.newIDToken(authReq.ClientID, authReq.ConnectorID, identity, authReq.Scopes, authReq.Nonce, accessToken, code.ID)
+		if err != nil {
+			log.Printf("Failed to create ID token: %v", err)
+			s.renderError(w, http.StatusInternalServerError, errServerError, "")
+			return
+		}
 	}
 
 	if authReq.RedirectURI == "urn:ietf:wg:oauth:2.0:oob" {
+		// There's no client to redirect to, so show the end user everything
+		// issued in the response.
 		// TODO(ericchiang): Add a proper template.
-		fmt.Fprintf(w, "Code: %s", code.ID)
+		var lines []string
+		if code.ID != "" {
+			lines = append(lines, "Code: "+code.ID)
+		}
+		if accessToken != "" {
+			lines = append(lines, "Access token: "+accessToken)
+		}
+		if idToken != "" {
+			lines = append(lines, "ID token: "+idToken)
+		}
+		fmt.Fprint(w, strings.Join(lines, "\n"))
 		return
 	}
 
-	u, err := url.Parse(authReq.RedirectURI)
+	if !implicitOrHybrid {
+		v := url.Values{"code": {code.ID}, "state": {authReq.State}}
+		s.sendAuthResponse(w, r, authReq.RedirectURI, responseMode(authReq), v)
+		return
+	}
+
+	// Implicit and hybrid flows return their values in the URL fragment by
+	// default so they aren't sent to the client's server.
+	//
+	// See: http://openid.net/specs/openid-connect-core-1_0.html#HybridAuthResponse
+	v := url.Values{}
+	if code.ID != "" {
+		v.Set("code", code.ID)
+	}
+	if accessToken != "" {
+		v.Set("access_token", accessToken)
+		v.Set("token_type", "bearer")
+		v.Set("expires_in", strconv.Itoa(int(accessTokenExpiry.Sub(s.now()).Seconds())))
+	}
+	if idToken != "" {
+		v.Set("id_token", idToken)
+	}
+	v.Set("state", authReq.State)
+	s.sendAuthResponse(w, r, authReq.RedirectURI, responseMode(authReq), v)
+}
+
+// responseMode returns the response mode of an authorization request. Unless
+// the client chose one, responses which include tokens use the URL fragment and
+// others the query.
+func responseMode(authReq storage.AuthRequest) string {
+	if authReq.ResponseMode != "" {
+		return authReq.ResponseMode
+	}
+	for _, responseType := range authReq.ResponseTypes {
+		if responseType != responseTypeCode {
+			return responseModeFragment
+		}
+	}
+	return responseModeQuery
+}
+
+// sendAuthResponse returns the parameters of an authorization response, or
+// error, to the client's redirect URI using the given response mode.
+func (s *Server) sendAuthResponse(w http.ResponseWriter, r *http.Request, redirectURI, mode string, v url.Values) {
+	u, err := url.Parse(redirectURI)
 	if err != nil {
 		s.renderError(w, http.StatusInternalServerError, errServerError, "Invalid redirect URI.")
 		return
 	}
-	q := u.Query()
-	q.Set("code", code.ID)
-	q.Set("state", authReq.State)
-	u.RawQuery = q.Encode()
-	http.Redirect(w, r, u.String(), http.StatusSeeOther)
+	switch mode {
+	case responseModeFormPost:
+		// The browser posts the parameters to the client, keeping them out of
+		// the URL.
+		renderFormPostTmpl(w, u.String(), v)
+	case responseModeFragment:
+		u.Fragment = ""
+		http.Redirect(w, r, u.String()+"#"+v.Encode(), http.StatusSeeOther)
+	default:
+		q := u.Query()
+		for k, vals := range v {
+			q[k] = vals
+		}
+		u.RawQuery = q.Encode()
+		http.Redirect(w, r, u.String(), http.StatusSeeOther)
+	}
 }
 
 func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	client, ok := s.authenticateClient(w, r)
+	if !ok {
+		return
+	}
+
+	grantType := r.PostFormValue("grant_type")
+	switch grantType {
+	case grantTypeAuthorizationCode:
+		s.handleAuthCode(w, r, client)
+	case grantTypeRefreshToken:
+		s.handleRefreshToken(w, r, client)
+	case grantTypeClientCredentials:
+		s.handleClientCredentials(w, r, client)
+	case grantTypePassword:
+		s.handlePasswordGrant(w, r, client)
+	case grantTypeDeviceCode:
+		s.handleDeviceToken(w, r, client)
+	case grantTypeTokenExchange:
+		s.handleTokenExchange(w, r, client)
+	default:
+		tokenErr(w, errInvalidGrant, "", http.StatusBadRequest)
+	}
+}
+
+// authenticateClient validates the client credentials of a request to the token
+// endpoint, or other endpoints which authenticate clients the same way. If the
+// client can't be authenticated, an error is written to the response and ok is
+// false.
+func (s *Server) authenticateClient(w http.ResponseWriter, r *http.Request) (client storage.Client, ok bool) {
+	if r.PostFormValue("client_assertion") != "" || r.PostFormValue("client_assertion_type") != "" {
+		return s.authenticateClientAssertion(w, r)
+	}
+
+	var method string
 	clientID, clientSecret, ok := r.BasicAuth()
 	if ok {
 		var err error
 		if clientID, err = url.QueryUnescape(clientID); err != nil {
 			tokenErr(w, errInvalidRequest, "client_id improperly encoded", http.StatusBadRequest)
-			return
+			return client, false
 		}
 		if clientSecret, err = url.QueryUnescape(clientSecret); err != nil {
 			tokenErr(w, errInvalidRequest, "client_secret improperly encoded", http.StatusBadRequest)
-			return
+			return client, false
 		}
+		method = authMethodClientSecretBasic
 	} else {
 		clientID = r.PostFormValue("client_id")
 		clientSecret = r.PostFormValue("client_secret")
+		method = authMethodClientSecretPost
+		if _, ok := r.PostForm["client_secret"]; !ok {
+			method = authMethodNone
+		}
 	}
 
 	client, err := s.storage.GetClient(clientID)
@@ -374,28 +684,168 @@ func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
 		} else {
 			tokenErr(w, errInvalidClient, "Invalid client credentials.", http.StatusUnauthorized)
 		}
-		return
+		return client, false
+	}
+	if !checkAuthMethod(w, client, method) {
+		return client, false
 	}
-	if client.Secret != clientSecret {
+	if method != authMethodNone && (client.Secret == "" || client.Secret != clientSecret) {
 		tokenErr(w, errInvalidClient, "Invalid client credentials.", http.StatusUnauthorized)
-		return
+		return client, false
 	}
+	return client, true
+}
 
-	grantType := r.PostFormValue("grant_type")
-	switch grantType {
-	case "authorization_code":
-		s.handleAuthCode(w, r, client)
-	case "refresh_token":
-		s.handleRefreshToken(w, r, client)
+// checkAuthMethod determines if the method a client authenticated with is the
+// one registered for the client. If not, an error is written to the response.
+func checkAuthMethod(w http.ResponseWriter, client storage.Client, method string) bool {
+	want := tokenEndpointAuthMethod(client)
+	if want == authMethodNone && !client.Public {
+		// Clients which can skip authentication must be marked public so the
+		// rest of the server treats them as such.
+		log.Printf("client %q uses token endpoint auth method %q but isn't public", client.ID, want)
+		tokenErr(w, errInvalidClient, "Invalid client credentials.", http.StatusUnauthorized)
+		return false
+	}
+	if client.TokenEndpointAuthMethod == "" && !client.Public && method == authMethodClientSecretPost {
+		// Clients created before auth methods were enforced may send their
+		// secret either way.
+		return true
+	}
+	if method != want {
+		tokenErr(w, errInvalidClient, fmt.Sprintf("Client must authenticate using %q.", want), http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+type clientAssertionClaims struct {
+	Issuer   string   `json:"iss"`
+	Subject  string   `json:"sub"`
+	Audience audience `json:"aud"`
+	Expiry   int64    `json:"exp"`
+	JTI      string   `json:"jti"`
+}
+
+// authenticateClientAssertion authenticates a client using a signed JWT. The
+// JWT is either signed by the client secret, the "client_secret_jwt" method, or
+// by one of the client's registered keys, the "private_key_jwt" method.
+//
+// See https://tools.ietf.org/html/rfc7523#section-2.2
+func (s *Server) authenticateClientAssertion(w http.ResponseWriter, r *http.Request) (client storage.Client, ok bool) {
+	if assertionType := r.PostFormValue("client_assertion_type"); assertionType != clientAssertionTypeJWTBearer {
+		tokenErr(w, errInvalidRequest, fmt.Sprintf("Unsupported client_assertion_type %q.", assertionType), http.StatusBadRequest)
+		return client, false
+	}
+	assertion := r.PostFormValue("client_assertion")
+	jws, err := jose.ParseSigned(assertion)
+	if err != nil || len(jws.Signatures) != 1 {
+		tokenErr(w, errInvalidClient, "Malformed client assertion.", http.StatusUnauthorized)
+		return client, false
+	}
+
+	// The subject of the assertion identifies the client.
+	var claims clientAssertionClaims
+	if err := unverifiedClaims(assertion, &claims); err != nil {
+		tokenErr(w, errInvalidClient, "Malformed client assertion.", http.StatusUnauthorized)
+		return client, false
+	}
+	if clientID := r.PostFormValue("client_id"); clientID != "" && clientID != claims.Subject {
+		tokenErr(w, errInvalidClient, "Client assertion subject doesn't match client_id.", http.StatusUnauthorized)
+		return client, false
+	}
+
+	client, err = s.storage.GetClient(claims.Subject)
+	if err != nil {
+		if err != storage.ErrNotFound {
+			log.Printf("failed to get client: %v", err)
+			tokenErr(w, errServerError, "", http.StatusInternalServerError)
+		} else {
+			tokenErr(w, errInvalidClient, "Invalid client credentials.", http.StatusUnauthorized)
+		}
+		return client, false
+	}
+
+	method := authMethodPrivateKeyJWT
+	switch jose.SignatureAlgorithm(jws.Signatures[0].Header.Algorithm) {
+	case jose.HS256, jose.HS384, jose.HS512:
+		method = authMethodClientSecretJWT
+	}
+	if !checkAuthMethod(w, client, method) {
+		return client, false
+	}
+
+	var payload []byte
+	switch method {
+	case authMethodClientSecretJWT:
+		if client.Secret == "" {
+			err = errors.New("client has no secret")
+			break
+		}
+		payload, err = jws.Verify([]byte(client.Secret))
 	default:
-		tokenErr(w, errInvalidGrant, "", http.StatusBadRequest)
+		payload, err = s.verifySignedByClient(client, jws)
 	}
+	if err != nil {
+		log.Printf("failed to verify assertion for client %q: %v", client.ID, err)
+		tokenErr(w, errInvalidClient, "Invalid client credentials.", http.StatusUnauthorized)
+		return client, false
+	}
+
+	claims = clientAssertionClaims{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		tokenErr(w, errInvalidClient, "Malformed client assertion.", http.StatusUnauthorized)
+		return client, false
+	}
+	if claims.Issuer != client.ID || claims.Subject != client.ID {
+		tokenErr(w, errInvalidClient, "Client assertion issuer and subject must be the client ID.", http.StatusUnauthorized)
+		return client, false
+	}
+	if !claims.Audience.contains(s.absURL("/token")) && !claims.Audience.contains(s.issuerURL.String()) {
+		tokenErr(w, errInvalidClient, "Client assertion audience must be the token endpoint.", http.StatusUnauthorized)
+		return client, false
+	}
+	if claims.JTI == "" {
+		tokenErr(w, errInvalidClient, "Client assertion has no jti claim.", http.StatusUnauthorized)
+		return client, false
+	}
+	expiry := time.Unix(claims.Expiry, 0)
+	now := s.now()
+	if !now.Before(expiry) {
+		tokenErr(w, errInvalidClient, "Client assertion is expired.", http.StatusUnauthorized)
+		return client, false
+	}
+	if expiry.After(now.Add(clientAssertionMaxLifetime)) {
+		tokenErr(w, errInvalidClient, "Client assertion expiry is too far in the future.", http.StatusUnauthorized)
+		return client, false
+	}
+
+	// Record the assertion so it can't be used again.
+	err = s.storage.CreateClientAssertion(storage.ClientAssertion{
+		ClientID: client.ID,
+		JTI:      claims.JTI,
+		Expiry:   expiry,
+	})
+	if err != nil {
+		if err != storage.ErrAlreadyExists {
+			log.Printf("failed to record client assertion: %v", err)
+			tokenErr(w, errServerError, "", http.StatusInternalServerError)
+		} else {
+			tokenErr(w, errInvalidClient, "Client assertion has already been used.", http.StatusUnauthorized)
+		}
+		return client, false
+	}
+	return client, true
 }
 
 // handle an access token request https://tools.ietf.org/html/rfc6749#section-4.1.3
 func (s *Server) handleAuthCode(w http.ResponseWriter, r *http.Request, client storage.Client) {
 	code := r.PostFormValue("code")
 	redirectURI := r.PostFormValue("redirect_uri")
+	resource, ok := requestedResource(w, r, client)
+	if !ok {
+		return
+	}
 
 	authCode, err := s.storage.GetAuthCode(code)
 	if err != nil || s.now().After(authCode.Expiry) || authCode.ClientID != client.ID {
@@ -413,17 +863,65 @@ func (s *Server) handleAuthCode(w http.ResponseWriter, r *http.Request, client s
 		return
 	}
 
-	idToken, expiry, err := s.newIDToken(client.ID, authCode.Identity, authCode.Scopes, authCode.Nonce)
+	codeVerifier := r.PostFormValue("code_verifier")
+	switch {
+	case authCode.CodeChallenge != "":
+		if codeVerifier == "" {
+			tokenErr(w, errInvalidGrant, "Expecting parameter code_verifier in PKCE flow.", http.StatusBadRequest)
+			return
+		}
+		if !verifyCodeVerifier(authCode.CodeChallenge, authCode.CodeChallengeMethod, codeVerifier) {
+			tokenErr(w, errInvalidGrant, "Invalid code_verifier.", http.StatusBadRequest)
+			return
+		}
+	case codeVerifier != "":
+		// The authorization request didn't use PKCE, the client is confused.
+		tokenErr(w, errInvalidRequest, "No PKCE flow started. Cannot check code_verifier.", http.StatusBadRequest)
+		return
+	case client.Public:
+		tokenErr(w, errInvalidGrant, "Public clients must use PKCE.", http.StatusBadRequest)
+		return
+	}
+
+	resp, err := s.exchangeAuthCode(client, authCode, resource)
 	if err != nil {
-		log.Printf("failed to create ID token: %v", err)
 		tokenErr(w, errServerError, "", http.StatusInternalServerError)
 		return
 	}
+	s.writeTokenResponse(w, resp)
+}
+
+// requestedResource returns the "resource" parameter of a token request. If the
+// client isn't allowed to request tokens for the resource, an error is written
+// to the response and ok is false.
+//
+// See https://tools.ietf.org/html/rfc8707#section-2.2
+func requestedResource(w http.ResponseWriter, r *http.Request, client storage.Client) (resource string, ok bool) {
+	resource = r.PostFormValue("resource")
+	if resource == "" {
+		return "", true
+	}
+	for _, allowed := range client.AllowedResources {
+		if resource == allowed {
+			return resource, true
+		}
+	}
+	tokenErr(w, errInvalidTarget, fmt.Sprintf("Client can't request tokens for resource %q.", resource), http.StatusBadRequest)
+	return "", false
+}
+
+// exchangeAuthCode claims an auth code and creates the token response for it.
+// Callers are expected to have already validated the code.
+func (s *Server) exchangeAuthCode(client storage.Client, authCode storage.AuthCode, resource string) (accessTokenResponse, error) {
+	idToken, _, err := s.newIDToken(authCode.ClientID, authCode.ConnectorID, authCode.Identity, authCode.Scopes, authCode.Nonce, "", "")
+	if err != nil {
+		log.Printf("failed to create ID token: %v", err)
+		return accessTokenResponse{}, err
+	}
 
-	if err := s.storage.DeleteAuthCode(code); err != nil {
+	if err := s.storage.DeleteAuthCode(authCode.ID); err != nil {
 		log.Printf("failed to delete auth code: %v", err)
-		tokenErr(w, errServerError, "", http.StatusInternalServerError)
-		return
+		return accessTokenResponse{}, err
 	}
 
 	reqRefresh := func() bool {
@@ -436,6 +934,7 @@ func (s *Server) handleAuthCode(w http.ResponseWriter, r *http.Request, client s
 	}()
 	var refreshToken string
 	if reqRefresh {
+		now := s.now()
 		refresh := storage.Refresh{
 			RefreshToken: storage.NewNonce(),
 			ClientID:     authCode.ClientID,
@@ -443,21 +942,34 @@ func (s *Server) handleAuthCode(w http.ResponseWriter, r *http.Request, client s
 			Scopes:       authCode.Scopes,
 			Identity:     authCode.Identity,
 			Nonce:        authCode.Nonce,
+			CreatedAt:    now,
+			LastUsed:     now,
+			Expiry:       s.refreshExpiry(client, now, now),
 		}
+		refresh.FamilyID = refresh.RefreshToken
 		if err := s.storage.CreateRefresh(refresh); err != nil {
 			log.Printf("failed to create refresh token: %v", err)
-			tokenErr(w, errServerError, "", http.StatusInternalServerError)
-			return
+			return accessTokenResponse{}, err
 		}
 		refreshToken = refresh.RefreshToken
 	}
-	s.writeAccessToken(w, idToken, refreshToken, expiry)
+
+	accessToken, expiry, err := s.newAccessToken(client, authCode.ConnectorID, authCode.Identity, authCode.Scopes, resource)
+	if err != nil {
+		log.Printf("failed to create access token: %v", err)
+		return accessTokenResponse{}, err
+	}
+	return s.newAccessTokenResponse(accessToken, expiry, idToken, refreshToken), nil
 }
 
 // handle a refresh token request https://tools.ietf.org/html/rfc6749#section-6
 func (s *Server) handleRefreshToken(w http.ResponseWriter, r *http.Request, client storage.Client) {
 	code := r.PostFormValue("refresh_token")
 	scope := r.PostFormValue("scope")
+	resource, ok := requestedResource(w, r, client)
+	if !ok {
+		return
+	}
 	if code == "" {
 		tokenErr(w, errInvalidRequest, "No refresh token in request.", http.StatusBadRequest)
 		return
@@ -473,6 +985,22 @@ func (s *Server) handleRefreshToken(w http.ResponseWriter, r *http.Request, clie
 		}
 		return
 	}
+	if err := s.checkRefreshReuse(refresh); err != nil {
+		if err == errRefreshReused {
+			log.Printf("refresh token reused by client %q, revoking token family", client.ID)
+			s.revokeRefreshFamily(refresh)
+			tokenErr(w, errInvalidGrant, "Refresh token has already been used.", http.StatusBadRequest)
+			return
+		}
+		log.Printf("failed to check refresh token reuse: %v", err)
+		tokenErr(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+	if s.refreshExpired(client, refresh) {
+		s.revokeRefreshFamily(refresh)
+		tokenErr(w, errInvalidGrant, "Refresh token has expired.", http.StatusBadRequest)
+		return
+	}
 
 	scopes := refresh.Scopes
 	if scope != "" {
@@ -496,46 +1024,750 @@ func (s *Server) handleRefreshToken(w http.ResponseWriter, r *http.Request, clie
 		scopes = requestedScopes
 	}
 
-	// TODO(ericchiang): re-auth with backends
+	identity, err := s.refreshIdentity(refresh, scopes)
+	if err != nil {
+		if err == connector.ErrRevoked {
+			log.Printf("revoking refresh token for user %q: %v", refresh.Identity.UserID, err)
+			s.revokeRefreshFamily(refresh)
+			tokenErr(w, errInvalidGrant, "Refresh token has been revoked.", http.StatusBadRequest)
+			return
+		}
+		log.Printf("failed to refresh identity with connector %q: %v", refresh.ConnectorID, err)
+		tokenErr(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+	refresh.Identity = identity
 
-	idToken, expiry, err := s.newIDToken(client.ID, refresh.Identity, scopes, refresh.Nonce)
+	idToken, _, err := s.newIDToken(client.ID, refresh.ConnectorID, refresh.Identity, scopes, refresh.Nonce, "", "")
 	if err != nil {
 		log.Printf("failed to create ID token: %v", err)
 		tokenErr(w, errServerError, "", http.StatusInternalServerError)
 		return
 	}
 
-	if err := s.storage.DeleteRefresh(code); err != nil {
-		log.Printf("failed to delete auth code: %v", err)
+	refresh, err = s.rotateRefresh(client, refresh)
+	if err != nil {
+		if err == errRefreshReused {
+			log.Printf("refresh token reused by client %q, revoking token family", client.ID)
+			s.revokeRefreshFamily(refresh)
+			tokenErr(w, errInvalidGrant, "Refresh token has already been used.", http.StatusBadRequest)
+			return
+		}
+		log.Printf("failed to rotate refresh token: %v", err)
 		tokenErr(w, errServerError, "", http.StatusInternalServerError)
 		return
 	}
-	refresh.RefreshToken = storage.NewNonce()
-	if err := s.storage.CreateRefresh(refresh); err != nil {
-		log.Printf("failed to create refresh token: %v", err)
+	accessToken, expiry, err := s.newAccessToken(client, refresh.ConnectorID, refresh.Identity, scopes, resource)
+	if err != nil {
+		log.Printf("failed to create access token: %v", err)
 		tokenErr(w, errServerError, "", http.StatusInternalServerError)
 		return
 	}
-	s.writeAccessToken(w, idToken, refresh.RefreshToken, expiry)
+	s.writeTokenResponse(w, s.newAccessTokenResponse(accessToken, expiry, idToken, refresh.RefreshToken))
+}
+
+// refreshIdentity checks the identity of a refresh token with its connector, if
+// the connector supports it, returning the updated identity. Groups are updated
+// if the refresh requests them. The refresh token should be revoked if this
+// returns connector.ErrRevoked.
+func (s *Server) refreshIdentity(refresh storage.Refresh, scopes []string) (storage.Identity, error) {
+	identity := refresh.Identity
+	conn, ok := s.connectors[refresh.ConnectorID]
+	if !ok {
+		// The connector has been removed from the server's config.
+		return identity, connector.ErrRevoked
+	}
+	refreshConn, ok := conn.Connector.(connector.RefreshConnector)
+	if !ok {
+		return identity, nil
+	}
+	updated, err := refreshConn.Refresh(identity)
+	if err != nil {
+		return identity, err
+	}
+	// The end user hasn't authenticated again.
+	updated.AuthTime, updated.ACR = identity.AuthTime, identity.ACR
+
+	groups, ok, err := groupsForScopes(updated, scopes, conn.Connector)
+	if err != nil {
+		return identity, fmt.Errorf("get groups: %v", err)
+	}
+	if ok {
+		updated.Groups = groups
+	}
+	return updated, nil
 }
 
-func (s *Server) writeAccessToken(w http.ResponseWriter, idToken, refreshToken string, expiry time.Time) {
-	// TODO(ericchiang): figure out an access token story and support the user info
-	// endpoint. For now use a random value so no one depends on the access_token
-	// holding a specific structure.
-	resp := struct {
-		AccessToken  string `json:"access_token"`
-		TokenType    string `json:"token_type"`
-		ExpiresIn    int    `json:"expires_in"`
-		RefreshToken string `json:"refresh_token,omitempty"`
-		IDToken      string `json:"id_token"`
-	}{
-		storage.NewNonce(),
-		"bearer",
-		int(expiry.Sub(s.now())),
-		refreshToken,
-		idToken,
+// handle a client credentials request https://tools.ietf.org/html/rfc6749#section-4.4
+func (s *Server) handleClientCredentials(w http.ResponseWriter, r *http.Request, client storage.Client) {
+	if client.Public {
+		tokenErr(w, errUnauthorizedClient, "Public clients cannot use the client_credentials grant.", http.StatusBadRequest)
+		return
+	}
+
+	// If the client doesn't request specific scopes, grant everything it's allowed.
+	scopes := client.AllowedScopes
+	if scope := r.PostFormValue("scope"); scope != "" {
+		scopes = strings.Split(scope, " ")
+	}
+	if len(scopes) == 0 {
+		tokenErr(w, errUnauthorizedClient, "Client is not allowed to use the client_credentials grant.", http.StatusBadRequest)
+		return
+	}
+
+	var invalidScopes []string
+Loop:
+	for _, scope := range scopes {
+		for _, allowed := range client.AllowedScopes {
+			if scope == allowed {
+				continue Loop
+			}
+		}
+		invalidScopes = append(invalidScopes, scope)
 	}
+	if len(invalidScopes) > 0 {
+		tokenErr(w, errInvalidScope, fmt.Sprintf("Client can't request scope(s) %q", invalidScopes), http.StatusBadRequest)
+		return
+	}
+	resource, ok := requestedResource(w, r, client)
+	if !ok {
+		return
+	}
+
+	// Tokens a client obtains for itself are always JWTs with the client as
+	// their subject.
+	client.JWTAccessTokens = true
+	accessToken, expiry, err := s.newAccessToken(client, "", storage.Identity{UserID: client.ID}, scopes, resource)
+	if err != nil {
+		log.Printf("failed to create access token: %v", err)
+		tokenErr(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+	// No refresh token, the client can always request a new access token.
+	// See: https://tools.ietf.org/html/rfc6749#section-4.4.3
+	s.writeTokenResponse(w, accessTokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "bearer",
+		ExpiresIn:   int(expiry.Sub(s.now()).Seconds()),
+		Scope:       strings.Join(scopes, " "),
+	})
+}
+
+// handle a resource owner password credentials request https://tools.ietf.org/html/rfc6749#section-4.3
+func (s *Server) handlePasswordGrant(w http.ResponseWriter, r *http.Request, client storage.Client) {
+	if s.passwordConnector == "" {
+		tokenErr(w, errUnsupportedGrantType, "Server does not support the password grant.", http.StatusBadRequest)
+		return
+	}
+	if !client.AllowPasswordGrant {
+		tokenErr(w, errUnauthorizedClient, "Client is not allowed to use the password grant.", http.StatusBadRequest)
+		return
+	}
+
+	username := r.PostFormValue("username")
+	password := r.PostFormValue("password")
+	if username == "" || password == "" {
+		tokenErr(w, errInvalidRequest, "Username and password are required.", http.StatusBadRequest)
+		return
+	}
+	resource, ok := requestedResource(w, r, client)
+	if !ok {
+		return
+	}
+
+	scopes := strings.Split(r.PostFormValue("scope"), " ")
+	hasOpenIDScope, unrecognized, invalidScopes, err := validateScopes(s.storage, client.ID, scopes)
+	if err != nil {
+		tokenErr(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+	switch {
+	case !hasOpenIDScope:
+		tokenErr(w, errInvalidScope, `Missing required scope(s) ["openid"].`, http.StatusBadRequest)
+		return
+	case len(unrecognized) > 0:
+		tokenErr(w, errInvalidScope, fmt.Sprintf("Unrecognized scope(s) %q", unrecognized), http.StatusBadRequest)
+		return
+	case len(invalidScopes) > 0:
+		tokenErr(w, errInvalidScope, fmt.Sprintf("Client can't request scope(s) %q", invalidScopes), http.StatusBadRequest)
+		return
+	}
+
+	conn := s.connectors[s.passwordConnector]
+	identity, ok, err := conn.Connector.(connector.PasswordConnector).Login(username, password)
+	if err != nil {
+		log.Printf("Failed to login user: %v", err)
+		tokenErr(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		tokenErr(w, errInvalidGrant, "Invalid username or password.", http.StatusBadRequest)
+		return
+	}
+	if identity.UserID == "" {
+		// The user ID is the subject of the tokens.
+		log.Printf("Connector %q returned an identity without a user ID", s.passwordConnector)
+		tokenErr(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+
+	groups, ok, err := groupsForScopes(identity, scopes, conn.Connector)
+	if err != nil {
+		log.Printf("Failed to get groups: %v", err)
+		tokenErr(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+	if ok {
+		identity.Groups = groups
+	}
+
+	idToken, _, err := s.newIDToken(client.ID, s.passwordConnector, identity, scopes, "", "", "")
+	if err != nil {
+		log.Printf("failed to create ID token: %v", err)
+		tokenErr(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+
+	reqRefresh := func() bool {
+		for _, scope := range scopes {
+			if scope == scopeOfflineAccess {
+				return true
+			}
+		}
+		return false
+	}()
+	var refreshToken string
+	if reqRefresh {
+		now := s.now()
+		refresh := storage.Refresh{
+			RefreshToken: storage.NewNonce(),
+			ClientID:     client.ID,
+			ConnectorID:  s.passwordConnector,
+			Scopes:       scopes,
+			Identity:     identity,
+			CreatedAt:    now,
+			LastUsed:     now,
+			Expiry:       s.refreshExpiry(client, now, now),
+		}
+		refresh.FamilyID = refresh.RefreshToken
+		if err := s.storage.CreateRefresh(refresh); err != nil {
+			log.Printf("failed to create refresh token: %v", err)
+			tokenErr(w, errServerError, "", http.StatusInternalServerError)
+			return
+		}
+		refreshToken = refresh.RefreshToken
+	}
+	accessToken, expiry, err := s.newAccessToken(client, s.passwordConnector, identity, scopes, resource)
+	if err != nil {
+		log.Printf("failed to create access token: %v", err)
+		tokenErr(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+	s.writeTokenResponse(w, s.newAccessTokenResponse(accessToken, expiry, idToken, refreshToken))
+}
+
+// subjectTokenClaims are the claims read from the subject token of a token
+// exchange request.
+type subjectTokenClaims struct {
+	Issuer        string   `json:"iss"`
+	Subject       string   `json:"sub"`
+	Audience      audience `json:"aud"`
+	Expiry        int64    `json:"exp"`
+	Email         string   `json:"email"`
+	EmailVerified bool     `json:"email_verified"`
+	Groups        []string `json:"groups"`
+	Name          string   `json:"name"`
+	Scope         string   `json:"scope"`
+}
+
+// grantedScopes returns the scopes the subject token was issued with. ID Tokens
+// don't list their scopes, so these are inferred from the claims present.
+func (c subjectTokenClaims) grantedScopes() []string {
+	if c.Scope != "" {
+		return strings.Fields(c.Scope)
+	}
+	scopes := []string{scopeOpenID}
+	if c.Email != "" {
+		scopes = append(scopes, scopeEmail)
+	}
+	if c.Groups != nil {
+		scopes = append(scopes, scopeGroups)
+	}
+	if c.Name != "" {
+		scopes = append(scopes, scopeProfile)
+	}
+	return scopes
+}
+
+// handleTokenExchange implements OAuth 2.0 Token Exchange, swapping an ID Token
+// issued by this server or a trusted issuer for an ID Token with a different
+// audience. A client may only obtain tokens for audiences which list it as a
+// trusted peer.
+//
+// See https://tools.ietf.org/html/rfc8693
+func (s *Server) handleTokenExchange(w http.ResponseWriter, r *http.Request, client storage.Client) {
+	if client.Public {
+		tokenErr(w, errUnauthorizedClient, "Public clients can't use token exchange.", http.StatusBadRequest)
+		return
+	}
+
+	subjectToken := r.PostFormValue("subject_token")
+	if subjectToken == "" {
+		tokenErr(w, errInvalidRequest, "Required param: subject_token.", http.StatusBadRequest)
+		return
+	}
+	switch subjectTokenType := r.PostFormValue("subject_token_type"); subjectTokenType {
+	case tokenTypeIDToken, tokenTypeJWT:
+	case "":
+		tokenErr(w, errInvalidRequest, "Required param: subject_token_type.", http.StatusBadRequest)
+		return
+	default:
+		tokenErr(w, errInvalidRequest, fmt.Sprintf("Unsupported subject_token_type %q.", subjectTokenType), http.StatusBadRequest)
+		return
+	}
+	if t := r.PostFormValue("requested_token_type"); t != "" && t != tokenTypeIDToken {
+		tokenErr(w, errInvalidRequest, fmt.Sprintf("Unsupported requested_token_type %q.", t), http.StatusBadRequest)
+		return
+	}
+
+	claims, err := s.verifySubjectToken(subjectToken)
+	if err != nil {
+		log.Printf("Invalid subject token: %v", err)
+		tokenErr(w, errInvalidGrant, "Invalid subject_token.", http.StatusBadRequest)
+		return
+	}
+
+	// The subject token must have been issued to the client, or to a client
+	// which trusts it to act on its behalf.
+	var issuedToClient bool
+	for _, aud := range claims.Audience {
+		isTrusted, err := validateCrossClientTrust(s.storage, client.ID, aud)
+		if err != nil {
+			tokenErr(w, errServerError, "", http.StatusInternalServerError)
+			return
+		}
+		if isTrusted {
+			issuedToClient = true
+			break
+		}
+	}
+	if !issuedToClient {
+		tokenErr(w, errInvalidGrant, "subject_token wasn't issued to the client or a client which trusts it.", http.StatusBadRequest)
+		return
+	}
+
+	// Exchanged tokens can't be granted more scopes than the subject token.
+	granted := claims.grantedScopes()
+	scopes := granted
+	if scope := r.PostFormValue("scope"); scope != "" {
+		isGranted := make(map[string]bool, len(granted))
+		for _, sc := range granted {
+			isGranted[sc] = true
+		}
+		scopes = nil
+		for _, sc := range strings.Fields(scope) {
+			if !isGranted[sc] {
+				tokenErr(w, errInvalidScope, fmt.Sprintf("Scope %q wasn't granted to the subject_token.", sc), http.StatusBadRequest)
+				return
+			}
+			scopes = append(scopes, sc)
+		}
+	}
+
+	audiences := r.PostForm["audience"]
+	if len(audiences) == 0 {
+		audiences = []string{client.ID}
+	}
+	for _, aud := range audiences {
+		isTrusted, err := validateCrossClientTrust(s.storage, client.ID, aud)
+		if err != nil {
+			tokenErr(w, errServerError, "", http.StatusInternalServerError)
+			return
+		}
+		if !isTrusted {
+			tokenErr(w, errInvalidTarget, fmt.Sprintf("Client can't obtain tokens for audience %q.", aud), http.StatusBadRequest)
+			return
+		}
+		scopes = append(scopes, scopeCrossClientPrefix+aud)
+	}
+
+	// Subjects are only unique per issuer. Qualify those from trusted issuers so
+	// they can't collide with the user IDs of local identities.
+	subject := claims.Subject
+	if claims.Issuer != s.issuerURL.String() {
+		subject = claims.Issuer + "#" + claims.Subject
+	}
+	identity := storage.Identity{
+		UserID:        subject,
+		Username:      claims.Name,
+		Email:         claims.Email,
+		EmailVerified: claims.EmailVerified,
+		Groups:        claims.Groups,
+	}
+	idToken, expiry, err := s.newIDToken(client.ID, "", identity, scopes, "", "", "")
+	if err != nil {
+		log.Printf("failed to create ID token: %v", err)
+		tokenErr(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+
+	// The issued token is an ID Token, not an OAuth2 access token, so the token
+	// type is "N_A". See https://tools.ietf.org/html/rfc8693#section-2.2.1
+	s.writeTokenResponse(w, accessTokenResponse{
+		AccessToken:     idToken,
+		IssuedTokenType: tokenTypeIDToken,
+		TokenType:       "N_A",
+		ExpiresIn:       int(expiry.Sub(s.now()).Seconds()),
+	})
+}
+
+// verifySubjectToken validates the signature and expiry of a token issued either
+// by this server or by one of the configured trusted issuers.
+func (s *Server) verifySubjectToken(token string) (subjectTokenClaims, error) {
+	var claims subjectTokenClaims
+	jws, err := jose.ParseSigned(token)
+	if err != nil {
+		return claims, fmt.Errorf("parse token: %v", err)
+	}
+
+	// Peek at the issuer to determine which keys to verify the token with.
+	if err := unverifiedClaims(token, &claims); err != nil {
+		return claims, err
+	}
+
+	var payload []byte
+	if claims.Issuer == s.issuerURL.String() {
+		payload, err = s.verifySignedByServer(jws)
+	} else if jwksURL, ok := s.trustedIssuers[claims.Issuer]; ok {
+		payload, err = s.remoteKeys(jwksURL).verify(jws)
+	} else {
+		return claims, fmt.Errorf("untrusted issuer %q", claims.Issuer)
+	}
+	if err != nil {
+		return claims, fmt.Errorf("verify token from %q: %v", claims.Issuer, err)
+	}
+
+	claims = subjectTokenClaims{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return claims, fmt.Errorf("decode claims: %v", err)
+	}
+	if claims.Subject == "" {
+		return claims, errors.New("token has no subject")
+	}
+	if !s.now().Before(time.Unix(claims.Expiry, 0)) {
+		return claims, errors.New("token is expired")
+	}
+	return claims, nil
+}
+
+// introspectionResponse describes the state of a token to a resource server.
+//
+// See https://tools.ietf.org/html/rfc7662#section-2.2
+type introspectionResponse struct {
+	Active   bool     `json:"active"`
+	Scope    string   `json:"scope,omitempty"`
+	ClientID string   `json:"client_id,omitempty"`
+	Subject  string   `json:"sub,omitempty"`
+	Expiry   int64    `json:"exp,omitempty"`
+	Audience audience `json:"aud,omitempty"`
+	Groups   []string `json:"groups,omitempty"`
+}
+
+// handleIntrospect lets authenticated clients, such as resource servers,
+// determine if an access token is active and what it grants.
+//
+// See https://tools.ietf.org/html/rfc7662
+func (s *Server) handleIntrospect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		tokenErr(w, errInvalidRequest, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := s.authenticateClient(w, r); !ok {
+		return
+	}
+
+	token := r.PostFormValue("token")
+	if token == "" {
+		tokenErr(w, errInvalidRequest, "Required param: token.", http.StatusBadRequest)
+		return
+	}
+	resp, err := s.introspect(token)
+	if err != nil {
+		log.Printf("failed to introspect token: %v", err)
+		tokenErr(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+
+	data, err := json.Marshal(resp)
+	if err != nil {
+		log.Printf("failed to marshal introspection response: %v", err)
+		tokenErr(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
+
+// introspect looks up an access token. Unknown, expired and malformed tokens
+// are all reported as inactive.
+func (s *Server) introspect(token string) (introspectionResponse, error) {
+	var inactive introspectionResponse
+
+	tok, err := s.lookupAccessToken(token)
+	if err != nil {
+		if err == storage.ErrNotFound {
+			return inactive, nil
+		}
+		return inactive, err
+	}
+	if !s.now().Before(tok.Expiry) {
+		return inactive, nil
+	}
+	resp := introspectionResponse{
+		Active:   true,
+		Scope:    strings.Join(tok.Scopes, " "),
+		ClientID: tok.ClientID,
+		Subject:  tok.Identity.UserID,
+		Expiry:   tok.Expiry.Unix(),
+	}
+	if tok.Resource != "" {
+		resp.Audience = audience{tok.Resource}
+	}
+	for _, scope := range tok.Scopes {
+		if scope == scopeGroups {
+			resp.Groups = tok.Identity.Groups
+		}
+	}
+	return resp, nil
+}
+
+// handleRevoke invalidates a refresh or access token issued to the client. As
+// required by the RFC, the response is the same whether or not a token was
+// found, so clients can't probe for other clients' tokens.
+//
+// See https://tools.ietf.org/html/rfc7009
+func (s *Server) handleRevoke(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		tokenErr(w, errInvalidRequest, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	client, ok := s.authenticateClient(w, r)
+	if !ok {
+		return
+	}
+
+	token := r.PostFormValue("token")
+	if token == "" {
+		tokenErr(w, errInvalidRequest, "Required param: token.", http.StatusBadRequest)
+		return
+	}
+
+	revokers := []func(clientID, token string) error{s.revokeRefreshToken, s.revokeAccessToken}
+	if r.PostFormValue("token_type_hint") == "access_token" {
+		revokers[0], revokers[1] = revokers[1], revokers[0]
+	}
+	for _, revoke := range revokers {
+		if err := revoke(client.ID, token); err != nil {
+			if err == storage.ErrNotFound {
+				continue
+			}
+			log.Printf("failed to revoke token: %v", err)
+			tokenErr(w, errServerError, "", http.StatusInternalServerError)
+			return
+		}
+		break
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// revokeRefreshToken deletes a refresh token, and the rest of its family, if it
+// belongs to the client. It returns storage.ErrNotFound if the client has no
+// such token.
+func (s *Server) revokeRefreshToken(clientID, token string) error {
+	refresh, err := s.storage.GetRefresh(token)
+	if err != nil {
+		return err
+	}
+	if refresh.ClientID != clientID {
+		return storage.ErrNotFound
+	}
+	s.revokeRefreshFamily(refresh)
+	return nil
+}
+
+// revokeAccessToken deletes an access token if it belongs to the client. It
+// returns storage.ErrNotFound if the client has no such token.
+//
+// Resource servers which validate JWT access tokens locally won't observe the
+// revocation until the token expires.
+func (s *Server) revokeAccessToken(clientID, token string) error {
+	tok, err := s.lookupAccessToken(token)
+	if err != nil {
+		return err
+	}
+	if tok.ClientID != clientID {
+		return storage.ErrNotFound
+	}
+	return s.storage.DeleteAccessToken(tok.Token)
+}
+
+// userInfoClaims are the claims returned by the user info endpoint. Issuer and
+// audience are only set when the response is signed.
+type userInfoClaims struct {
+	Issuer   string   `json:"iss,omitempty"`
+	Audience audience `json:"aud,omitempty"`
+
+	Subject       string   `json:"sub"`
+	Email         string   `json:"email,omitempty"`
+	EmailVerified *bool    `json:"email_verified,omitempty"`
+	Groups        []string `json:"groups,omitempty"`
+	Name          string   `json:"name,omitempty"`
+}
+
+// handleUserInfo returns the claims of the end user an access token was issued
+// for, filtered by the scopes the token was granted.
+//
+// See http://openid.net/specs/openid-connect-core-1_0.html#UserInfo
+func (s *Server) handleUserInfo(w http.ResponseWriter, r *http.Request) {
+	token, ok := bearerToken(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Missing bearer token.", http.StatusUnauthorized)
+		return
+	}
+
+	tok, err := s.lookupAccessToken(token)
+	if err != nil {
+		if err != storage.ErrNotFound {
+			log.Printf("failed to get access token: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		bearerErr(w, "invalid_token", "Invalid access token.", http.StatusUnauthorized)
+		return
+	}
+	if !s.now().Before(tok.Expiry) {
+		bearerErr(w, "invalid_token", "Access token is expired.", http.StatusUnauthorized)
+		return
+	}
+
+	claims := userInfoClaims{Subject: tok.Identity.UserID}
+	hasOpenIDScope := false
+	for _, scope := range tok.Scopes {
+		switch scope {
+		case scopeOpenID:
+			hasOpenIDScope = true
+		case scopeEmail:
+			claims.Email = tok.Identity.Email
+			claims.EmailVerified = &tok.Identity.EmailVerified
+		case scopeGroups:
+			claims.Groups = tok.Identity.Groups
+		case scopeProfile:
+			claims.Name = tok.Identity.Username
+		}
+	}
+	if !hasOpenIDScope {
+		bearerErr(w, "insufficient_scope", `Access token wasn't granted the "openid" scope.`, http.StatusForbidden)
+		return
+	}
+
+	client, err := s.storage.GetClient(tok.ClientID)
+	if err != nil {
+		log.Printf("failed to get client %q: %v", tok.ClientID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	contentType := "application/json"
+	if client.UserInfoSignedResponseAlg != "" {
+		claims.Issuer = s.issuerURL.String()
+		claims.Audience = audience{client.ID}
+	}
+	data, err := marshalClaims(claims, s.mappedClaims(tok.ConnectorID, tok.Identity, tok.Scopes))
+	if err != nil {
+		log.Printf("failed to marshal user info: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if client.UserInfoSignedResponseAlg != "" {
+		keys, err := s.storage.GetKeys()
+		if err != nil {
+			log.Printf("failed to get keys: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		// The alg was checked at registration, but the server's keys may have
+		// changed since.
+		if alg, err := storage.SignatureAlgorithm(keys.SigningKey); err != nil || string(alg) != client.UserInfoSignedResponseAlg {
+			log.Printf("can't sign user info for client %q with %q: signing key uses %q (%v)",
+				client.ID, client.UserInfoSignedResponseAlg, alg, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		signed, err := keys.Sign(data)
+		if err != nil {
+			log.Printf("failed to sign user info: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		data = []byte(signed)
+		contentType = "application/jwt"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
+
+// bearerToken returns the access token a request presents, either through the
+// Authorization header or a form-encoded body.
+//
+// See https://tools.ietf.org/html/rfc6750#section-2
+func bearerToken(r *http.Request) (token string, ok bool) {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		parts := strings.SplitN(auth, " ", 2)
+		if len(parts) != 2 || !strings.EqualFold(parts[0], "bearer") || parts[1] == "" {
+			return "", false
+		}
+		return parts[1], true
+	}
+	if r.Method == "POST" {
+		if token := r.PostFormValue("access_token"); token != "" {
+			return token, true
+		}
+	}
+	return "", false
+}
+
+// bearerErr writes an error for a request to a resource protected by bearer tokens.
+//
+// See https://tools.ietf.org/html/rfc6750#section-3
+func bearerErr(w http.ResponseWriter, typ, description string, statusCode int) {
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf("Bearer error=%q, error_description=%q", typ, description))
+	http.Error(w, description, statusCode)
+}
+
+type accessTokenResponse struct {
+	AccessToken     string `json:"access_token"`
+	IssuedTokenType string `json:"issued_token_type,omitempty"`
+	TokenType       string `json:"token_type"`
+	ExpiresIn       int    `json:"expires_in"`
+	RefreshToken    string `json:"refresh_token,omitempty"`
+	IDToken         string `json:"id_token,omitempty"`
+	Scope           string `json:"scope,omitempty"`
+}
+
+func (s *Server) newAccessTokenResponse(accessToken string, expiry time.Time, idToken, refreshToken string) accessTokenResponse {
+	return accessTokenResponse{
+		AccessToken:  accessToken,
+		TokenType:    "bearer",
+		ExpiresIn:    int(expiry.Sub(s.now()).Seconds()),
+		RefreshToken: refreshToken,
+		IDToken:      idToken,
+	}
+}
+
+func (s *Server) writeTokenResponse(w http.ResponseWriter, resp accessTokenResponse) {
 	data, err := json.Marshal(resp)
 	if err != nil {
 		log.Printf("failed to marshal access token response: %v", err)
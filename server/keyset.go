@@ -0,0 +1,199 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	jose "gopkg.in/square/go-jose.v2"
+
+	"github.com/ericchiang/poke/storage"
+)
+
+const (
+	// How long to cache keys fetched from a JWKS URL.
+	remoteKeysValidFor = 5 * time.Minute
+	// Minimum time between fetches triggered by signatures no cached key can
+	// verify, such as after the remote issuer rotates its keys.
+	remoteKeysMinRefresh = time.Minute
+)
+
+var errNoMatchingKey = errors.New("no keys can verify the signature")
+
+// Algorithms of signatures which can be verified using public keys.
+var asymmetricAlgs = map[jose.SignatureAlgorithm]bool{
+	jose.RS256: true, jose.RS384: true, jose.RS512: true,
+	jose.PS256: true, jose.PS384: true, jose.PS512: true,
+	jose.ES256: true, jose.ES384: true, jose.ES512: true,
+}
+
+// remoteKeySet caches the public keys served from a JWKS URL.
+type remoteKeySet struct {
+	jwksURL string
+	client  *http.Client
+	now     func() time.Time
+
+	// mu guards the following fields. It's held while fetching keys so only one
+	// request is made at a time.
+	mu        sync.Mutex
+	keys      []jose.JSONWebKey
+	lastFetch time.Time
+}
+
+func newRemoteKeySet(jwksURL string, client *http.Client, now func() time.Time) *remoteKeySet {
+	return &remoteKeySet{jwksURL: jwksURL, client: client, now: now}
+}
+
+// verify validates the signature of a JWS using the remote keys, returning the payload.
+func (r *remoteKeySet) verify(jws *jose.JSONWebSignature) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	if now.Before(r.lastFetch.Add(remoteKeysValidFor)) {
+		if payload, err := verifyWithKeys(jws, r.keys); err == nil {
+			return payload, nil
+		}
+		if now.Before(r.lastFetch.Add(remoteKeysMinRefresh)) {
+			return nil, errNoMatchingKey
+		}
+	}
+
+	keys, err := r.fetch()
+	if err != nil {
+		return nil, err
+	}
+	r.keys = keys
+	r.lastFetch = now
+	return verifyWithKeys(jws, r.keys)
+}
+
+func (r *remoteKeySet) fetch() ([]jose.JSONWebKey, error) {
+	resp, err := r.client.Get(r.jwksURL)
+	if err != nil {
+		return nil, fmt.Errorf("get keys: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("read keys: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("get keys: %s %s", resp.Status, body)
+	}
+	var keySet jose.JSONWebKeySet
+	if err := json.Unmarshal(body, &keySet); err != nil {
+		return nil, fmt.Errorf("decode keys: %v", err)
+	}
+	return keySet.Keys, nil
+}
+
+// verifyWithKeys validates the signature of a JWS using the first key which
+// matches the signature's key ID.
+func verifyWithKeys(jws *jose.JSONWebSignature, keys []jose.JSONWebKey) ([]byte, error) {
+	for _, sig := range jws.Signatures {
+		if !asymmetricAlgs[jose.SignatureAlgorithm(sig.Header.Algorithm)] {
+			// The vendored version of go-jose panics when verifying signatures
+			// such as "none" with public keys.
+			continue
+		}
+		for i := range keys {
+			key := &keys[i]
+			if sig.Header.KeyID != "" && key.KeyID != sig.Header.KeyID {
+				continue
+			}
+			if key.Use != "" && key.Use != "sig" {
+				continue
+			}
+			if payload, err := jws.Verify(key); err == nil {
+				return payload, nil
+			}
+		}
+	}
+	return nil, errNoMatchingKey
+}
+
+// remoteKeys returns the cached key set for a JWKS URL.
+func (s *Server) remoteKeys(jwksURL string) *remoteKeySet {
+	s.keySetsMu.Lock()
+	defer s.keySetsMu.Unlock()
+	keySet, ok := s.keySets[jwksURL]
+	if !ok {
+		keySet = newRemoteKeySet(jwksURL, s.httpClient, s.now)
+		s.keySets[jwksURL] = keySet
+	}
+	return keySet
+}
+
+// verifySignedByClient validates a JWS signed by one of a client's registered
+// keys.
+func (s *Server) verifySignedByClient(client storage.Client, jws *jose.JSONWebSignature) ([]byte, error) {
+	switch {
+	case client.JWKS != nil:
+		return verifyWithKeys(jws, client.JWKS.Keys)
+	case client.JWKSURI != "":
+		return s.remoteKeys(client.JWKSURI).verify(jws)
+	default:
+		return nil, errors.New("client has no registered keys")
+	}
+}
+
+// verifySignedByServer validates a JWS signed by this server's current or
+// rotated signing keys.
+func (s *Server) verifySignedByServer(jws *jose.JSONWebSignature) ([]byte, error) {
+	keys, err := s.storage.GetKeys()
+	if err != nil {
+		return nil, fmt.Errorf("get keys: %v", err)
+	}
+	var pubKeys []jose.JSONWebKey
+	if keys.SigningKeyPub != nil {
+		pubKeys = append(pubKeys, *keys.SigningKeyPub)
+	}
+	for _, key := range keys.VerificationKeys {
+		pubKeys = append(pubKeys, *key.PublicKey)
+	}
+	return verifyWithKeys(jws, pubKeys)
+}
+
+// unverifiedClaims decodes the payload of a compact JWS without validating its
+// signature. It's used to determine which keys should verify the token and the
+// result must never be trusted.
+func unverifiedClaims(token string, v interface{}) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errors.New("malformed token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return fmt.Errorf("decode payload: %v", err)
+	}
+	if err := json.Unmarshal(payload, v); err != nil {
+		return fmt.Errorf("decode claims: %v", err)
+	}
+	return nil
+}
+
+// unverifiedHeader decodes the protected header of a compact JWS without
+// validating its signature.
+func unverifiedHeader(token string, v interface{}) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errors.New("malformed token")
+	}
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return fmt.Errorf("decode header: %v", err)
+	}
+	if err := json.Unmarshal(header, v); err != nil {
+		return fmt.Errorf("decode header: %v", err)
+	}
+	return nil
+}
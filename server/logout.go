@@ -0,0 +1,372 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	jose "gopkg.in/square/go-jose.v2"
+
+	"github.com/ericchiang/poke/storage"
+)
+
+// RP-initiated logout lets a client send the end user to the server to log out,
+// then have them redirected back to the client.
+//
+// See: https://openid.net/specs/openid-connect-rpinitiated-1_0.html
+
+// Back-channel logout notifies clients directly when an end user logs out by
+// posting a signed logout token to each client's back-channel logout URI.
+//
+// See: https://openid.net/specs/openid-connect-backchannel-1_0.html
+const (
+	jwtTypeLogoutToken     = "logout+jwt"
+	backchannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+
+	logoutTokenValidFor       = 2 * time.Minute
+	backchannelLogoutAttempts = 3
+	// Deliveries which haven't succeeded by this time, including retries, are
+	// abandoned.
+	backchannelLogoutTimeout = time.Minute
+)
+
+type logoutTokenClaims struct {
+	Issuer   string              `json:"iss"`
+	Subject  string              `json:"sub"`
+	Audience audience            `json:"aud"`
+	IssuedAt int64               `json:"iat"`
+	Expiry   int64               `json:"exp"`
+	JTI      string              `json:"jti"`
+	Events   map[string]struct{} `json:"events"`
+
+	SessionID string `json:"sid,omitempty"`
+}
+
+// logoutRequest is a validated request to the end session endpoint.
+type logoutRequest struct {
+	// Claims of the ID Token passed as a hint, if any.
+	IDToken *idTokenClaims
+	// The client requesting the logout. Empty if the client wasn't identified.
+	ClientID string
+
+	RedirectURI string
+	State       string
+}
+
+// parseLogoutRequest validates the parameters of a logout request. Errors are
+// reported to the end user and never redirected, since the redirect URI can't
+// be trusted until the request is validated.
+func (s *Server) parseLogoutRequest(r *http.Request) (req logoutRequest, aerr *authErr) {
+	if err := r.ParseForm(); err != nil {
+		return req, &authErr{Type: errInvalidRequest, Description: "Failed to parse request."}
+	}
+	q := r.Form
+	req.RedirectURI = q.Get("post_logout_redirect_uri")
+	req.State = q.Get("state")
+	req.ClientID = q.Get("client_id")
+
+	if hint := q.Get("id_token_hint"); hint != "" {
+		claims, err := s.verifyIDTokenHint(hint)
+		if err != nil {
+			log.Printf("invalid id_token_hint: %v", err)
+			return req, &authErr{Type: errInvalidRequest, Description: "Invalid id_token_hint."}
+		}
+		req.IDToken = claims
+
+		clientID := claims.AuthorizingParty
+		if clientID == "" && len(claims.Audience) == 1 {
+			clientID = claims.Audience[0]
+		}
+		if req.ClientID == "" {
+			req.ClientID = clientID
+		} else if req.ClientID != clientID {
+			return req, &authErr{Type: errInvalidRequest, Description: "client_id doesn't match the id_token_hint."}
+		}
+	}
+
+	if req.RedirectURI == "" {
+		return req, nil
+	}
+	if req.ClientID == "" {
+		return req, &authErr{Type: errInvalidRequest, Description: "post_logout_redirect_uri requires id_token_hint or client_id."}
+	}
+	client, err := s.storage.GetClient(req.ClientID)
+	if err != nil {
+		if err == storage.ErrNotFound {
+			return req, &authErr{Type: errInvalidRequest, Description: "Unknown client."}
+		}
+		log.Printf("failed to get client: %v", err)
+		return req, &authErr{Type: errServerError}
+	}
+	for _, uri := range client.PostLogoutRedirectURIs {
+		if req.RedirectURI == uri {
+			return req, nil
+		}
+	}
+	return req, &authErr{Type: errInvalidRequest, Description: "Unregistered post_logout_redirect_uri."}
+}
+
+// verifyIDTokenHint validates an ID Token issued by this server. Expired tokens
+// are accepted since the end user's session may have outlived the token, but
+// only unexpired tokens let a logout skip confirmation.
+func (s *Server) verifyIDTokenHint(token string) (*idTokenClaims, error) {
+	// Other tokens signed by the server, such as JWT access tokens and logout
+	// tokens, carry a "typ" header. ID Tokens don't.
+	var header struct {
+		Typ string `json:"typ"`
+	}
+	if err := unverifiedHeader(token, &header); err != nil {
+		return nil, fmt.Errorf("parse token: %v", err)
+	}
+	if header.Typ != "" && header.Typ != "JWT" {
+		return nil, fmt.Errorf("token has type %q", header.Typ)
+	}
+	jws, err := jose.ParseSigned(token)
+	if err != nil {
+		return nil, fmt.Errorf("parse token: %v", err)
+	}
+	payload, err := s.verifySignedByServer(jws)
+	if err != nil {
+		return nil, fmt.Errorf("verify token: %v", err)
+	}
+	var claims idTokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("decode claims: %v", err)
+	}
+	if claims.Issuer != s.issuerURL.String() {
+		return nil, fmt.Errorf("token issued by %q", claims.Issuer)
+	}
+	return &claims, nil
+}
+
+// idTokenHintMatches reports whether an ID Token was issued to the end user of a
+// session. Tokens issued outside a session, such as by the password grant, only
+// need to match the end user.
+func idTokenHintMatches(claims *idTokenClaims, session storage.Session) bool {
+	if claims.Subject != session.Identity.UserID {
+		return false
+	}
+	return claims.SessionID == "" || claims.SessionID == sessionSID(session.ID)
+}
+
+// handleLogout handles the end session endpoint.
+func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		s.renderError(w, http.StatusMethodNotAllowed, errInvalidRequest, "Method not allowed.")
+		return
+	}
+	req, authErr := s.parseLogoutRequest(r)
+	if authErr != nil {
+		status := http.StatusBadRequest
+		if authErr.Type == errServerError {
+			status = http.StatusInternalServerError
+		}
+		s.renderError(w, status, authErr.Type, authErr.Description)
+		return
+	}
+
+	session, ok := s.session(r)
+	// Don't end the browser's session if the client is logging out a different
+	// end user.
+	if ok && req.IDToken != nil && !idTokenHintMatches(req.IDToken, session) {
+		ok = false
+	}
+
+	// Anyone can link to this endpoint, and a leaked ID Token is no proof the end
+	// user wants to log out, so ask the end user to confirm unless the request
+	// carries an unexpired ID Token for their session. The session cookie is
+	// SameSite=Lax, so only the end user can post the confirmation.
+	confirmed := r.Method == "POST" ||
+		(ok && req.IDToken != nil && s.now().Unix() < req.IDToken.Expiry)
+	if !confirmed {
+		params := url.Values{}
+		for _, name := range []string{"id_token_hint", "client_id", "post_logout_redirect_uri", "state"} {
+			if v := r.Form.Get(name); v != "" {
+				params.Set(name, v)
+			}
+		}
+		renderLogoutConfirmTmpl(w, s.absPath("/logout"), params)
+		return
+	}
+
+	// Clients are only notified of sessions which were actually ended.
+	if ok {
+		s.endSession(w, session)
+		clientIDs := append([]string{req.ClientID}, session.Clients...)
+		s.backchannelLogout(session.Identity.UserID, sessionSID(session.ID), s.loggedInClients(session, clientIDs...))
+	}
+
+	if req.RedirectURI == "" {
+		renderLogoutTmpl(w)
+		return
+	}
+	u, err := url.Parse(req.RedirectURI)
+	if err != nil {
+		s.renderError(w, http.StatusBadRequest, errInvalidRequest, "Invalid post_logout_redirect_uri.")
+		return
+	}
+	if req.State != "" {
+		q := u.Query()
+		q.Set("state", req.State)
+		u.RawQuery = q.Encode()
+	}
+	http.Redirect(w, r, u.String(), http.StatusSeeOther)
+}
+
+// loggedInClients returns the clients an end user has logged into during a
+// session: the given clients, usually those of the session, and any client
+// holding a refresh token issued in the session.
+func (s *Server) loggedInClients(session storage.Session, loggedIn ...string) []string {
+	var clientIDs []string
+	seen := make(map[string]bool)
+	add := func(id string) {
+		if id != "" && !seen[id] {
+			seen[id] = true
+			clientIDs = append(clientIDs, id)
+		}
+	}
+	for _, id := range loggedIn {
+		add(id)
+	}
+
+	refreshTokens, err := s.storage.ListRefreshTokens()
+	if err != nil {
+		log.Printf("failed to list refresh tokens: %v", err)
+		return clientIDs
+	}
+	sid := sessionSID(session.ID)
+	for _, refresh := range refreshTokens {
+		if refresh.ConnectorID == session.ConnectorID &&
+			refresh.Identity.UserID == session.Identity.UserID &&
+			refresh.Identity.SessionID == sid {
+			add(refresh.ClientID)
+		}
+	}
+	return clientIDs
+}
+
+// backchannelLogout sends a logout token for the end user to each client with a
+// back-channel logout URI. Tokens are delivered in the background.
+func (s *Server) backchannelLogout(subject, sid string, clientIDs []string) {
+	for _, clientID := range clientIDs {
+		client, err := s.storage.GetClient(clientID)
+		if err != nil {
+			if err != storage.ErrNotFound {
+				log.Printf("backchannel logout: failed to get client %q: %v", clientID, err)
+			}
+			continue
+		}
+		if client.BackchannelLogoutURI == "" {
+			continue
+		}
+		token, err := s.newLogoutToken(client.ID, subject, sid)
+		if err != nil {
+			log.Printf("backchannel logout: failed to create logout token for client %q: %v", client.ID, err)
+			continue
+		}
+		go s.deliverLogoutToken(client, token)
+	}
+}
+
+func (s *Server) newLogoutToken(clientID, subject, sid string) (string, error) {
+	issuedAt := s.now()
+	claims := logoutTokenClaims{
+		Issuer:   s.issuerURL.String(),
+		Subject:  subject,
+		Audience: audience{clientID},
+		IssuedAt: issuedAt.Unix(),
+		Expiry:   issuedAt.Add(logoutTokenValidFor).Unix(),
+		JTI:      storage.NewNonce(),
+		Events:   map[string]struct{}{backchannelLogoutEvent: {}},
+
+		SessionID: sid,
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("could not serialize claims: %v", err)
+	}
+	keys, err := s.storage.GetKeys()
+	if err != nil {
+		return "", fmt.Errorf("get keys: %v", err)
+	}
+	return signJWT(keys.SigningKey, jwtTypeLogoutToken, payload)
+}
+
+// deliverLogoutToken posts a logout token to a client, retrying failed requests
+// with an exponential backoff until the delivery times out. The outcome is
+// recorded on the client.
+func (s *Server) deliverLogoutToken(client storage.Client, token string) {
+	ctx, cancel := context.WithTimeout(context.Background(), backchannelLogoutTimeout)
+	defer cancel()
+
+	var (
+		attempts int
+		err      error
+		delay    = s.backchannelRetryDelay
+	)
+	for {
+		attempts++
+		var retry bool
+		retry, err = s.postLogoutToken(ctx, client.BackchannelLogoutURI, token)
+		if err == nil || !retry || attempts == backchannelLogoutAttempts {
+			break
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		delay *= 2
+	}
+
+	status := storage.BackchannelLogoutStatus{Time: s.now(), Attempts: attempts}
+	if err != nil {
+		log.Printf("backchannel logout: delivery to client %q failed after %d attempts: %v", client.ID, attempts, err)
+		status.Error = err.Error()
+	}
+	err = s.storage.UpdateClient(client.ID, func(old storage.Client) (storage.Client, error) {
+		old.BackchannelLogoutStatus = &status
+		return old, nil
+	})
+	if err != nil && err != storage.ErrNotFound {
+		log.Printf("backchannel logout: failed to record delivery to client %q: %v", client.ID, err)
+	}
+}
+
+// postLogoutToken makes a single back-channel logout request. Failures caused by
+// the network or server errors can be retried, while rejections of the token
+// can't.
+func (s *Server) postLogoutToken(ctx context.Context, logoutURI, token string) (retry bool, err error) {
+	body := url.Values{"logout_token": {token}}.Encode()
+	req, err := http.NewRequest("POST", logoutURI, strings.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := s.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<20))
+
+	switch {
+	case resp.StatusCode/100 == 2:
+		return false, nil
+	case resp.StatusCode >= 500:
+		return true, fmt.Errorf("unexpected status %s", resp.Status)
+	default:
+		return false, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+}
@@ -1,8 +1,17 @@
 package server
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"hash"
 	"log"
 	"net/http"
 	"net/url"
@@ -10,6 +19,8 @@ import (
 	"strings"
 	"time"
 
+	jose "gopkg.in/square/go-jose.v2"
+
 	"github.com/ericchiang/poke/storage"
 )
 
@@ -52,6 +63,7 @@ func tokenErr(w http.ResponseWriter, typ, description string, statusCode int) {
 	}
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(statusCode)
 	w.Write(body)
 }
 
@@ -66,6 +78,30 @@ const (
 	errUnsupportedGrantType    = "unsupported_grant_type"
 	errInvalidGrant            = "invalid_grant"
 	errInvalidClient           = "invalid_client"
+
+	// Device flow errors. See https://tools.ietf.org/html/rfc8628#section-3.5
+	errAuthorizationPending = "authorization_pending"
+	errSlowDown             = "slow_down"
+	errExpiredToken         = "expired_token"
+
+	// Token exchange errors. See https://tools.ietf.org/html/rfc8693#section-2.2.2
+	errInvalidTarget = "invalid_target"
+
+	// Authentication errors. See http://openid.net/specs/openid-connect-core-1_0.html#AuthError
+	errLoginRequired   = "login_required"
+	errConsentRequired = "consent_required"
+
+	// Request object errors. See https://tools.ietf.org/html/rfc9101#section-6.3
+	errInvalidRequestObject = "invalid_request_object"
+	errInvalidRequestURI    = "invalid_request_uri"
+)
+
+// Values of the "prompt" authorization parameter.
+const (
+	promptNone          = "none"
+	promptLogin         = "login"
+	promptConsent       = "consent"
+	promptSelectAccount = "select_account"
 )
 
 const (
@@ -78,8 +114,28 @@ const (
 )
 
 const (
-	grantTypeAuthorizationCode = "code"
+	grantTypeAuthorizationCode = "authorization_code"
 	grantTypeRefreshToken      = "refresh_token"
+	grantTypeClientCredentials = "client_credentials"
+	grantTypePassword          = "password"
+	grantTypeDeviceCode        = "urn:ietf:params:oauth:grant-type:device_code"
+	grantTypeTokenExchange     = "urn:ietf:params:oauth:grant-type:token-exchange"
+)
+
+var supportedGrantTypes = []string{
+	grantTypeAuthorizationCode,
+	grantTypeRefreshToken,
+	grantTypeClientCredentials,
+	grantTypePassword,
+	grantTypeDeviceCode,
+	grantTypeTokenExchange,
+}
+
+// Token type identifiers used by token exchange.
+// See https://tools.ietf.org/html/rfc8693#section-3
+const (
+	tokenTypeIDToken = "urn:ietf:params:oauth:token-type:id_token"
+	tokenTypeJWT     = "urn:ietf:params:oauth:token-type:jwt"
 )
 
 const (
@@ -88,19 +144,146 @@ const (
 	responseTypeIDToken = "id_token" // ID Token in url fragment
 )
 
+// Response modes determine how the authorization response is returned to the
+// client's redirect URI.
+//
+// See: https://openid.net/specs/oauth-v2-multiple-response-types-1_0.html#ResponseModes
+// See: https://openid.net/specs/oauth-v2-form-post-response-mode-1_0.html
+const (
+	responseModeQuery    = "query"
+	responseModeFragment = "fragment"
+	responseModeFormPost = "form_post"
+)
+
+var supportedResponseModes = []string{
+	responseModeQuery,
+	responseModeFragment,
+	responseModeFormPost,
+}
+
+// Methods clients can use to authenticate to the token endpoint.
+// See https://openid.net/specs/openid-connect-core-1_0.html#ClientAuthentication
+const (
+	authMethodClientSecretBasic = "client_secret_basic"
+	authMethodClientSecretPost  = "client_secret_post"
+	authMethodClientSecretJWT   = "client_secret_jwt"
+	authMethodPrivateKeyJWT     = "private_key_jwt"
+	authMethodNone              = "none"
+)
+
+var supportedAuthMethods = []string{
+	authMethodClientSecretBasic,
+	authMethodClientSecretPost,
+	authMethodClientSecretJWT,
+	authMethodPrivateKeyJWT,
+	authMethodNone,
+}
+
+// tokenEndpointAuthMethod returns the method a client must use to authenticate
+// to the token endpoint. Public clients can't keep credentials and always use
+// "none". Confidential clients default to "client_secret_basic", though
+// checkAuthMethod also lets those without a registered method use
+// "client_secret_post".
+func tokenEndpointAuthMethod(client storage.Client) string {
+	switch {
+	case client.Public:
+		return authMethodNone
+	case client.TokenEndpointAuthMethod == "":
+		return authMethodClientSecretBasic
+	}
+	return client.TokenEndpointAuthMethod
+}
+
+// signingAlg returns the algorithm of the server's current signing key, used
+// for ID Tokens and signed user info responses.
+func (s *Server) signingAlg() (jose.SignatureAlgorithm, error) {
+	keys, err := s.storage.GetKeys()
+	if err != nil {
+		return "", err
+	}
+	return storage.SignatureAlgorithm(keys.SigningKey)
+}
+
+// Algorithms accepted for signing client assertions.
+var supportedAuthSigningAlgs = []string{
+	string(jose.RS256), string(jose.RS384), string(jose.RS512),
+	string(jose.ES256), string(jose.ES384), string(jose.ES512),
+	string(jose.HS256), string(jose.HS384), string(jose.HS512),
+}
+
+// Request objects must be signed by one of the client's registered keys.
+var supportedRequestObjectSigningAlgs = []string{
+	string(jose.RS256), string(jose.RS384), string(jose.RS512),
+	string(jose.ES256), string(jose.ES384), string(jose.ES512),
+}
+
+const (
+	clientAssertionTypeJWTBearer = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+	// Client assertions valid for longer than this are rejected. This bounds
+	// how long used JTIs must be remembered.
+	clientAssertionMaxLifetime = time.Hour
+)
+
+const (
+	codeChallengeMethodPlain = "plain"
+	codeChallengeMethodS256  = "S256"
+)
+
+var supportedCodeChallengeMethods = []string{
+	codeChallengeMethodS256,
+	codeChallengeMethodPlain,
+}
+
 var validResponseTypes = map[string]bool{
 	"code":     true,
 	"token":    true,
 	"id_token": true,
 }
 
+// supportedResponseTypes are the response_type combinations advertised by
+// discovery. Each entry is one "code" (regular) flow, implicit flow, or hybrid
+// flow described in http://openid.net/specs/openid-connect-core-1_0.html#Authentication
+var supportedResponseTypes = []string{
+	"code",
+	"id_token",
+	"token",
+	"id_token token",
+	"code id_token",
+	"code token",
+	"code id_token token",
+}
+
 type audience []string
 
 func (a audience) MarshalJSON() ([]byte, error) {
 	if len(a) == 1 {
 		return json.Marshal(a[0])
 	}
-	return json.Marshal(a)
+	return json.Marshal([]string(a))
+}
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if json.Unmarshal(b, &s) == nil {
+		*a = audience{s}
+		return nil
+	}
+	var auds []string
+	if err := json.Unmarshal(b, &auds); err != nil {
+		return err
+	}
+	*a = audience(auds)
+	return nil
+}
+
+func (a audience) contains(aud string) bool {
+	for _, e := range a {
+		if e == aud {
+			return true
+		}
+	}
+	return false
 }
 
 type idTokenClaims struct {
@@ -112,15 +295,57 @@ type idTokenClaims struct {
 	AuthorizingParty string   `json:"azp,omitempty"`
 	Nonce            string   `json:"nonce,omitempty"`
 
+	AccessTokenHash string `json:"at_hash,omitempty"`
+	CodeHash        string `json:"c_hash,omitempty"`
+
 	Email         string `json:"email,omitempty"`
 	EmailVerified *bool  `json:"email_verified,omitempty"`
 
 	Groups []string `json:"groups,omitempty"`
 
 	Name string `json:"name,omitempty"`
+
+	AuthTime int64  `json:"auth_time,omitempty"`
+	ACR      string `json:"acr,omitempty"`
+
+	SessionID string `json:"sid,omitempty"`
+}
+
+// tokenHash computes the value of an "at_hash" or "c_hash" claim: the base64url
+// encoded left-most half of the hash of the token, using the hash function of
+// the ID Token's signing algorithm.
+//
+// See: http://openid.net/specs/openid-connect-core-1_0.html#HybridIDToken
+func tokenHash(alg jose.SignatureAlgorithm, token string) (string, error) {
+	var h hash.Hash
+	switch alg {
+	case jose.RS256, jose.ES256, jose.PS256:
+		h = sha256.New()
+	case jose.RS384, jose.ES384, jose.PS384:
+		h = sha512.New384()
+	case jose.RS512, jose.ES512, jose.PS512:
+		h = sha512.New()
+	default:
+		return "", fmt.Errorf("unsupported signature algorithm: %s", alg)
+	}
+	h.Write([]byte(token)) // hash.Hash writes never error.
+	sum := h.Sum(nil)
+	return base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2]), nil
 }
 
-func (s *Server) newIDToken(clientID string, claims storage.Identity, scopes []string, nonce string) (idToken string, expiry time.Time, err error) {
+// newIDToken creates a signed ID Token for the client. If accessToken or code are
+// non-empty, the token includes the "at_hash" or "c_hash" claims respectively.
+func (s *Server) newIDToken(clientID, connectorID string, claims storage.Identity, scopes []string, nonce, accessToken, code string) (idToken string, expiry time.Time, err error) {
+	keys, err := s.storage.GetKeys()
+	if err != nil {
+		log.Printf("Failed to get keys: %v", err)
+		return "", expiry, err
+	}
+	signingAlg, err := storage.SignatureAlgorithm(keys.SigningKey)
+	if err != nil {
+		return "", expiry, err
+	}
+
 	issuedAt := s.now()
 	expiry = issuedAt.Add(s.idTokensValidFor)
 
@@ -130,6 +355,23 @@ func (s *Server) newIDToken(clientID string, claims storage.Identity, scopes []s
 		Nonce:    nonce,
 		Expiry:   expiry.Unix(),
 		IssuedAt: issuedAt.Unix(),
+		ACR:      claims.ACR,
+
+		SessionID: claims.SessionID,
+	}
+	if !claims.AuthTime.IsZero() {
+		tok.AuthTime = claims.AuthTime.Unix()
+	}
+
+	if accessToken != "" {
+		if tok.AccessTokenHash, err = tokenHash(signingAlg, accessToken); err != nil {
+			return "", expiry, fmt.Errorf("computing at_hash: %v", err)
+		}
+	}
+	if code != "" {
+		if tok.CodeHash, err = tokenHash(signingAlg, code); err != nil {
+			return "", expiry, fmt.Errorf("computing c_hash: %v", err)
+		}
 	}
 
 	for _, scope := range scopes {
@@ -163,20 +405,188 @@ func (s *Server) newIDToken(clientID string, claims storage.Identity, scopes []s
 		tok.AuthorizingParty = clientID
 	}
 
-	payload, err := json.Marshal(tok)
+	payload, err := marshalClaims(tok, s.mappedClaims(connectorID, claims, scopes))
 	if err != nil {
 		return "", expiry, fmt.Errorf("could not serialize claims: %v", err)
 	}
 
+	if idToken, err = keys.Sign(payload); err != nil {
+		return "", expiry, fmt.Errorf("failed to sign payload: %v", err)
+	}
+	return idToken, expiry, nil
+}
+
+// newAccessToken issues an access token and records it so it can be
+// introspected, revoked and presented to the user info endpoint.
+//
+// If the server or client is configured for JWT access tokens, the token is a
+// JWT which resource servers can validate using the server's public keys, and
+// the record is stored under the token's "jti" claim. Otherwise the token is
+// an opaque value. resource, if non-empty, is the audience of the token.
+func (s *Server) newAccessToken(client storage.Client, connectorID string, identity storage.Identity, scopes []string, resource string) (accessToken string, expiry time.Time, err error) {
+	// Connector data is only needed for refreshing, don't copy it around.
+	identity.ConnectorData = nil
+	issuedAt := s.now()
+	tok := storage.AccessToken{
+		Token:       storage.NewNonce(),
+		ClientID:    client.ID,
+		ConnectorID: connectorID,
+		Scopes:      scopes,
+		Resource:    resource,
+		Identity:    identity,
+		Expiry:      issuedAt.Add(s.idTokensValidFor),
+	}
+
+	accessToken = tok.Token
+	if s.jwtAccessTokens || client.JWTAccessTokens {
+		if accessToken, err = s.signAccessToken(tok, issuedAt); err != nil {
+			return "", tok.Expiry, err
+		}
+	}
+	if err := s.storage.CreateAccessToken(tok); err != nil {
+		return "", tok.Expiry, fmt.Errorf("create access token: %v", err)
+	}
+	return accessToken, tok.Expiry, nil
+}
+
+// lookupAccessToken returns the record of an opaque or JWT access token issued
+// by the server. Unrecognized tokens return storage.ErrNotFound.
+func (s *Server) lookupAccessToken(token string) (storage.AccessToken, error) {
+	if strings.Count(token, ".") != 2 {
+		return s.storage.GetAccessToken(token)
+	}
+
+	var header struct {
+		Typ string `json:"typ"`
+	}
+	if err := unverifiedHeader(token, &header); err != nil || header.Typ != jwtTypeAccessToken {
+		return storage.AccessToken{}, storage.ErrNotFound
+	}
+	jws, err := jose.ParseSigned(token)
+	if err != nil {
+		return storage.AccessToken{}, storage.ErrNotFound
+	}
+	payload, err := s.verifySignedByServer(jws)
+	if err != nil {
+		if err == errNoMatchingKey {
+			return storage.AccessToken{}, storage.ErrNotFound
+		}
+		return storage.AccessToken{}, err
+	}
+	var claims accessTokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return storage.AccessToken{}, storage.ErrNotFound
+	}
+	if claims.JTI == "" {
+		return storage.AccessToken{}, storage.ErrNotFound
+	}
+	return s.storage.GetAccessToken(claims.JTI)
+}
+
+// accessTokenClaims are the claims of JWT access tokens.
+//
+// See https://tools.ietf.org/html/rfc9068#section-2.2
+type accessTokenClaims struct {
+	Issuer   string   `json:"iss"`
+	Subject  string   `json:"sub"`
+	Audience audience `json:"aud"`
+	Expiry   int64    `json:"exp"`
+	IssuedAt int64    `json:"iat"`
+	JTI      string   `json:"jti"`
+
+	ClientID string `json:"client_id"`
+	Scope    string `json:"scope,omitempty"`
+}
+
+// The "typ" header of JWT access tokens, which keeps them from being confused
+// with ID Tokens signed by the same keys.
+const jwtTypeAccessToken = "at+jwt"
+
+// signAccessToken creates a JWT for an access token record.
+func (s *Server) signAccessToken(tok storage.AccessToken, issuedAt time.Time) (string, error) {
+	aud := audience{tok.ClientID}
+	if tok.Resource != "" {
+		aud = audience{tok.Resource}
+	}
+	claims := accessTokenClaims{
+		Issuer:   s.issuerURL.String(),
+		Subject:  tok.Identity.UserID,
+		Audience: aud,
+		Expiry:   tok.Expiry.Unix(),
+		IssuedAt: issuedAt.Unix(),
+		JTI:      tok.Token,
+		ClientID: tok.ClientID,
+		Scope:    strings.Join(tok.Scopes, " "),
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("could not serialize claims: %v", err)
+	}
+
 	keys, err := s.storage.GetKeys()
 	if err != nil {
 		log.Printf("Failed to get keys: %v", err)
-		return "", expiry, err
+		return "", err
 	}
-	if idToken, err = keys.Sign(payload); err != nil {
-		return "", expiry, fmt.Errorf("failed to sign payload: %v", err)
+	token, err := signJWT(keys.SigningKey, jwtTypeAccessToken, payload)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign payload: %v", err)
 	}
-	return idToken, expiry, nil
+	return token, nil
+}
+
+// signJWT creates a compact JWS with a "typ" header. The vendored version of
+// go-jose can't set extra headers, so the token is assembled by hand.
+func signJWT(key *jose.JSONWebKey, typ string, payload []byte) (string, error) {
+	alg, err := storage.SignatureAlgorithm(key)
+	if err != nil {
+		return "", err
+	}
+	header, err := json.Marshal(struct {
+		Alg   string `json:"alg"`
+		KeyID string `json:"kid,omitempty"`
+		Typ   string `json:"typ"`
+	}{string(alg), key.KeyID, typ})
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	var h crypto.Hash
+	switch alg {
+	case jose.RS256, jose.ES256:
+		h = crypto.SHA256
+	case jose.ES384:
+		h = crypto.SHA384
+	case jose.ES512:
+		h = crypto.SHA512
+	default:
+		return "", fmt.Errorf("unsupported signature algorithm: %s", alg)
+	}
+	hasher := h.New()
+	hasher.Write([]byte(signingInput))
+	digest := hasher.Sum(nil)
+
+	var sig []byte
+	switch k := key.Key.(type) {
+	case *rsa.PrivateKey:
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k, h, digest); err != nil {
+			return "", err
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest)
+		if err != nil {
+			return "", err
+		}
+		// JWS uses the fixed size concatenation of R and S, not ASN.1.
+		// See https://tools.ietf.org/html/rfc7518#section-3.4
+		size := (k.Params().BitSize + 7) / 8
+		sig = make([]byte, 2*size)
+		r.FillBytes(sig[:size])
+		s.FillBytes(sig[size:])
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), nil
 }
 
 // parse the initial request from the OAuth2 client.
@@ -216,31 +626,9 @@ func parseAuthorizationRequest(s storage.Storage, r *http.Request) (req storage.
 
 	scopes := strings.Split(r.Form.Get("scope"), " ")
 
-	var (
-		unrecognized  []string
-		invalidScopes []string
-	)
-	hasOpenIDScope := false
-	for _, scope := range scopes {
-		switch scope {
-		case scopeOpenID:
-			hasOpenIDScope = true
-		case scopeOfflineAccess, scopeEmail, scopeProfile, scopeGroups:
-		default:
-			peerID, ok := parseCrossClientScope(scope)
-			if !ok {
-				unrecognized = append(unrecognized, scope)
-				continue
-			}
-
-			isTrusted, err := validateCrossClientTrust(s, clientID, peerID)
-			if err != nil {
-				return req, newErr(errServerError, "")
-			}
-			if !isTrusted {
-				invalidScopes = append(invalidScopes, scope)
-			}
-		}
+	hasOpenIDScope, unrecognized, invalidScopes, err := validateScopes(s, clientID, scopes)
+	if err != nil {
+		return req, newErr(errServerError, "")
 	}
 	if !hasOpenIDScope {
 		return req, newErr("invalid_scope", `Missing required scope(s) ["openid"].`)
@@ -253,10 +641,102 @@ func parseAuthorizationRequest(s storage.Storage, r *http.Request) (req storage.
 	}
 
 	responseTypes := strings.Split(r.Form.Get("response_type"), " ")
+	hasCode, hasIDToken := false, false
 	for _, responseType := range responseTypes {
 		if !validResponseTypes[responseType] {
 			return req, newErr("invalid_request", "Invalid response type %q", responseType)
 		}
+		switch responseType {
+		case responseTypeCode:
+			hasCode = true
+		case responseTypeIDToken:
+			hasIDToken = true
+		}
+	}
+
+	responseMode := r.Form.Get("response_mode")
+	switch responseMode {
+	case "", responseModeFragment, responseModeFormPost:
+	case responseModeQuery:
+		// Tokens must not be sent to the client's server in the query.
+		if hasIDToken || contains(responseTypes, responseTypeToken) {
+			return req, newErr("invalid_request", "Response mode %q can't be used to return tokens.", responseMode)
+		}
+	default:
+		return req, newErr("invalid_request", "Unsupported response mode %q.", responseMode)
+	}
+
+	// ID Tokens returned through the front channel can be replayed. Require a
+	// nonce so clients can detect this.
+	//
+	// See: http://openid.net/specs/openid-connect-core-1_0.html#ImplicitAuthRequest
+	if hasIDToken && r.Form.Get("nonce") == "" {
+		return req, newErr("invalid_request", `Response type "id_token" requires a nonce value.`)
+	}
+
+	codeChallenge := r.Form.Get("code_challenge")
+	codeChallengeMethod := r.Form.Get("code_challenge_method")
+	if codeChallenge == "" {
+		if client.RequirePKCE {
+			return req, newErr("invalid_request", "Client requires a PKCE code_challenge.")
+		}
+		if client.Public && hasCode {
+			// Public clients can't authenticate when redeeming the code, so the
+			// code challenge is the only proof they initiated the request.
+			return req, newErr("invalid_request", "Public clients must send a PKCE code_challenge.")
+		}
+		if codeChallengeMethod != "" {
+			return req, newErr("invalid_request", "code_challenge_method provided without a code_challenge.")
+		}
+	} else {
+		if codeChallengeMethod == "" {
+			// "plain" is the default method. See https://tools.ietf.org/html/rfc7636#section-4.3
+			codeChallengeMethod = codeChallengeMethodPlain
+		}
+		if codeChallengeMethod != codeChallengeMethodPlain && codeChallengeMethod != codeChallengeMethodS256 {
+			return req, newErr("invalid_request", "Unsupported code_challenge_method %q.", codeChallengeMethod)
+		}
+		if !validPKCEValue(codeChallenge) {
+			return req, newErr("invalid_request", "Invalid code_challenge.")
+		}
+	}
+
+	// Clients can force the approval prompt using Google's "approval_prompt=force"
+	// or OpenID Connect's "prompt=consent".
+	//
+	// See: http://openid.net/specs/openid-connect-core-1_0.html#AuthRequest
+	var forceApprovalPrompt, forceLogin, noPrompt bool
+	forceApprovalPrompt = r.Form.Get("approval_prompt") == "force"
+	prompts := strings.Fields(r.Form.Get("prompt"))
+	for _, prompt := range prompts {
+		switch prompt {
+		case promptNone:
+			if len(prompts) > 1 {
+				return req, newErr("invalid_request", `Prompt "none" can't be combined with other values.`)
+			}
+			noPrompt = true
+		case promptLogin, promptSelectAccount:
+			// There's no account chooser, so selecting an account means logging in
+			// through a connector again.
+			forceLogin = true
+		case promptConsent:
+			forceApprovalPrompt = true
+		default:
+			return req, newErr("invalid_request", "Unsupported prompt value %q.", prompt)
+		}
+	}
+
+	var maxAge int
+	if v := r.Form.Get("max_age"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return req, newErr("invalid_request", "Invalid max_age value %q.", v)
+		}
+		if n == 0 {
+			// Equivalent to "prompt=login".
+			forceLogin = true
+		}
+		maxAge = n
 	}
 
 	return storage.AuthRequest{
@@ -264,13 +744,88 @@ func parseAuthorizationRequest(s storage.Storage, r *http.Request) (req storage.
 		ClientID:            client.ID,
 		State:               r.Form.Get("state"),
 		Nonce:               r.Form.Get("nonce"),
-		ForceApprovalPrompt: r.Form.Get("approval_prompt") == "force",
+		ForceApprovalPrompt: forceApprovalPrompt,
+		ForceLogin:          forceLogin,
+		MaxAge:              maxAge,
+		PromptNone:          noPrompt,
+		LoginHint:           r.Form.Get("login_hint"),
+		ACRValues:           strings.Fields(r.Form.Get("acr_values")),
 		Scopes:              scopes,
 		RedirectURI:         redirectURI,
 		ResponseTypes:       responseTypes,
+		ResponseMode:        responseMode,
+		CodeChallenge:       codeChallenge,
+		CodeChallengeMethod: codeChallengeMethod,
 	}, nil
 }
 
+// validPKCEValue determines if a code verifier or code challenge is composed of
+// 43 to 128 unreserved characters.
+//
+// See: https://tools.ietf.org/html/rfc7636#section-4.1
+func validPKCEValue(s string) bool {
+	if len(s) < 43 || len(s) > 128 {
+		return false
+	}
+	for _, c := range s {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == '-', c == '.', c == '_', c == '~':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// verifyCodeVerifier determines if the code verifier sent to the token endpoint
+// matches the challenge from the authorization request.
+//
+// See: https://tools.ietf.org/html/rfc7636#section-4.6
+func verifyCodeVerifier(challenge, method, verifier string) bool {
+	if !validPKCEValue(verifier) {
+		return false
+	}
+	switch method {
+	case codeChallengeMethodPlain:
+		return subtle.ConstantTimeCompare([]byte(challenge), []byte(verifier)) == 1
+	case codeChallengeMethodS256:
+		sum := sha256.Sum256([]byte(verifier))
+		want := base64.RawURLEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(challenge), []byte(want)) == 1
+	default:
+		return false
+	}
+}
+
+// validateScopes checks the scopes requested by a client. It returns the scopes
+// the server doesn't recognize and the cross-client scopes of peers which don't
+// trust the client.
+func validateScopes(s storage.Storage, clientID string, scopes []string) (hasOpenIDScope bool, unrecognized, invalidScopes []string, err error) {
+	for _, scope := range scopes {
+		switch scope {
+		case scopeOpenID:
+			hasOpenIDScope = true
+		case scopeOfflineAccess, scopeEmail, scopeProfile, scopeGroups:
+		default:
+			peerID, ok := parseCrossClientScope(scope)
+			if !ok {
+				unrecognized = append(unrecognized, scope)
+				continue
+			}
+
+			isTrusted, err := validateCrossClientTrust(s, clientID, peerID)
+			if err != nil {
+				return false, nil, nil, err
+			}
+			if !isTrusted {
+				invalidScopes = append(invalidScopes, scope)
+			}
+		}
+	}
+	return hasOpenIDScope, unrecognized, invalidScopes, nil
+}
+
 func parseCrossClientScope(scope string) (peerID string, ok bool) {
 	if ok = strings.HasPrefix(scope, scopeCrossClientPrefix); ok {
 		peerID = scope[len(scopeCrossClientPrefix):]
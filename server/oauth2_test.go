@@ -1 +1,56 @@
 package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestTokenErr(t *testing.T) {
+	tests := []struct {
+		typ        string
+		statusCode int
+	}{
+		{errInvalidRequest, http.StatusBadRequest},
+		{errInvalidClient, http.StatusUnauthorized},
+		{errServerError, http.StatusInternalServerError},
+	}
+	for _, tc := range tests {
+		w := httptest.NewRecorder()
+		tokenErr(w, tc.typ, "description", tc.statusCode)
+		if w.Code != tc.statusCode {
+			t.Errorf("%s: expected status %d got %d", tc.typ, tc.statusCode, w.Code)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s: expected content type application/json got %q", tc.typ, ct)
+		}
+		var body struct {
+			Error       string `json:"error"`
+			Description string `json:"error_description"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%s: failed to decode body: %v", tc.typ, err)
+		}
+		if body.Error != tc.typ || body.Description != "description" {
+			t.Errorf("%s: unexpected body %s", tc.typ, w.Body)
+		}
+	}
+}
+
+func TestTokenEndpointErrorStatus(t *testing.T) {
+	httpServer, _ := newTestServer(nil)
+	defer httpServer.Close()
+
+	resp, err := http.Post(httpServer.URL+"/token", "application/x-www-form-urlencoded",
+		strings.NewReader(url.Values{"grant_type": {"authorization_code"}}.Encode()))
+	if err != nil {
+		t.Fatalf("post failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected status 401 for an unauthenticated token request, got %s", resp.Status)
+	}
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ericchiang/poke/storage"
+)
+
+// Pushed authorization requests let clients send the parameters of an
+// authorization request directly to the server. The client then redirects the
+// end user with a short reference to the request instead of the parameters.
+//
+// See: https://tools.ietf.org/html/rfc9126
+
+const (
+	parRequestURIPrefix = "urn:ietf:params:oauth:request_uri:"
+
+	// How long clients have to redirect the end user after pushing a request.
+	pushedAuthRequestValidFor = time.Minute
+)
+
+type parResponse struct {
+	RequestURI string `json:"request_uri"`
+	ExpiresIn  int    `json:"expires_in"`
+}
+
+// handlePushedAuthRequest handles the pushed authorization request endpoint.
+// Clients authenticate the same way as at the token endpoint.
+func (s *Server) handlePushedAuthRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		tokenErr(w, errInvalidRequest, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	client, ok := s.authenticateClient(w, r)
+	if !ok {
+		return
+	}
+	if r.PostFormValue("request_uri") != "" {
+		tokenErr(w, errInvalidRequest, "request_uri can't be pushed.", http.StatusBadRequest)
+		return
+	}
+	if clientID := r.Form.Get("client_id"); clientID != "" && clientID != client.ID {
+		tokenErr(w, errInvalidRequest, "client_id doesn't match the authenticated client.", http.StatusBadRequest)
+		return
+	}
+	// Clients using HTTP basic auth don't have to repeat their ID.
+	r.Form.Set("client_id", client.ID)
+
+	if err := s.resolveRequestObject(r); err != nil {
+		tokenErr(w, err.Type, err.Description, http.StatusBadRequest)
+		return
+	}
+	authReq, err := parseAuthorizationRequest(s.storage, r)
+	if err != nil {
+		status := http.StatusBadRequest
+		if err.Type == errServerError {
+			status = http.StatusInternalServerError
+		}
+		tokenErr(w, err.Type, err.Description, status)
+		return
+	}
+	authReq.Pushed = true
+	authReq.Expiry = s.now().Add(pushedAuthRequestValidFor)
+	if err := s.storage.CreateAuthRequest(authReq); err != nil {
+		log.Printf("Failed to create pushed authorization request: %v", err)
+		tokenErr(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+
+	data, jerr := json.Marshal(parResponse{
+		RequestURI: parRequestURIPrefix + authReq.ID,
+		ExpiresIn:  int(pushedAuthRequestValidFor / time.Second),
+	})
+	if jerr != nil {
+		log.Printf("failed to marshal pushed authorization response: %v", jerr)
+		tokenErr(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(http.StatusCreated)
+	w.Write(data)
+}
+
+// pushedAuthRequest starts the pushed authorization request referenced by the
+// request URI of a request to the authorization endpoint. Each pushed request
+// can only be used once, so it's replaced by a new authorization request for the
+// end user's login.
+func (s *Server) pushedAuthRequest(r *http.Request) (storage.AuthRequest, *authErr) {
+	requestURI := r.Form.Get("request_uri")
+	id := strings.TrimPrefix(requestURI, parRequestURIPrefix)
+	pushed, err := s.storage.GetAuthRequest(id)
+	if err != nil {
+		if err != storage.ErrNotFound {
+			log.Printf("Failed to get pushed authorization request: %v", err)
+			return pushed, &authErr{"", "", errServerError, ""}
+		}
+		return pushed, &authErr{"", "", errInvalidRequestURI, "Unknown or already used request_uri."}
+	}
+	if !pushed.Pushed {
+		return pushed, &authErr{"", "", errInvalidRequestURI, "Unknown or already used request_uri."}
+	}
+	if err := s.storage.DeleteAuthRequest(pushed.ID); err != nil {
+		if err != storage.ErrNotFound {
+			log.Printf("Failed to delete pushed authorization request: %v", err)
+			return pushed, &authErr{"", "", errServerError, ""}
+		}
+		return pushed, &authErr{"", "", errInvalidRequestURI, "Unknown or already used request_uri."}
+	}
+	if s.now().After(pushed.Expiry) {
+		return pushed, &authErr{"", "", errInvalidRequestURI, "Expired request_uri."}
+	}
+	if clientID := r.Form.Get("client_id"); clientID != pushed.ClientID {
+		return pushed, &authErr{"", "", errInvalidRequest, "client_id doesn't match the request_uri."}
+	}
+
+	authReq := pushed
+	authReq.ID = storage.NewNonce()
+	authReq.Pushed = false
+	return authReq, nil
+}
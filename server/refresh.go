@@ -0,0 +1,164 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/ericchiang/poke/storage"
+)
+
+// Refresh tokens are rotated on every use. Rotated tokens are kept, linked to
+// their successor, so that a token used twice can be detected. Since only the
+// client should hold a refresh token, reuse suggests the token was stolen and
+// every token descended from the same initial token, its family, is revoked.
+//
+// A client which never received the response to a refresh request, for example
+// because of a network failure, will retry with the old token. Retries within
+// the reuse interval are allowed as long as the successor hasn't been used.
+//
+// Refresh tokens expire once they haven't been used for the idle timeout, or
+// once the absolute lifetime has passed since the family's initial token was
+// issued.
+//
+// See: https://tools.ietf.org/html/rfc9700#section-4.14.2
+
+var errRefreshReused = errors.New("refresh token has already been used")
+
+// familyID returns the family of a refresh token. Tokens issued before families
+// were tracked start their own family.
+func familyID(refresh storage.Refresh) string {
+	if refresh.FamilyID == "" {
+		return refresh.RefreshToken
+	}
+	return refresh.FamilyID
+}
+
+// checkRefreshReuse returns errRefreshReused if a refresh token has already
+// been rotated and can't be used again.
+func (s *Server) checkRefreshReuse(refresh storage.Refresh) error {
+	if refresh.RotatedAt.IsZero() {
+		return nil
+	}
+	if s.now().After(refresh.RotatedAt.Add(s.refreshTokenReuseInterval)) {
+		return errRefreshReused
+	}
+	successor, err := s.storage.GetRefresh(refresh.ReplacedBy)
+	if err != nil {
+		if err == storage.ErrNotFound {
+			// The successor has been revoked.
+			return errRefreshReused
+		}
+		return err
+	}
+	if !successor.RotatedAt.IsZero() {
+		// The successor was received and used, so this isn't a retry.
+		return errRefreshReused
+	}
+	return nil
+}
+
+// refreshExpiry returns when a refresh token issued to a client expires, or a
+// zero time if it doesn't. Clients may override the server's lifetimes.
+func (s *Server) refreshExpiry(client storage.Client, createdAt, lastUsed time.Time) time.Time {
+	idleTimeout := s.refreshTokenIdleTimeout
+	if client.RefreshTokenIdleTimeout != 0 {
+		idleTimeout = client.RefreshTokenIdleTimeout
+	}
+	absoluteLifetime := s.refreshTokenAbsoluteLifetime
+	if client.RefreshTokenAbsoluteLifetime != 0 {
+		absoluteLifetime = client.RefreshTokenAbsoluteLifetime
+	}
+
+	var expiry time.Time
+	if absoluteLifetime > 0 && !createdAt.IsZero() {
+		expiry = createdAt.Add(absoluteLifetime)
+	}
+	if idleTimeout > 0 && !lastUsed.IsZero() {
+		if idle := lastUsed.Add(idleTimeout); expiry.IsZero() || idle.Before(expiry) {
+			expiry = idle
+		}
+	}
+	return expiry
+}
+
+// refreshExpired returns if a refresh token has expired. The expiry is computed
+// with the current lifetimes, rather than those the token was issued with, so
+// configuration changes apply to existing tokens. Tokens issued before expiry
+// was tracked never expire.
+func (s *Server) refreshExpired(client storage.Client, refresh storage.Refresh) bool {
+	expiry := s.refreshExpiry(client, refresh.CreatedAt, refresh.LastUsed)
+	return !expiry.IsZero() && !s.now().Before(expiry)
+}
+
+// rotateRefresh replaces a refresh token with a new token in the same family.
+// The old token is kept to detect reuse. If the old token was already rotated,
+// its previous successor is deleted.
+func (s *Server) rotateRefresh(client storage.Client, old storage.Refresh) (storage.Refresh, error) {
+	now := s.now()
+	next := old
+	next.RefreshToken = storage.NewNonce()
+	next.FamilyID = familyID(old)
+	next.RotatedAt = time.Time{}
+	next.ReplacedBy = ""
+	if next.CreatedAt.IsZero() {
+		next.CreatedAt = now
+	}
+	next.LastUsed = now
+	next.Expiry = s.refreshExpiry(client, next.CreatedAt, next.LastUsed)
+	if err := s.storage.CreateRefresh(next); err != nil {
+		return next, err
+	}
+
+	err := s.storage.UpdateRefresh(old.RefreshToken, func(r storage.Refresh) (storage.Refresh, error) {
+		if r.ReplacedBy != old.ReplacedBy {
+			// Rotated by a concurrent request.
+			return r, errRefreshReused
+		}
+		r.FamilyID = next.FamilyID
+		r.RotatedAt = now
+		r.ReplacedBy = next.RefreshToken
+		// Keep the rotated token as long as its family to detect reuse.
+		r.Expiry = next.Expiry
+		return r, nil
+	})
+	if err != nil {
+		if err := s.storage.DeleteRefresh(next.RefreshToken); err != nil {
+			log.Printf("failed to delete refresh token: %v", err)
+		}
+		if err == storage.ErrNotFound {
+			// Revoked by a concurrent request.
+			err = errRefreshReused
+		}
+		return next, err
+	}
+
+	if old.ReplacedBy != "" {
+		if err := s.storage.DeleteRefresh(old.ReplacedBy); err != nil && err != storage.ErrNotFound {
+			log.Printf("failed to delete replaced refresh token: %v", err)
+		}
+	}
+	return next, nil
+}
+
+// revokeRefreshFamily deletes a refresh token and every other token in its
+// family. Failures are logged.
+func (s *Server) revokeRefreshFamily(refresh storage.Refresh) {
+	family := familyID(refresh)
+	if err := s.storage.DeleteRefresh(refresh.RefreshToken); err != nil && err != storage.ErrNotFound {
+		log.Printf("failed to delete refresh token: %v", err)
+	}
+	refreshTokens, err := s.storage.ListRefreshTokens()
+	if err != nil {
+		log.Printf("failed to list refresh tokens: %v", err)
+		return
+	}
+	for _, r := range refreshTokens {
+		if familyID(r) != family {
+			continue
+		}
+		if err := s.storage.DeleteRefresh(r.RefreshToken); err != nil && err != storage.ErrNotFound {
+			log.Printf("failed to delete refresh token: %v", err)
+		}
+	}
+}
@@ -0,0 +1,364 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	jose "gopkg.in/square/go-jose.v2"
+
+	"github.com/ericchiang/poke/storage"
+)
+
+// Dynamic client registration lets applications register themselves as clients
+// instead of an admin creating each one by hand. Registering requires an
+// initial access token from the server's config. Each registered client gets a
+// registration access token to read, update or delete its registration later.
+//
+// See: https://tools.ietf.org/html/rfc7591 and https://tools.ietf.org/html/rfc7592
+
+// Registration errors. See https://tools.ietf.org/html/rfc7591#section-3.2.2
+const (
+	errInvalidRedirectURI    = "invalid_redirect_uri"
+	errInvalidClientMetadata = "invalid_client_metadata"
+)
+
+// clientMetadata holds the client fields clients can register themselves.
+type clientMetadata struct {
+	RedirectURIs              []string            `json:"redirect_uris,omitempty"`
+	PostLogoutRedirectURIs    []string            `json:"post_logout_redirect_uris,omitempty"`
+	BackchannelLogoutURI      string              `json:"backchannel_logout_uri,omitempty"`
+	RequestURIs               []string            `json:"request_uris,omitempty"`
+	TokenEndpointAuthMethod   string              `json:"token_endpoint_auth_method,omitempty"`
+	ClientName                string              `json:"client_name,omitempty"`
+	LogoURI                   string              `json:"logo_uri,omitempty"`
+	JWKS                      *jose.JSONWebKeySet `json:"jwks,omitempty"`
+	JWKSURI                   string              `json:"jwks_uri,omitempty"`
+	UserInfoSignedResponseAlg string              `json:"userinfo_signed_response_alg,omitempty"`
+
+	RequirePushedAuthorizationRequests bool `json:"require_pushed_authorization_requests,omitempty"`
+	BackchannelLogoutSessionRequired   bool `json:"backchannel_logout_session_required,omitempty"`
+}
+
+type clientRegistrationResponse struct {
+	ClientID              string `json:"client_id"`
+	ClientSecret          string `json:"client_secret,omitempty"`
+	ClientSecretExpiresAt int64  `json:"client_secret_expires_at"`
+
+	RegistrationAccessToken string `json:"registration_access_token"`
+	RegistrationClientURI   string `json:"registration_client_uri"`
+
+	clientMetadata
+}
+
+// registrationErr is a registration request the server refused because of the
+// client's metadata.
+type registrationErr struct {
+	Type        string
+	Description string
+}
+
+func (err *registrationErr) Error() string {
+	return err.Type + ": " + err.Description
+}
+
+// validate checks client metadata and fills in defaults. signingAlg is the
+// algorithm of the server's signing key, the only one user info can be signed
+// with.
+func (m *clientMetadata) validate(signingAlg jose.SignatureAlgorithm) error {
+	newErr := func(typ, format string, a ...interface{}) error {
+		return &registrationErr{typ, fmt.Sprintf(format, a...)}
+	}
+
+	switch m.TokenEndpointAuthMethod {
+	case "":
+		m.TokenEndpointAuthMethod = authMethodClientSecretBasic
+	case authMethodClientSecretBasic, authMethodClientSecretPost, authMethodClientSecretJWT, authMethodNone:
+	case authMethodPrivateKeyJWT:
+		if m.JWKS == nil && m.JWKSURI == "" {
+			return newErr(errInvalidClientMetadata, `Method "private_key_jwt" requires "jwks" or "jwks_uri".`)
+		}
+	default:
+		return newErr(errInvalidClientMetadata, "Unsupported token_endpoint_auth_method %q.", m.TokenEndpointAuthMethod)
+	}
+	if m.JWKS != nil && m.JWKSURI != "" {
+		return newErr(errInvalidClientMetadata, `Only one of "jwks" and "jwks_uri" may be set.`)
+	}
+	if m.JWKSURI != "" {
+		if u, err := url.Parse(m.JWKSURI); err != nil || u.Scheme != "https" {
+			return newErr(errInvalidClientMetadata, "jwks_uri must be an https URL.")
+		}
+	}
+	if m.UserInfoSignedResponseAlg != "" && m.UserInfoSignedResponseAlg != string(signingAlg) {
+		return newErr(errInvalidClientMetadata, "Unsupported userinfo_signed_response_alg %q.", m.UserInfoSignedResponseAlg)
+	}
+
+	public := m.TokenEndpointAuthMethod == authMethodNone
+	for _, redirectURI := range m.RedirectURIs {
+		if !validRegistrationRedirectURI(redirectURI, public) {
+			return newErr(errInvalidRedirectURI, "Invalid redirect URI %q.", redirectURI)
+		}
+	}
+	for _, redirectURI := range m.PostLogoutRedirectURIs {
+		if !validRegistrationRedirectURI(redirectURI, false) {
+			return newErr(errInvalidClientMetadata, "Invalid post logout redirect URI %q.", redirectURI)
+		}
+	}
+	if m.BackchannelLogoutURI != "" && !validRegistrationRedirectURI(m.BackchannelLogoutURI, false) {
+		return newErr(errInvalidClientMetadata, "Invalid backchannel logout URI %q.", m.BackchannelLogoutURI)
+	}
+	for _, requestURI := range m.RequestURIs {
+		if u, err := url.Parse(requestURI); err != nil || u.Scheme != "https" || u.Host == "" {
+			return newErr(errInvalidClientMetadata, "Invalid request URI %q.", requestURI)
+		}
+	}
+	return nil
+}
+
+// validRegistrationRedirectURI determines if a client may register a redirect
+// URI. Redirect URIs must be absolute without a fragment, and use https unless
+// they point to the loopback interface. Public clients are limited to the
+// redirect URIs which validateRedirectURI accepts for them.
+func validRegistrationRedirectURI(redirectURI string, public bool) bool {
+	if public {
+		return validateRedirectURI(storage.Client{Public: true}, redirectURI)
+	}
+	u, err := url.Parse(redirectURI)
+	if err != nil || !u.IsAbs() || u.Host == "" || u.Fragment != "" {
+		return false
+	}
+	switch u.Scheme {
+	case "https":
+		return true
+	case "http":
+		host, _, err := net.SplitHostPort(u.Host)
+		if err != nil {
+			host = u.Host
+		}
+		return host == "localhost" || net.ParseIP(host).IsLoopback()
+	}
+	return false
+}
+
+// apply sets the registered fields of a client from the metadata. Metadata must
+// be validated first.
+func (m clientMetadata) apply(c *storage.Client) {
+	c.RedirectURIs = m.RedirectURIs
+	c.PostLogoutRedirectURIs = m.PostLogoutRedirectURIs
+	c.BackchannelLogoutURI = m.BackchannelLogoutURI
+	c.RequestURIs = m.RequestURIs
+	c.Name = m.ClientName
+	c.LogoURL = m.LogoURI
+	c.JWKS = m.JWKS
+	c.JWKSURI = m.JWKSURI
+	c.UserInfoSignedResponseAlg = m.UserInfoSignedResponseAlg
+	c.RequirePushedAuthorizationRequests = m.RequirePushedAuthorizationRequests
+	c.BackchannelLogoutSessionRequired = m.BackchannelLogoutSessionRequired
+
+	c.Public = m.TokenEndpointAuthMethod == authMethodNone
+	if c.Public {
+		c.TokenEndpointAuthMethod = ""
+	} else {
+		c.TokenEndpointAuthMethod = m.TokenEndpointAuthMethod
+	}
+
+	switch m.TokenEndpointAuthMethod {
+	case authMethodClientSecretBasic, authMethodClientSecretPost, authMethodClientSecretJWT:
+		if c.Secret == "" {
+			c.Secret = newSecret()
+		}
+	default:
+		c.Secret = ""
+	}
+}
+
+func metadataForClient(c storage.Client) clientMetadata {
+	return clientMetadata{
+		RedirectURIs:              c.RedirectURIs,
+		PostLogoutRedirectURIs:    c.PostLogoutRedirectURIs,
+		BackchannelLogoutURI:      c.BackchannelLogoutURI,
+		RequestURIs:               c.RequestURIs,
+		TokenEndpointAuthMethod:   tokenEndpointAuthMethod(c),
+		ClientName:                c.Name,
+		LogoURI:                   c.LogoURL,
+		JWKS:                      c.JWKS,
+		JWKSURI:                   c.JWKSURI,
+		UserInfoSignedResponseAlg: c.UserInfoSignedResponseAlg,
+
+		RequirePushedAuthorizationRequests: c.RequirePushedAuthorizationRequests,
+		BackchannelLogoutSessionRequired:   c.BackchannelLogoutSessionRequired,
+	}
+}
+
+// newSecret returns a random value suitable for client secrets and
+// registration access tokens.
+func newSecret() string {
+	buff := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, buff); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buff)
+}
+
+// handleRegister handles the client registration endpoint.
+//
+// See: https://tools.ietf.org/html/rfc7591#section-3
+func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		tokenErr(w, errInvalidRequest, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	token, ok := bearerToken(r)
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.registrationToken)) != 1 {
+		bearerErr(w, "invalid_token", "Invalid initial access token.", http.StatusUnauthorized)
+		return
+	}
+
+	metadata, ok := s.decodeClientMetadata(w, r)
+	if !ok {
+		return
+	}
+
+	client := storage.Client{
+		ID:                      storage.NewNonce(),
+		RegistrationAccessToken: newSecret(),
+	}
+	metadata.apply(&client)
+	if err := s.storage.CreateClient(client); err != nil {
+		log.Printf("failed to create client: %v", err)
+		tokenErr(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+	s.writeClientRegistration(w, http.StatusCreated, client)
+}
+
+// handleClientConfiguration lets a registered client read, update and delete
+// its registration.
+//
+// See: https://tools.ietf.org/html/rfc7592#section-2
+func (s *Server) handleClientConfiguration(w http.ResponseWriter, r *http.Request) {
+	clientID := mux.Vars(r)["client"]
+	client, err := s.storage.GetClient(clientID)
+	if err != nil && err != storage.ErrNotFound {
+		log.Printf("failed to get client: %v", err)
+		tokenErr(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+
+	// Unknown clients and clients created outside of registration are treated
+	// as invalid tokens so the endpoint doesn't reveal which clients exist.
+	token, ok := bearerToken(r)
+	if !ok || err == storage.ErrNotFound || client.RegistrationAccessToken == "" ||
+		subtle.ConstantTimeCompare([]byte(token), []byte(client.RegistrationAccessToken)) != 1 {
+		bearerErr(w, "invalid_token", "Invalid registration access token.", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		s.writeClientRegistration(w, http.StatusOK, client)
+	case "PUT":
+		var update struct {
+			ClientID     string `json:"client_id"`
+			ClientSecret string `json:"client_secret"`
+		}
+		metadata, ok := s.decodeClientMetadata(w, r, &update)
+		if !ok {
+			return
+		}
+		if update.ClientID != client.ID {
+			tokenErr(w, errInvalidRequest, "client_id doesn't match the registration.", http.StatusBadRequest)
+			return
+		}
+		if update.ClientSecret != "" && update.ClientSecret != client.Secret {
+			tokenErr(w, errInvalidRequest, "client_secret doesn't match the registration.", http.StatusBadRequest)
+			return
+		}
+
+		var updated storage.Client
+		err := s.storage.UpdateClient(client.ID, func(old storage.Client) (storage.Client, error) {
+			metadata.apply(&old)
+			updated = old
+			return old, nil
+		})
+		if err != nil {
+			log.Printf("failed to update client: %v", err)
+			tokenErr(w, errServerError, "", http.StatusInternalServerError)
+			return
+		}
+		s.writeClientRegistration(w, http.StatusOK, updated)
+	case "DELETE":
+		if err := s.storage.DeleteClient(client.ID); err != nil && err != storage.ErrNotFound {
+			log.Printf("failed to delete client: %v", err)
+			tokenErr(w, errServerError, "", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		tokenErr(w, errInvalidRequest, "Method not allowed.", http.StatusMethodNotAllowed)
+	}
+}
+
+// decodeClientMetadata reads and validates the client metadata in a request
+// body. Additional values decode the body into other structs as well. If the
+// metadata is invalid, an error is written to the response and ok is false.
+func (s *Server) decodeClientMetadata(w http.ResponseWriter, r *http.Request, additional ...interface{}) (metadata clientMetadata, ok bool) {
+	body, err := readBody(r)
+	if err != nil {
+		tokenErr(w, errInvalidRequest, "Failed to read request body.", http.StatusBadRequest)
+		return metadata, false
+	}
+	for _, v := range append([]interface{}{&metadata}, additional...) {
+		if err := json.Unmarshal(body, v); err != nil {
+			tokenErr(w, errInvalidClientMetadata, "Malformed client metadata.", http.StatusBadRequest)
+			return metadata, false
+		}
+	}
+	alg, err := s.signingAlg()
+	if err != nil {
+		log.Printf("failed to get signing algorithm: %v", err)
+		tokenErr(w, errServerError, "", http.StatusInternalServerError)
+		return metadata, false
+	}
+	if err := metadata.validate(alg); err != nil {
+		rerr := err.(*registrationErr)
+		tokenErr(w, rerr.Type, rerr.Description, http.StatusBadRequest)
+		return metadata, false
+	}
+	return metadata, true
+}
+
+func readBody(r *http.Request) ([]byte, error) {
+	defer r.Body.Close()
+	return ioutil.ReadAll(io.LimitReader(r.Body, 1<<20))
+}
+
+func (s *Server) writeClientRegistration(w http.ResponseWriter, status int, client storage.Client) {
+	resp := clientRegistrationResponse{
+		ClientID:                client.ID,
+		ClientSecret:            client.Secret,
+		RegistrationAccessToken: client.RegistrationAccessToken,
+		RegistrationClientURI:   s.absURL("/register", client.ID),
+		clientMetadata:          metadataForClient(client),
+	}
+	data, err := json.Marshal(resp)
+	if err != nil {
+		log.Printf("failed to marshal registration response: %v", err)
+		tokenErr(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(status)
+	w.Write(data)
+}
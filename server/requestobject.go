@@ -0,0 +1,236 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	jose "gopkg.in/square/go-jose.v2"
+
+	"github.com/ericchiang/poke/storage"
+)
+
+// Request objects let clients send the parameters of an authorization request
+// as a JWT signed by one of the client's registered keys, either inline using
+// the "request" parameter or by reference using "request_uri".
+//
+// See: https://tools.ietf.org/html/rfc9101
+// See: http://openid.net/specs/openid-connect-core-1_0.html#JWTRequests
+
+const (
+	// The maximum size of a request object fetched from a request URI.
+	maxRequestObjectSize = 64 << 10
+	// How long to wait for a request URI to respond.
+	requestObjectFetchTimeout = 5 * time.Second
+	// Request objects valid for longer than this are rejected. Like client
+	// assertions, used request objects are remembered until they expire.
+	requestObjectMaxLifetime = time.Hour
+)
+
+// Claims of a request object which aren't authorization request parameters.
+var requestObjectJWTClaims = map[string]bool{
+	"iss": true,
+	"aud": true,
+	"exp": true,
+	"nbf": true,
+	"iat": true,
+	"jti": true,
+}
+
+// resolveRequestObject verifies the request object of an authorization request,
+// if any, and merges its claims into the request's form. Parameters of the
+// request object take precedence over query parameters.
+//
+// Errors are reported to the end user and never redirected, since the redirect
+// URI hasn't been validated yet.
+func (s *Server) resolveRequestObject(r *http.Request) *authErr {
+	if err := r.ParseForm(); err != nil {
+		return &authErr{"", "", errInvalidRequest, "Failed to parse request."}
+	}
+	request, requestURI := r.Form.Get("request"), r.Form.Get("request_uri")
+	switch {
+	case request == "" && requestURI == "":
+		return nil
+	case request != "" && requestURI != "":
+		return &authErr{"", "", errInvalidRequest, "request and request_uri can't both be provided."}
+	}
+
+	clientID := r.Form.Get("client_id")
+	if clientID == "" {
+		return &authErr{"", "", errInvalidRequest, "Request objects require a client_id parameter."}
+	}
+	client, err := s.storage.GetClient(clientID)
+	if err != nil {
+		if err == storage.ErrNotFound {
+			return &authErr{"", "", errUnauthorizedClient, fmt.Sprintf("Invalid client_id (%q).", clientID)}
+		}
+		log.Printf("Failed to get client: %v", err)
+		return &authErr{"", "", errServerError, ""}
+	}
+
+	if requestURI != "" {
+		// Only fetch URIs the client registered, so the server can't be used to
+		// make requests to arbitrary hosts.
+		if !contains(client.RequestURIs, requestURI) {
+			return &authErr{"", "", errInvalidRequestURI, "Unregistered request_uri."}
+		}
+		if request, err = s.fetchRequestObject(requestURI); err != nil {
+			log.Printf("Failed to fetch request object: %v", err)
+			return &authErr{"", "", errInvalidRequestURI, "Failed to fetch request_uri."}
+		}
+	}
+
+	params, used, err := s.verifyRequestObject(client, request)
+	if err != nil {
+		log.Printf("Invalid request object for client %q: %v", client.ID, err)
+		return &authErr{"", "", errInvalidRequestObject, "Invalid request object."}
+	}
+	// Record the request object so it can't be replayed.
+	if err := s.storage.CreateClientAssertion(used); err != nil {
+		if err == storage.ErrAlreadyExists {
+			return &authErr{"", "", errInvalidRequestObject, "Request object has already been used."}
+		}
+		log.Printf("Failed to record request object: %v", err)
+		return &authErr{"", "", errServerError, ""}
+	}
+	for k, v := range params {
+		r.Form[k] = v
+	}
+	r.Form.Del("request")
+	r.Form.Del("request_uri")
+	return nil
+}
+
+// fetchRequestObject retrieves a request object passed by reference.
+func (s *Server) fetchRequestObject(requestURI string) (string, error) {
+	u, err := url.Parse(requestURI)
+	if err != nil {
+		return "", fmt.Errorf("parse request_uri: %v", err)
+	}
+	if u.Scheme != "https" {
+		return "", fmt.Errorf("request_uri must use https, got %q", requestURI)
+	}
+	client := *s.httpClient
+	client.Timeout = requestObjectFetchTimeout
+	resp, err := client.Get(u.String())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("get request object: %s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxRequestObjectSize+1))
+	if err != nil {
+		return "", fmt.Errorf("read request object: %v", err)
+	}
+	if len(body) > maxRequestObjectSize {
+		return "", fmt.Errorf("request object is larger than %d bytes", maxRequestObjectSize)
+	}
+	return string(body), nil
+}
+
+// verifyRequestObject validates the signature and claims of a request object,
+// returning its authorization request parameters and a record of the request
+// object which must be stored to prevent it from being replayed.
+func (s *Server) verifyRequestObject(client storage.Client, token string) (url.Values, storage.ClientAssertion, error) {
+	var used storage.ClientAssertion
+	jws, err := jose.ParseSigned(token)
+	if err != nil {
+		return nil, used, fmt.Errorf("parse request object: %v", err)
+	}
+	if len(jws.Signatures) != 1 {
+		return nil, used, fmt.Errorf("expected one signature, got %d", len(jws.Signatures))
+	}
+	payload, err := s.verifySignedByClient(client, jws)
+	if err != nil {
+		return nil, used, fmt.Errorf("verify request object: %v", err)
+	}
+
+	var claims map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, used, fmt.Errorf("decode claims: %v", err)
+	}
+	var c struct {
+		Issuer    string   `json:"iss"`
+		Audience  audience `json:"aud"`
+		Expiry    int64    `json:"exp"`
+		NotBefore int64    `json:"nbf"`
+		JTI       string   `json:"jti"`
+		ClientID  string   `json:"client_id"`
+	}
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return nil, used, fmt.Errorf("decode claims: %v", err)
+	}
+	if c.Issuer != client.ID {
+		return nil, used, fmt.Errorf("issued by %q", c.Issuer)
+	}
+	if !c.Audience.contains(s.issuerURL.String()) {
+		return nil, used, fmt.Errorf("audience %q doesn't contain the issuer", []string(c.Audience))
+	}
+	if c.ClientID != "" && c.ClientID != client.ID {
+		return nil, used, fmt.Errorf("client_id %q doesn't match the client", c.ClientID)
+	}
+	if c.JTI == "" {
+		return nil, used, fmt.Errorf("no jti claim")
+	}
+	if c.Expiry == 0 {
+		return nil, used, fmt.Errorf("no exp claim")
+	}
+	now, expiry := s.now(), time.Unix(c.Expiry, 0)
+	if !now.Before(expiry) {
+		return nil, used, fmt.Errorf("expired")
+	}
+	if expiry.After(now.Add(requestObjectMaxLifetime)) {
+		return nil, used, fmt.Errorf("expiry is too far in the future")
+	}
+	if c.NotBefore != 0 && now.Before(time.Unix(c.NotBefore, 0)) {
+		return nil, used, fmt.Errorf("not valid yet")
+	}
+
+	params := url.Values{}
+	for name, raw := range claims {
+		if requestObjectJWTClaims[name] {
+			continue
+		}
+		if name == "request" || name == "request_uri" {
+			return nil, used, fmt.Errorf("request objects can't be nested")
+		}
+		value, err := requestObjectParam(raw)
+		if err != nil {
+			return nil, used, fmt.Errorf("claim %q: %v", name, err)
+		}
+		params.Set(name, value)
+	}
+	used = storage.ClientAssertion{ClientID: client.ID, JTI: c.JTI, Expiry: expiry}
+	return params, used, nil
+}
+
+// requestObjectParam converts a request object claim to the value of the
+// equivalent query parameter. Strings and numbers are used as is, while other
+// JSON values, such as the "claims" parameter, are passed as JSON.
+func requestObjectParam(raw json.RawMessage) (string, error) {
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return "", err
+	}
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case nil:
+		return "", nil
+	default:
+		return string(raw), nil
+	}
+}
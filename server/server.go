@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"net/url"
 	"path"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -19,6 +20,18 @@ type Connector struct {
 	ID          string
 	DisplayName string
 	Connector   connector.Connector
+
+	// ClaimMappings issue attributes provided by the connector as claims.
+	ClaimMappings []ClaimMapping
+}
+
+// TrustedIssuer is an external OpenID Connect provider whose ID Tokens clients
+// may exchange for tokens issued by this server.
+type TrustedIssuer struct {
+	// Issuer is the "iss" claim of the provider's tokens.
+	Issuer string
+	// JWKSURL serves the public keys used to verify the provider's tokens.
+	JWKSURL string
 }
 
 // Config holds the server's configuration options.
@@ -31,11 +44,47 @@ type Config struct {
 	// Strategies for federated identity.
 	Connectors []Connector
 
+	// If specified, the ID of a connector implementing connector.PasswordConnector
+	// used to verify credentials for the resource owner password credentials grant.
+	// Clients must still be explicitly allowed to use the grant.
+	PasswordConnector string
+
+	// External issuers whose tokens can be used as subject tokens for token exchange.
+	// Tokens issued by this server are always accepted.
+	TrustedIssuers []TrustedIssuer
+
+	// Issue access tokens as JWTs which resource servers can validate using the
+	// server's public keys. Clients can also opt in individually.
+	JWTAccessTokens bool
+
+	// If specified, enables dynamic client registration. Clients must present
+	// this value as a bearer token to register.
+	RegistrationToken string
+
 	// NOTE: Multiple servers using the same storage are expected to set rotation and
 	// validity periods to the same values.
 	RotateKeysAfter  time.Duration // Defaults to 6 hours.
 	IDTokensValidFor time.Duration // Defaults to 24 hours
 
+	// Lifetimes of end user login sessions. A session expires once it hasn't been
+	// used for the idle timeout, or once it reaches the absolute timeout.
+	SessionIdleTimeout     time.Duration // Defaults to 1 hour.
+	SessionAbsoluteTimeout time.Duration // Defaults to 24 hours.
+
+	// How long after a refresh token is rotated a client may retry with it, in
+	// case it never received the new token. Later uses revoke the token's family.
+	RefreshTokenReuseInterval time.Duration // Defaults to 3 seconds.
+
+	// Lifetimes of refresh tokens. A refresh token expires once it hasn't been
+	// used for the idle timeout, or once the absolute lifetime has passed since
+	// the end user authorized the client. Clients may override both. If not
+	// specified, refresh tokens don't expire.
+	RefreshTokenIdleTimeout      time.Duration
+	RefreshTokenAbsoluteLifetime time.Duration
+
+	// How often expired objects are removed from storage.
+	GCFrequency time.Duration // Defaults to 5 minutes.
+
 	// If specified, the server will use this function for determining time.
 	Now func() time.Time
 }
@@ -54,8 +103,31 @@ type Server struct {
 	// Read-only map of connector IDs to connectors.
 	connectors map[string]Connector
 
+	// ID of the connector used for the password grant. Empty if disabled.
+	passwordConnector string
+
 	storage storage.Storage
 
+	// Map of issuer URLs to the JWKS URLs of trusted issuers for token exchange.
+	trustedIssuers map[string]string
+
+	// If enabled, access tokens are issued as JWTs for all clients.
+	jwtAccessTokens bool
+
+	// Initial access token for dynamic client registration. Empty if disabled.
+	registrationToken string
+
+	// HTTP client used to fetch remote keys and deliver logout tokens.
+	httpClient *http.Client
+
+	// Delay before the first retry of a failed back-channel logout. Doubles for
+	// each following retry.
+	backchannelRetryDelay time.Duration
+
+	// Cache of remote key sets indexed by JWKS URL.
+	keySetsMu sync.Mutex
+	keySets   map[string]*remoteKeySet
+
 	mux http.Handler
 
 	// If enabled, don't prompt user for approval after logging in through connector.
@@ -65,6 +137,14 @@ type Server struct {
 	now func() time.Time
 
 	idTokensValidFor time.Duration
+
+	sessionIdleTimeout     time.Duration
+	sessionAbsoluteTimeout time.Duration
+
+	refreshTokenReuseInterval time.Duration
+
+	refreshTokenIdleTimeout      time.Duration
+	refreshTokenAbsoluteLifetime time.Duration
 }
 
 // New constructs a server from the provided config.
@@ -92,18 +172,56 @@ func newServer(c Config, rotationStrategy rotationStrategy) (*Server, error) {
 		now = time.Now
 	}
 
+	store := storageWithKeyRotation(c.Storage, rotationStrategy, now)
+
 	s := &Server{
-		issuerURL:        *issuerURL,
-		connectors:       make(map[string]Connector),
-		storage:          storageWithKeyRotation(c.Storage, rotationStrategy, now),
-		idTokensValidFor: value(c.IDTokensValidFor, 24*time.Hour),
-		now:              now,
+		issuerURL:         *issuerURL,
+		connectors:        make(map[string]Connector),
+		storage:           storageWithGC(store, value(c.GCFrequency, 5*time.Minute), now),
+		idTokensValidFor:  value(c.IDTokensValidFor, 24*time.Hour),
+		now:               now,
+		trustedIssuers:    make(map[string]string),
+		jwtAccessTokens:   c.JWTAccessTokens,
+		registrationToken: c.RegistrationToken,
+		httpClient:        &http.Client{Timeout: 30 * time.Second},
+		keySets:           make(map[string]*remoteKeySet),
+
+		backchannelRetryDelay: time.Second,
+
+		sessionIdleTimeout:     value(c.SessionIdleTimeout, time.Hour),
+		sessionAbsoluteTimeout: value(c.SessionAbsoluteTimeout, 24*time.Hour),
+
+		refreshTokenReuseInterval: value(c.RefreshTokenReuseInterval, 3*time.Second),
+
+		refreshTokenIdleTimeout:      c.RefreshTokenIdleTimeout,
+		refreshTokenAbsoluteLifetime: c.RefreshTokenAbsoluteLifetime,
+	}
+
+	for _, issuer := range c.TrustedIssuers {
+		if issuer.Issuer == "" || issuer.JWKSURL == "" {
+			return nil, errors.New("server: trusted issuers require an issuer and a JWKS URL")
+		}
+		s.trustedIssuers[issuer.Issuer] = issuer.JWKSURL
 	}
 
 	for _, conn := range c.Connectors {
+		if conn.ClaimMappings, err = validateClaimMappings(conn.ClaimMappings); err != nil {
+			return nil, fmt.Errorf("server: connector %q: %v", conn.ID, err)
+		}
 		s.connectors[conn.ID] = conn
 	}
 
+	if c.PasswordConnector != "" {
+		conn, ok := s.connectors[c.PasswordConnector]
+		if !ok {
+			return nil, fmt.Errorf("server: password connector %q not found", c.PasswordConnector)
+		}
+		if _, ok := conn.Connector.(connector.PasswordConnector); !ok {
+			return nil, fmt.Errorf("server: connector %q does not support password logins", c.PasswordConnector)
+		}
+		s.passwordConnector = c.PasswordConnector
+	}
+
 	r := mux.NewRouter()
 	handleFunc := func(p string, h http.HandlerFunc) {
 		r.HandleFunc(path.Join(issuerURL.Path, p), h)
@@ -113,11 +231,24 @@ func newServer(c Config, rotationStrategy rotationStrategy) (*Server, error) {
 	// TODO(ericchiang): rate limit certain paths based on IP.
 	handleFunc("/.well-known/openid-configuration", s.handleDiscovery)
 	handleFunc("/token", s.handleToken)
+	handleFunc("/par", s.handlePushedAuthRequest)
+	handleFunc("/token/introspect", s.handleIntrospect)
+	handleFunc("/token/revoke", s.handleRevoke)
+	handleFunc("/userinfo", s.handleUserInfo)
 	handleFunc("/keys", s.handlePublicKeys)
 	handleFunc("/auth", s.handleAuthorization)
 	handleFunc("/auth/{connector}", s.handleConnectorLogin)
 	handleFunc("/callback/{connector}", s.handleConnectorCallback)
 	handleFunc("/approval", s.handleApproval)
+	handleFunc("/device", s.handleDeviceVerification)
+	handleFunc("/device/code", s.handleDeviceCode)
+	handleFunc("/device/callback", s.handleDeviceCallback)
+	handleFunc("/logout", s.handleLogout)
+	handleFunc("/consent", s.handleConsent)
+	if s.registrationToken != "" {
+		handleFunc("/register", s.handleRegister)
+		handleFunc("/register/{client}", s.handleClientConfiguration)
+	}
 	s.mux = r
 
 	return s, nil
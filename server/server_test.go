@@ -1,19 +1,37 @@
 package server
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/json"
 	"encoding/pem"
+	"errors"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"net/http/cookiejar"
 	"net/http/httptest"
 	"net/http/httputil"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/ericchiang/oidc"
 	"golang.org/x/net/context"
 	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+	jose "gopkg.in/square/go-jose.v2"
 
+	"github.com/ericchiang/poke/connector"
 	"github.com/ericchiang/poke/connector/mock"
 	"github.com/ericchiang/poke/storage"
 	"github.com/ericchiang/poke/storage/memory"
@@ -59,7 +77,7 @@ FDWV28nTP9sqbtsmU8Tem2jzMvZ7C/Q0AuDoKELFUpux8shm8wfIhyaPnXUGZoAZ
 Np4vUwMSYV5mopESLWOg3loBxKyLGFtgGKVCjGiQvy6zISQ4fQo=
 -----END RSA PRIVATE KEY-----`)
 
-func newTestServer() (*httptest.Server, *Server) {
+func newTestServer(updateConfig func(c *Config)) (*httptest.Server, *Server) {
 	var server *Server
 	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		server.ServeHTTP(w, r)
@@ -75,6 +93,9 @@ func newTestServer() (*httptest.Server, *Server) {
 			},
 		},
 	}
+	if updateConfig != nil {
+		updateConfig(&config)
+	}
 	var err error
 	if server, err = newServer(config, staticRotationStrategy(testKey)); err != nil {
 		panic(err)
@@ -84,14 +105,14 @@ func newTestServer() (*httptest.Server, *Server) {
 }
 
 func TestNewTestServer(t *testing.T) {
-	newTestServer()
+	newTestServer(nil)
 }
 
 func TestDiscovery(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	httpServer, _ := newTestServer()
+	httpServer, _ := newTestServer(nil)
 	defer httpServer.Close()
 
 	p, err := oidc.NewProvider(ctx, httpServer.URL)
@@ -111,13 +132,31 @@ func TestDiscovery(t *testing.T) {
 			t.Errorf("server discovery is missing required field %q", field.name)
 		}
 	}
+
+	// The advertised algorithms are those of the server's signing key.
+	var algs struct {
+		IDTokenAlgs  []string `json:"id_token_signing_alg_values_supported"`
+		UserInfoAlgs []string `json:"userinfo_signing_alg_values_supported"`
+	}
+	resp, err := http.Get(httpServer.URL + "/.well-known/openid-configuration")
+	if err != nil {
+		t.Fatalf("failed to get discovery: %v", err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(&algs); err != nil {
+		t.Fatalf("failed to decode discovery: %v", err)
+	}
+	want := []string{string(jose.RS256)}
+	if !reflect.DeepEqual(algs.IDTokenAlgs, want) || !reflect.DeepEqual(algs.UserInfoAlgs, want) {
+		t.Errorf("expected signing algs %q, got %q and %q", want, algs.IDTokenAlgs, algs.UserInfoAlgs)
+	}
 }
 
 func TestOAuth2Flow(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	httpServer, s := newTestServer()
+	httpServer, s := newTestServer(nil)
 	defer httpServer.Close()
 
 	p, err := oidc.NewProvider(ctx, httpServer.URL)
@@ -219,3 +258,3684 @@ func TestOAuth2Flow(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// authRedirect performs an authorization request with the provided parameters,
+// following redirects within the server, and returns the final redirect to the
+// client's callback.
+func authRedirect(t *testing.T, httpServer *httptest.Server, redirectURL string, v url.Values) *url.URL {
+	httpClient := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if strings.HasPrefix(req.URL.String(), redirectURL) {
+				return http.ErrUseLastResponse
+			}
+			return nil
+		},
+	}
+	resp, err := httpClient.Get(httpServer.URL + "/auth?" + v.Encode())
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	resp.Body.Close()
+
+	u, err := resp.Location()
+	if err != nil {
+		t.Fatalf("no redirect to client: %v", err)
+	}
+	return u
+}
+
+func TestHybridFlow(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, s := newTestServer(nil)
+	defer httpServer.Close()
+
+	redirectURL := "https://client.example.com/callback"
+	client := storage.Client{
+		ID:           "testclient",
+		Secret:       "testclientsecret",
+		RedirectURIs: []string{redirectURL},
+	}
+	if err := s.storage.CreateClient(client); err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+
+	v := url.Values{}
+	v.Set("client_id", client.ID)
+	v.Set("redirect_uri", redirectURL)
+	v.Set("response_type", "code id_token")
+	v.Set("scope", "openid email")
+	v.Set("state", "a_state")
+	v.Set("nonce", "a_nonce")
+	u := authRedirect(t, httpServer, redirectURL, v)
+	if u.RawQuery != "" {
+		t.Errorf("hybrid flow response should not use the query, got %q", u.RawQuery)
+	}
+	fragment, err := url.ParseQuery(u.Fragment)
+	if err != nil {
+		t.Fatalf("failed to parse fragment: %v", err)
+	}
+	if got := fragment.Get("state"); got != "a_state" {
+		t.Errorf("state did not match, want=%q got=%q", "a_state", got)
+	}
+	code, idToken := fragment.Get("code"), fragment.Get("id_token")
+	if code == "" || idToken == "" {
+		t.Fatalf("expected code and id_token in fragment, got %q", u.Fragment)
+	}
+
+	jws, err := jose.ParseSigned(idToken)
+	if err != nil {
+		t.Fatalf("failed to parse id token: %v", err)
+	}
+	payload, err := jws.Verify(&testKey.PublicKey)
+	if err != nil {
+		t.Fatalf("failed to verify id token: %v", err)
+	}
+	var claims struct {
+		Nonce    string `json:"nonce"`
+		CodeHash string `json:"c_hash"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		t.Fatalf("failed to unmarshal claims: %v", err)
+	}
+	if claims.Nonce != "a_nonce" {
+		t.Errorf("nonce did not match, want=%q got=%q", "a_nonce", claims.Nonce)
+	}
+	wantHash, err := tokenHash(jose.RS256, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.CodeHash != wantHash {
+		t.Errorf("c_hash did not match code, want=%q got=%q", wantHash, claims.CodeHash)
+	}
+
+	oauth2Config := &oauth2.Config{
+		ClientID:     client.ID,
+		ClientSecret: client.Secret,
+		Endpoint:     oauth2.Endpoint{TokenURL: httpServer.URL + "/token"},
+		RedirectURL:  redirectURL,
+	}
+	if _, err := oauth2Config.Exchange(ctx, code); err != nil {
+		t.Errorf("failed to exchange code from hybrid flow: %v", err)
+	}
+}
+
+func TestImplicitFlowResponses(t *testing.T) {
+	now := time.Now()
+	httpServer, s := newTestServer(func(c *Config) {
+		c.Now = func() time.Time { return now }
+	})
+	defer httpServer.Close()
+
+	redirectURL := "https://client.example.com/callback"
+	client := storage.Client{
+		ID:           "testclient",
+		Secret:       "testclientsecret",
+		RedirectURIs: []string{redirectURL},
+	}
+	if err := s.storage.CreateClient(client); err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+
+	v := url.Values{
+		"client_id":     {client.ID},
+		"redirect_uri":  {redirectURL},
+		"response_type": {"id_token token"},
+		"scope":         {"openid"},
+		"state":         {"a_state"},
+		"nonce":         {"a_nonce"},
+	}
+	fragment, err := url.ParseQuery(authRedirect(t, httpServer, redirectURL, v).Fragment)
+	if err != nil {
+		t.Fatalf("failed to parse fragment: %v", err)
+	}
+	tok, err := s.lookupAccessToken(fragment.Get("access_token"))
+	if err != nil {
+		t.Fatalf("failed to look up access token: %v", err)
+	}
+	if want := strconv.Itoa(int(tok.Expiry.Sub(now).Seconds())); fragment.Get("expires_in") != want {
+		t.Errorf("expected expires_in to match the access token's expiry %s, got %s", want, fragment.Get("expires_in"))
+	}
+
+	// Out-of-band clients are shown everything issued in the response.
+	public := storage.Client{ID: "publicclient", Public: true}
+	if err := s.storage.CreateClient(public); err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	v = url.Values{
+		"client_id":             {public.ID},
+		"redirect_uri":          {"urn:ietf:wg:oauth:2.0:oob"},
+		"response_type":         {"code id_token token"},
+		"scope":                 {"openid"},
+		"nonce":                 {"a_nonce"},
+		"code_challenge":        {"rualUr8LB3NGquOSnZBtsK0-VAMHhfmlzpiiNV_qPCE"},
+		"code_challenge_method": {"S256"},
+	}
+	resp, err := http.Get(httpServer.URL + "/auth?" + v.Encode())
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read body: %v", err)
+	}
+	for _, prefix := range []string{"Code: ", "Access token: ", "ID token: "} {
+		if !strings.Contains(string(body), prefix) {
+			t.Errorf("expected out-of-band response to include %q, got %q", prefix, body)
+		}
+	}
+}
+
+func TestPKCE(t *testing.T) {
+	httpServer, s := newTestServer(nil)
+	defer httpServer.Close()
+
+	redirectURL := "https://client.example.com/callback"
+	client := storage.Client{
+		ID:           "testclient",
+		Secret:       "testclientsecret",
+		RedirectURIs: []string{redirectURL},
+		RequirePKCE:  true,
+	}
+	if err := s.storage.CreateClient(client); err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+
+	// challenge is BASE64URL-ENCODE(SHA256(ASCII(verifier)))
+	verifier := "dBjftJeZ4CVP-mJ92K1s-G5JKTOkQLWPzjLHUrOQ7lM"
+	challenge := "rualUr8LB3NGquOSnZBtsK0-VAMHhfmlzpiiNV_qPCE"
+
+	newCode := func() string {
+		v := url.Values{}
+		v.Set("client_id", client.ID)
+		v.Set("redirect_uri", redirectURL)
+		v.Set("response_type", "code")
+		v.Set("scope", "openid")
+		v.Set("state", "a_state")
+		v.Set("code_challenge", challenge)
+		v.Set("code_challenge_method", "S256")
+		code := authRedirect(t, httpServer, redirectURL, v).Query().Get("code")
+		if code == "" {
+			t.Fatalf("no code returned")
+		}
+		return code
+	}
+
+	exchange := func(code, verifier string) int {
+		v := url.Values{}
+		v.Set("grant_type", "authorization_code")
+		v.Set("code", code)
+		v.Set("redirect_uri", redirectURL)
+		v.Set("code_verifier", verifier)
+		req, err := http.NewRequest("POST", httpServer.URL+"/token", strings.NewReader(v.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(client.ID, client.Secret)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("post failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := exchange(newCode(), "wrong-verifier-wrong-verifier-wrong-verifier"); status != http.StatusBadRequest {
+		t.Errorf("exchange with invalid code_verifier: expected status %d got %d", http.StatusBadRequest, status)
+	}
+	if status := exchange(newCode(), verifier); status != http.StatusOK {
+		t.Errorf("exchange with valid code_verifier: expected status %d got %d", http.StatusOK, status)
+	}
+
+	// A client requiring PKCE must not be able to start a flow without it.
+	v := url.Values{}
+	v.Set("client_id", client.ID)
+	v.Set("redirect_uri", redirectURL)
+	v.Set("response_type", "code")
+	v.Set("scope", "openid")
+	resp, err := http.Get(httpServer.URL + "/auth?" + v.Encode())
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		t.Errorf("expected authorization request without code_challenge to fail")
+	}
+}
+
+func TestClientCredentials(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, s := newTestServer(nil)
+	defer httpServer.Close()
+
+	client := storage.Client{
+		ID:            "testclient",
+		Secret:        "testclientsecret",
+		AllowedScopes: []string{"read", "write"},
+	}
+	if err := s.storage.CreateClient(client); err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+
+	config := &clientcredentials.Config{
+		ClientID:     client.ID,
+		ClientSecret: client.Secret,
+		TokenURL:     httpServer.URL + "/token",
+		Scopes:       []string{"read"},
+	}
+	token, err := config.Token(ctx)
+	if err != nil {
+		t.Fatalf("failed to get token: %v", err)
+	}
+	if token.RefreshToken != "" {
+		t.Errorf("client_credentials grant should not issue a refresh token")
+	}
+
+	jws, err := jose.ParseSigned(token.AccessToken)
+	if err != nil {
+		t.Fatalf("failed to parse access token: %v", err)
+	}
+	payload, err := jws.Verify(&testKey.PublicKey)
+	if err != nil {
+		t.Fatalf("failed to verify access token: %v", err)
+	}
+	var claims accessTokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		t.Fatalf("failed to unmarshal claims: %v", err)
+	}
+	if claims.Subject != client.ID {
+		t.Errorf("expected subject %q got %q", client.ID, claims.Subject)
+	}
+	if claims.Scope != "read" {
+		t.Errorf("expected scope %q got %q", "read", claims.Scope)
+	}
+
+	config.Scopes = []string{"read", "admin"}
+	if _, err := config.Token(ctx); err == nil {
+		t.Errorf("expected request for scope outside of the client's allowlist to fail")
+	}
+}
+
+func TestPasswordGrant(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, s := newTestServer(func(c *Config) {
+		c.Connectors = append(c.Connectors, Connector{
+			ID:          "password",
+			DisplayName: "Password",
+			Connector:   mock.NewPasswordConnector("kilgore", "trout"),
+		})
+		c.PasswordConnector = "password"
+	})
+	defer httpServer.Close()
+
+	client := storage.Client{
+		ID:                 "testclient",
+		Secret:             "testclientsecret",
+		AllowPasswordGrant: true,
+	}
+	if err := s.storage.CreateClient(client); err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+
+	oauth2Config := &oauth2.Config{
+		ClientID:     client.ID,
+		ClientSecret: client.Secret,
+		Endpoint:     oauth2.Endpoint{TokenURL: httpServer.URL + "/token"},
+		Scopes:       []string{"openid", "groups", "offline_access"},
+	}
+	token, err := oauth2Config.PasswordCredentialsToken(ctx, "kilgore", "trout")
+	if err != nil {
+		t.Fatalf("failed to get token: %v", err)
+	}
+	if token.RefreshToken == "" {
+		t.Errorf("expected a refresh token when requesting offline_access")
+	}
+	idToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		t.Fatalf("no id token found")
+	}
+	jws, err := jose.ParseSigned(idToken)
+	if err != nil {
+		t.Fatalf("failed to parse id token: %v", err)
+	}
+	payload, err := jws.Verify(&testKey.PublicKey)
+	if err != nil {
+		t.Fatalf("failed to verify id token: %v", err)
+	}
+	var claims idTokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		t.Fatalf("failed to unmarshal claims: %v", err)
+	}
+	if len(claims.Groups) != 1 || claims.Groups[0] != "authors" {
+		t.Errorf("expected groups %q got %q", []string{"authors"}, claims.Groups)
+	}
+
+	if _, err := oauth2Config.PasswordCredentialsToken(ctx, "kilgore", "wrong"); err == nil {
+		t.Errorf("expected login with invalid password to fail")
+	}
+
+	// Clients must be explicitly allowed to use the grant.
+	if err := s.storage.UpdateClient(client.ID, func(c storage.Client) (storage.Client, error) {
+		c.AllowPasswordGrant = false
+		return c, nil
+	}); err != nil {
+		t.Fatalf("failed to update client: %v", err)
+	}
+	if _, err := oauth2Config.PasswordCredentialsToken(ctx, "kilgore", "trout"); err == nil {
+		t.Errorf("expected password grant to fail for client which isn't allowed to use it")
+	}
+}
+
+func TestDeviceFlow(t *testing.T) {
+	httpServer, s := newTestServer(nil)
+	defer httpServer.Close()
+
+	client := storage.Client{
+		ID:     "testclient",
+		Public: true,
+	}
+	if err := s.storage.CreateClient(client); err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+
+	resp, err := http.PostForm(httpServer.URL+"/device/code", url.Values{
+		"client_id": {client.ID},
+		"scope":     {"openid email"},
+	})
+	if err != nil {
+		t.Fatalf("post failed: %v", err)
+	}
+	var deviceResp struct {
+		DeviceCode      string `json:"device_code"`
+		UserCode        string `json:"user_code"`
+		VerificationURI string `json:"verification_uri"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&deviceResp)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("failed to decode device code response: %v", err)
+	}
+
+	poll := func() (status int, body map[string]interface{}) {
+		resp, err := http.PostForm(httpServer.URL+"/token", url.Values{
+			"client_id":   {client.ID},
+			"grant_type":  {grantTypeDeviceCode},
+			"device_code": {deviceResp.DeviceCode},
+		})
+		if err != nil {
+			t.Fatalf("post failed: %v", err)
+		}
+		defer resp.Body.Close()
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatalf("failed to decode token response: %v", err)
+		}
+		return resp.StatusCode, body
+	}
+
+	if status, body := poll(); status != http.StatusBadRequest || body["error"] != errAuthorizationPending {
+		t.Errorf("expected %q before the user authorizes the device, got %d %v", errAuthorizationPending, status, body)
+	}
+	if _, body := poll(); body["error"] != errSlowDown {
+		t.Errorf("expected %q when polling too quickly, got %v", errSlowDown, body)
+	}
+
+	// The end user enters the code, lowercased and without the dash.
+	userCode := strings.ToLower(strings.Replace(deviceResp.UserCode, "-", "", -1))
+	resp, err = http.PostForm(deviceResp.VerificationURI, url.Values{"user_code": {userCode}})
+	if err != nil {
+		t.Fatalf("post failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Request.URL.Path != "/device/callback" {
+		t.Fatalf("expected to end at device callback, got %d %s", resp.StatusCode, resp.Request.URL)
+	}
+
+	status, body := poll()
+	if status != http.StatusOK {
+		t.Fatalf("expected tokens after the user authorized the device, got %d %v", status, body)
+	}
+	if _, ok := body["id_token"].(string); !ok {
+		t.Errorf("no id_token in response %v", body)
+	}
+	if status, _ := poll(); status != http.StatusBadRequest {
+		t.Errorf("expected tokens to only be returned once, got status %d", status)
+	}
+}
+
+func TestDeviceFlowDenied(t *testing.T) {
+	httpServer, s := newTestServer(nil)
+	defer httpServer.Close()
+	s.skipApproval = false
+
+	client := storage.Client{ID: "testclient", Public: true}
+	if err := s.storage.CreateClient(client); err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+
+	resp, err := http.PostForm(httpServer.URL+"/device/code", url.Values{
+		"client_id": {client.ID},
+		"scope":     {"openid"},
+	})
+	if err != nil {
+		t.Fatalf("post failed: %v", err)
+	}
+	var deviceResp struct {
+		DeviceCode      string `json:"device_code"`
+		UserCode        string `json:"user_code"`
+		VerificationURI string `json:"verification_uri"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&deviceResp)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("failed to decode device code response: %v", err)
+	}
+
+	// The end user has already approved the client, but must still approve the
+	// device.
+	consent := storage.Consent{
+		ConnectorID: "mock",
+		UserID:      "0-385-28089-0",
+		ClientID:    client.ID,
+		Scopes:      []string{"openid"},
+	}
+	if err := s.storage.CreateConsent(consent); err != nil {
+		t.Fatalf("failed to create consent: %v", err)
+	}
+
+	// The end user enters the code, then refuses to authorize the device.
+	resp, err = http.PostForm(deviceResp.VerificationURI, url.Values{"user_code": {deviceResp.UserCode}})
+	if err != nil {
+		t.Fatalf("post failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Request.URL.Path != "/approval" {
+		t.Fatalf("expected approval prompt, got %d %s", resp.StatusCode, resp.Request.URL)
+	}
+	state := resp.Request.URL.Query().Get("state")
+	resp, err = http.PostForm(httpServer.URL+"/approval", url.Values{"state": {state}, "approval": {"deny"}})
+	if err != nil {
+		t.Fatalf("post failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected status 403 after denying the device, got %d", resp.StatusCode)
+	}
+
+	resp, err = http.PostForm(httpServer.URL+"/token", url.Values{
+		"client_id":   {client.ID},
+		"grant_type":  {grantTypeDeviceCode},
+		"device_code": {deviceResp.DeviceCode},
+	})
+	if err != nil {
+		t.Fatalf("post failed: %v", err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("failed to decode token response: %v", err)
+	}
+	if resp.StatusCode != http.StatusBadRequest || body.Error != errAccessDenied {
+		t.Errorf("expected %q after the end user denied the device, got %d %q", errAccessDenied, resp.StatusCode, body.Error)
+	}
+}
+
+func TestTokenExchange(t *testing.T) {
+	// An external provider whose ID Tokens the server trusts.
+	externalKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	external := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{
+			Keys: []jose.JSONWebKey{{Key: &externalKey.PublicKey, Algorithm: string(jose.ES256), Use: "sig"}},
+		})
+	}))
+	defer external.Close()
+
+	httpServer, s := newTestServer(func(c *Config) {
+		c.TrustedIssuers = []TrustedIssuer{{Issuer: external.URL, JWKSURL: external.URL}}
+	})
+	defer httpServer.Close()
+
+	clients := []storage.Client{
+		{ID: "frontend", Secret: "frontendsecret"},
+		{ID: "gateway", Secret: "gatewaysecret"},
+		{ID: "backend", Secret: "backendsecret", TrustedPeers: []string{"gateway"}},
+	}
+	for _, client := range clients {
+		if err := s.storage.CreateClient(client); err != nil {
+			t.Fatalf("failed to create client: %v", err)
+		}
+	}
+
+	exchange := func(subjectToken, audience, scope string) (*http.Response, accessTokenResponse) {
+		v := url.Values{
+			"grant_type":         {grantTypeTokenExchange},
+			"subject_token":      {subjectToken},
+			"subject_token_type": {tokenTypeIDToken},
+			"audience":           {audience},
+		}
+		if scope != "" {
+			v.Set("scope", scope)
+		}
+		req, err := http.NewRequest("POST", httpServer.URL+"/token", strings.NewReader(v.Encode()))
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth("gateway", "gatewaysecret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("failed to exchange token: %v", err)
+		}
+		defer resp.Body.Close()
+		var tokenResp accessTokenResponse
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+		}
+		return resp, tokenResp
+	}
+
+	verifyExchanged := func(token accessTokenResponse, wantSubject string) {
+		if token.IssuedTokenType != tokenTypeIDToken {
+			t.Errorf("expected issued_token_type %q got %q", tokenTypeIDToken, token.IssuedTokenType)
+		}
+		jws, err := jose.ParseSigned(token.AccessToken)
+		if err != nil {
+			t.Fatalf("failed to parse token: %v", err)
+		}
+		payload, err := jws.Verify(&testKey.PublicKey)
+		if err != nil {
+			t.Fatalf("failed to verify token: %v", err)
+		}
+		var claims idTokenClaims
+		if err := json.Unmarshal(payload, &claims); err != nil {
+			t.Fatalf("failed to unmarshal claims: %v", err)
+		}
+		if claims.Subject != wantSubject {
+			t.Errorf("expected subject %q got %q", wantSubject, claims.Subject)
+		}
+		if len(claims.Audience) != 1 || claims.Audience[0] != "backend" {
+			t.Errorf("expected audience [backend] got %q", claims.Audience)
+		}
+		if claims.AuthorizingParty != "gateway" {
+			t.Errorf("expected azp %q got %q", "gateway", claims.AuthorizingParty)
+		}
+	}
+
+	// A token issued by this server to the gateway.
+	idToken, _, err := s.newIDToken("gateway", "", storage.Identity{UserID: "kilgore"}, []string{scopeOpenID}, "", "", "")
+	if err != nil {
+		t.Fatalf("failed to create ID token: %v", err)
+	}
+	resp, token := exchange(idToken, "backend", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected exchange of local token to succeed, got %s", resp.Status)
+	}
+	verifyExchanged(token, "kilgore")
+
+	// A token from a trusted external issuer. Its subject is qualified by the
+	// issuer so it isn't confused with the local user of the same ID.
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: externalKey}, nil)
+	if err != nil {
+		t.Fatalf("failed to create signer: %v", err)
+	}
+	claims, err := json.Marshal(subjectTokenClaims{
+		Issuer:   external.URL,
+		Subject:  "kilgore",
+		Audience: audience{"gateway"},
+		Expiry:   time.Now().Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal claims: %v", err)
+	}
+	signed, err := signer.Sign(claims)
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+	externalToken, err := signed.CompactSerialize()
+	if err != nil {
+		t.Fatalf("failed to serialize token: %v", err)
+	}
+	resp, token = exchange(externalToken, "backend", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected exchange of external token to succeed, got %s", resp.Status)
+	}
+	verifyExchanged(token, external.URL+"#kilgore")
+
+	// The frontend doesn't trust the gateway.
+	if resp, _ := exchange(idToken, "frontend", ""); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected exchange for untrusted audience to fail, got %s", resp.Status)
+	}
+
+	// A token issued to the frontend can't be exchanged by the gateway.
+	frontendToken, _, err := s.newIDToken("frontend", "", storage.Identity{UserID: "kilgore"}, []string{scopeOpenID}, "", "", "")
+	if err != nil {
+		t.Fatalf("failed to create ID token: %v", err)
+	}
+	if resp, _ := exchange(frontendToken, "backend", ""); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected exchange of token issued to another client to fail, got %s", resp.Status)
+	}
+
+	// Scopes can be narrowed but not widened.
+	if resp, _ := exchange(idToken, "backend", "openid"); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected exchange with granted scope to succeed, got %s", resp.Status)
+	}
+	if resp, _ := exchange(idToken, "backend", "openid email"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected exchange with scope beyond the subject token to fail, got %s", resp.Status)
+	}
+
+	if resp, _ := exchange(idToken[:len(idToken)-4]+"AAAA", "backend", ""); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected exchange of token with invalid signature to fail, got %s", resp.Status)
+	}
+}
+
+func TestClientAssertion(t *testing.T) {
+	httpServer, s := newTestServer(nil)
+	defer httpServer.Close()
+
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	clients := []storage.Client{
+		{
+			ID:                      "keyclient",
+			TokenEndpointAuthMethod: authMethodPrivateKeyJWT,
+			AllowedScopes:           []string{"read"},
+			JWKS: &jose.JSONWebKeySet{
+				Keys: []jose.JSONWebKey{{Key: &clientKey.PublicKey, KeyID: "key1", Algorithm: string(jose.ES256), Use: "sig"}},
+			},
+		},
+		{
+			ID:                      "secretclient",
+			Secret:                  "a secret long enough for an hmac key",
+			TokenEndpointAuthMethod: authMethodClientSecretJWT,
+			AllowedScopes:           []string{"read"},
+		},
+	}
+	for _, client := range clients {
+		if err := s.storage.CreateClient(client); err != nil {
+			t.Fatalf("failed to create client: %v", err)
+		}
+	}
+
+	newAssertion := func(key jose.SigningKey, claims clientAssertionClaims) string {
+		signer, err := jose.NewSigner(key, nil)
+		if err != nil {
+			t.Fatalf("failed to create signer: %v", err)
+		}
+		payload, err := json.Marshal(claims)
+		if err != nil {
+			t.Fatalf("failed to marshal claims: %v", err)
+		}
+		jws, err := signer.Sign(payload)
+		if err != nil {
+			t.Fatalf("failed to sign assertion: %v", err)
+		}
+		assertion, err := jws.CompactSerialize()
+		if err != nil {
+			t.Fatalf("failed to serialize assertion: %v", err)
+		}
+		return assertion
+	}
+	requestToken := func(assertion string) int {
+		resp, err := http.PostForm(httpServer.URL+"/token", url.Values{
+			"grant_type":            {grantTypeClientCredentials},
+			"client_assertion_type": {clientAssertionTypeJWTBearer},
+			"client_assertion":      {assertion},
+		})
+		if err != nil {
+			t.Fatalf("failed to request token: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	claimsFor := func(clientID string) clientAssertionClaims {
+		return clientAssertionClaims{
+			Issuer:   clientID,
+			Subject:  clientID,
+			Audience: audience{httpServer.URL + "/token"},
+			Expiry:   time.Now().Add(5 * time.Minute).Unix(),
+			JTI:      storage.NewNonce(),
+		}
+	}
+
+	privateKey := jose.SigningKey{Algorithm: jose.ES256, Key: clientKey}
+	secretKey := jose.SigningKey{Algorithm: jose.HS256, Key: []byte(clients[1].Secret)}
+
+	assertion := newAssertion(privateKey, claimsFor("keyclient"))
+	if status := requestToken(assertion); status != http.StatusOK {
+		t.Errorf("private_key_jwt: expected status 200 got %d", status)
+	}
+	if status := requestToken(assertion); status != http.StatusUnauthorized {
+		t.Errorf("replayed assertion: expected status 401 got %d", status)
+	}
+
+	if status := requestToken(newAssertion(secretKey, claimsFor("secretclient"))); status != http.StatusOK {
+		t.Errorf("client_secret_jwt: expected status 200 got %d", status)
+	}
+
+	// An assertion signed with the wrong client's credentials.
+	if status := requestToken(newAssertion(secretKey, claimsFor("keyclient"))); status != http.StatusUnauthorized {
+		t.Errorf("assertion with wrong key: expected status 401 got %d", status)
+	}
+
+	wrongAudience := claimsFor("keyclient")
+	wrongAudience.Audience = audience{"https://example.com/token"}
+	if status := requestToken(newAssertion(privateKey, wrongAudience)); status != http.StatusUnauthorized {
+		t.Errorf("assertion with wrong audience: expected status 401 got %d", status)
+	}
+
+	expired := claimsFor("keyclient")
+	expired.Expiry = time.Now().Add(-time.Minute).Unix()
+	if status := requestToken(newAssertion(privateKey, expired)); status != http.StatusUnauthorized {
+		t.Errorf("expired assertion: expected status 401 got %d", status)
+	}
+}
+
+func TestTokenEndpointAuthMethod(t *testing.T) {
+	httpServer, s := newTestServer(nil)
+	defer httpServer.Close()
+
+	clients := []storage.Client{
+		{
+			ID:                      "basicclient",
+			Secret:                  "basicsecret",
+			TokenEndpointAuthMethod: authMethodClientSecretBasic,
+			AllowedScopes:           []string{"read"},
+		},
+		// A client created before auth methods were recorded.
+		{ID: "legacyclient", Secret: "legacysecret", AllowedScopes: []string{"read"}},
+		{
+			ID:                      "postclient",
+			Secret:                  "postsecret",
+			TokenEndpointAuthMethod: authMethodClientSecretPost,
+			AllowedScopes:           []string{"read"},
+		},
+		{ID: "publicclient", Public: true},
+	}
+	for _, client := range clients {
+		if err := s.storage.CreateClient(client); err != nil {
+			t.Fatalf("failed to create client: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		path string
+		form url.Values
+		// Credentials sent using HTTP basic auth, if set.
+		basicID, basicSecret string
+		wantStatus           int
+	}{
+		{
+			name:        "client_secret_basic",
+			path:        "/token",
+			form:        url.Values{"grant_type": {grantTypeClientCredentials}},
+			basicID:     "basicclient",
+			basicSecret: "basicsecret",
+			wantStatus:  http.StatusOK,
+		},
+		{
+			name:        "legacy client uses client_secret_basic",
+			path:        "/token",
+			form:        url.Values{"grant_type": {grantTypeClientCredentials}},
+			basicID:     "legacyclient",
+			basicSecret: "legacysecret",
+			wantStatus:  http.StatusOK,
+		},
+		{
+			name: "legacy client uses client_secret_post",
+			path: "/token",
+			form: url.Values{
+				"grant_type":    {grantTypeClientCredentials},
+				"client_id":     {"legacyclient"},
+				"client_secret": {"legacysecret"},
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name: "legacy client can't post the wrong secret",
+			path: "/token",
+			form: url.Values{
+				"grant_type":    {grantTypeClientCredentials},
+				"client_id":     {"legacyclient"},
+				"client_secret": {"basicsecret"},
+			},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "client_secret_post rejected for client_secret_basic client",
+			path: "/token",
+			form: url.Values{
+				"grant_type":    {grantTypeClientCredentials},
+				"client_id":     {"basicclient"},
+				"client_secret": {"basicsecret"},
+			},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "confidential client can't skip authentication",
+			path:       "/token",
+			form:       url.Values{"grant_type": {grantTypeClientCredentials}, "client_id": {"basicclient"}},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "client_secret_post",
+			path: "/token",
+			form: url.Values{
+				"grant_type":    {grantTypeClientCredentials},
+				"client_id":     {"postclient"},
+				"client_secret": {"postsecret"},
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:        "client_secret_basic rejected for client_secret_post client",
+			path:        "/token",
+			form:        url.Values{"grant_type": {grantTypeClientCredentials}},
+			basicID:     "postclient",
+			basicSecret: "postsecret",
+			wantStatus:  http.StatusUnauthorized,
+		},
+		{
+			name:       "public client uses none",
+			path:       "/device/code",
+			form:       url.Values{"client_id": {"publicclient"}, "scope": {"openid"}},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "public client can't use an empty secret",
+			path:       "/device/code",
+			form:       url.Values{"client_id": {"publicclient"}, "client_secret": {""}, "scope": {"openid"}},
+			wantStatus: http.StatusUnauthorized,
+		},
+	}
+	for _, tc := range tests {
+		req, err := http.NewRequest("POST", httpServer.URL+tc.path, strings.NewReader(tc.form.Encode()))
+		if err != nil {
+			t.Fatalf("%s: failed to create request: %v", tc.name, err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if tc.basicID != "" {
+			req.SetBasicAuth(tc.basicID, tc.basicSecret)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: post failed: %v", tc.name, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.wantStatus {
+			t.Errorf("%s: expected status %d got %d", tc.name, tc.wantStatus, resp.StatusCode)
+		}
+	}
+}
+
+func TestIntrospect(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, s := newTestServer(func(c *Config) {
+		c.Connectors = append(c.Connectors, Connector{
+			ID:          "password",
+			DisplayName: "Password",
+			Connector:   mock.NewPasswordConnector("kilgore", "trout"),
+		})
+		c.PasswordConnector = "password"
+	})
+	defer httpServer.Close()
+
+	client := storage.Client{
+		ID:                 "testclient",
+		Secret:             "testclientsecret",
+		AllowPasswordGrant: true,
+		AllowedScopes:      []string{"read"},
+	}
+	resourceServer := storage.Client{ID: "resourceserver", Secret: "resourceserversecret"}
+	for _, c := range []storage.Client{client, resourceServer} {
+		if err := s.storage.CreateClient(c); err != nil {
+			t.Fatalf("failed to create client: %v", err)
+		}
+	}
+
+	introspect := func(token string, authenticate bool) (int, introspectionResponse) {
+		v := url.Values{"token": {token}}
+		req, err := http.NewRequest("POST", httpServer.URL+"/token/introspect", strings.NewReader(v.Encode()))
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if authenticate {
+			req.SetBasicAuth(resourceServer.ID, resourceServer.Secret)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("post failed: %v", err)
+		}
+		defer resp.Body.Close()
+		var body introspectionResponse
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+		}
+		return resp.StatusCode, body
+	}
+
+	oauth2Config := &oauth2.Config{
+		ClientID:     client.ID,
+		ClientSecret: client.Secret,
+		Endpoint:     oauth2.Endpoint{TokenURL: httpServer.URL + "/token"},
+		Scopes:       []string{"openid", "groups"},
+	}
+	token, err := oauth2Config.PasswordCredentialsToken(ctx, "kilgore", "trout")
+	if err != nil {
+		t.Fatalf("failed to get token: %v", err)
+	}
+
+	if status, _ := introspect(token.AccessToken, false); status != http.StatusUnauthorized {
+		t.Errorf("unauthenticated introspection: expected status 401 got %d", status)
+	}
+
+	status, resp := introspect(token.AccessToken, true)
+	if status != http.StatusOK {
+		t.Fatalf("introspect access token: expected status 200 got %d", status)
+	}
+	if !resp.Active {
+		t.Errorf("expected access token to be active")
+	}
+	if resp.ClientID != client.ID {
+		t.Errorf("expected client_id %q got %q", client.ID, resp.ClientID)
+	}
+	if resp.Scope != "openid groups" {
+		t.Errorf("expected scope %q got %q", "openid groups", resp.Scope)
+	}
+	if resp.Subject == "" || len(resp.Groups) == 0 {
+		t.Errorf("expected sub and groups in response, got %#v", resp)
+	}
+
+	// Tokens from the client_credentials grant are self-contained.
+	ccConfig := &clientcredentials.Config{
+		ClientID:     client.ID,
+		ClientSecret: client.Secret,
+		TokenURL:     httpServer.URL + "/token",
+		Scopes:       []string{"read"},
+	}
+	ccToken, err := ccConfig.Token(ctx)
+	if err != nil {
+		t.Fatalf("failed to get client credentials token: %v", err)
+	}
+	if _, resp := introspect(ccToken.AccessToken, true); !resp.Active || resp.Subject != client.ID || resp.Scope != "read" {
+		t.Errorf("expected active client credentials token, got %#v", resp)
+	}
+
+	idToken, _ := token.Extra("id_token").(string)
+	for name, tok := range map[string]string{"unknown": storage.NewNonce(), "ID Token": idToken} {
+		if _, resp := introspect(tok, true); resp.Active {
+			t.Errorf("expected %s token to be inactive", name)
+		}
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, s := newTestServer(func(c *Config) {
+		c.Connectors = append(c.Connectors, Connector{
+			ID:          "password",
+			DisplayName: "Password",
+			Connector:   mock.NewPasswordConnector("kilgore", "trout"),
+		})
+		c.PasswordConnector = "password"
+	})
+	defer httpServer.Close()
+
+	client := storage.Client{ID: "testclient", Secret: "testclientsecret", AllowPasswordGrant: true}
+	otherClient := storage.Client{ID: "otherclient", Secret: "otherclientsecret"}
+	for _, c := range []storage.Client{client, otherClient} {
+		if err := s.storage.CreateClient(c); err != nil {
+			t.Fatalf("failed to create client: %v", err)
+		}
+	}
+
+	revoke := func(c storage.Client, token, hint string) int {
+		v := url.Values{"token": {token}}
+		if hint != "" {
+			v.Set("token_type_hint", hint)
+		}
+		req, err := http.NewRequest("POST", httpServer.URL+"/token/revoke", strings.NewReader(v.Encode()))
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(c.ID, c.Secret)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("post failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	oauth2Config := &oauth2.Config{
+		ClientID:     client.ID,
+		ClientSecret: client.Secret,
+		Endpoint:     oauth2.Endpoint{TokenURL: httpServer.URL + "/token"},
+		Scopes:       []string{"openid", "offline_access"},
+	}
+	token, err := oauth2Config.PasswordCredentialsToken(ctx, "kilgore", "trout")
+	if err != nil {
+		t.Fatalf("failed to get token: %v", err)
+	}
+
+	// Another client can't revoke the token, but isn't told so.
+	if status := revoke(otherClient, token.RefreshToken, ""); status != http.StatusOK {
+		t.Errorf("revoke another client's token: expected status 200 got %d", status)
+	}
+	if _, err := s.storage.GetRefresh(token.RefreshToken); err != nil {
+		t.Errorf("refresh token revoked by another client: %v", err)
+	}
+
+	if status := revoke(client, token.RefreshToken, "refresh_token"); status != http.StatusOK {
+		t.Errorf("revoke refresh token: expected status 200 got %d", status)
+	}
+	if _, err := s.storage.GetRefresh(token.RefreshToken); err != storage.ErrNotFound {
+		t.Errorf("expected refresh token to be deleted, got %v", err)
+	}
+
+	if status := revoke(client, token.AccessToken, "access_token"); status != http.StatusOK {
+		t.Errorf("revoke access token: expected status 200 got %d", status)
+	}
+	if _, err := s.storage.GetAccessToken(token.AccessToken); err != storage.ErrNotFound {
+		t.Errorf("expected access token to be deleted, got %v", err)
+	}
+
+	// Revoking an unknown or already revoked token still succeeds.
+	if status := revoke(client, token.RefreshToken, ""); status != http.StatusOK {
+		t.Errorf("revoke unknown token: expected status 200 got %d", status)
+	}
+}
+
+func TestUserInfo(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, s := newTestServer(func(c *Config) {
+		c.Connectors = append(c.Connectors, Connector{
+			ID:          "password",
+			DisplayName: "Password",
+			Connector:   mock.NewPasswordConnector("kilgore", "trout"),
+		})
+		c.PasswordConnector = "password"
+	})
+	defer httpServer.Close()
+
+	client := storage.Client{ID: "testclient", Secret: "testclientsecret", AllowPasswordGrant: true}
+	signedClient := storage.Client{
+		ID:                        "signedclient",
+		Secret:                    "signedclientsecret",
+		AllowPasswordGrant:        true,
+		UserInfoSignedResponseAlg: string(jose.RS256),
+	}
+	// A client registered for an algorithm the server's key doesn't use.
+	mismatchedClient := storage.Client{
+		ID:                        "mismatchedclient",
+		Secret:                    "mismatchedclientsecret",
+		AllowPasswordGrant:        true,
+		UserInfoSignedResponseAlg: string(jose.ES256),
+	}
+	for _, c := range []storage.Client{client, signedClient, mismatchedClient} {
+		if err := s.storage.CreateClient(c); err != nil {
+			t.Fatalf("failed to create client: %v", err)
+		}
+	}
+
+	accessToken := func(c storage.Client, scopes ...string) string {
+		oauth2Config := &oauth2.Config{
+			ClientID:     c.ID,
+			ClientSecret: c.Secret,
+			Endpoint:     oauth2.Endpoint{TokenURL: httpServer.URL + "/token"},
+			Scopes:       scopes,
+		}
+		token, err := oauth2Config.PasswordCredentialsToken(ctx, "kilgore", "trout")
+		if err != nil {
+			t.Fatalf("failed to get token: %v", err)
+		}
+		return token.AccessToken
+	}
+	userInfo := func(token string) (*http.Response, []byte) {
+		req, err := http.NewRequest("GET", httpServer.URL+"/userinfo", nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("get failed: %v", err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("failed to read body: %v", err)
+		}
+		return resp, body
+	}
+
+	resp, body := userInfo(accessToken(client, "openid", "email"))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200 got %s: %s", resp.Status, body)
+	}
+	var claims userInfoClaims
+	if err := json.Unmarshal(body, &claims); err != nil {
+		t.Fatalf("failed to decode user info: %v", err)
+	}
+	if claims.Subject == "" || claims.Email == "" {
+		t.Errorf("expected sub and email claims, got %s", body)
+	}
+	if claims.Groups != nil || claims.Name != "" {
+		t.Errorf("expected claims for unrequested scopes to be filtered, got %s", body)
+	}
+
+	resp, body = userInfo(accessToken(signedClient, "openid", "profile"))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("signed user info: expected status 200 got %s: %s", resp.Status, body)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/jwt" {
+		t.Errorf("expected content type application/jwt got %q", ct)
+	}
+	jws, err := jose.ParseSigned(string(body))
+	if err != nil {
+		t.Fatalf("failed to parse signed user info: %v", err)
+	}
+	payload, err := jws.Verify(&testKey.PublicKey)
+	if err != nil {
+		t.Fatalf("failed to verify signed user info: %v", err)
+	}
+	claims = userInfoClaims{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		t.Fatalf("failed to decode signed user info: %v", err)
+	}
+	if claims.Issuer != httpServer.URL || !claims.Audience.contains(signedClient.ID) || claims.Name == "" {
+		t.Errorf("unexpected signed user info claims %s", payload)
+	}
+
+	if resp, body := userInfo(accessToken(mismatchedClient, "openid")); resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("user info signed with another alg: expected status 500 got %s: %s", resp.Status, body)
+	}
+
+	for name, token := range map[string]string{"missing": "", "unknown": storage.NewNonce()} {
+		if resp, _ := userInfo(token); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s token: expected status 401 got %s", name, resp.Status)
+		} else if resp.Header.Get("WWW-Authenticate") == "" {
+			t.Errorf("%s token: expected WWW-Authenticate header", name)
+		}
+	}
+}
+
+func TestJWTAccessTokens(t *testing.T) {
+	httpServer, s := newTestServer(func(c *Config) {
+		c.Connectors = append(c.Connectors, Connector{
+			ID:          "password",
+			DisplayName: "Password",
+			Connector:   mock.NewPasswordConnector("kilgore", "trout"),
+		})
+		c.PasswordConnector = "password"
+	})
+	defer httpServer.Close()
+
+	api := "https://api.example.com"
+	client := storage.Client{
+		ID:                 "testclient",
+		Secret:             "testclientsecret",
+		AllowPasswordGrant: true,
+		JWTAccessTokens:    true,
+		AllowedResources:   []string{api},
+	}
+	if err := s.storage.CreateClient(client); err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+
+	requestToken := func(resource string) (int, accessTokenResponse) {
+		v := url.Values{
+			"grant_type": {grantTypePassword},
+			"username":   {"kilgore"},
+			"password":   {"trout"},
+			"scope":      {"openid email"},
+		}
+		if resource != "" {
+			v.Set("resource", resource)
+		}
+		req, err := http.NewRequest("POST", httpServer.URL+"/token", strings.NewReader(v.Encode()))
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(client.ID, client.Secret)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("post failed: %v", err)
+		}
+		defer resp.Body.Close()
+		var tokenResp accessTokenResponse
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+		}
+		return resp.StatusCode, tokenResp
+	}
+
+	status, tokenResp := requestToken(api)
+	if status != http.StatusOK {
+		t.Fatalf("expected status 200 got %d", status)
+	}
+
+	var header struct {
+		Typ string `json:"typ"`
+	}
+	if err := unverifiedHeader(tokenResp.AccessToken, &header); err != nil {
+		t.Fatalf("failed to decode header: %v", err)
+	}
+	if header.Typ != jwtTypeAccessToken {
+		t.Errorf("expected typ %q got %q", jwtTypeAccessToken, header.Typ)
+	}
+
+	jws, err := jose.ParseSigned(tokenResp.AccessToken)
+	if err != nil {
+		t.Fatalf("failed to parse access token: %v", err)
+	}
+	payload, err := jws.Verify(&testKey.PublicKey)
+	if err != nil {
+		t.Fatalf("failed to verify access token: %v", err)
+	}
+	var claims accessTokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		t.Fatalf("failed to unmarshal claims: %v", err)
+	}
+	if len(claims.Audience) != 1 || claims.Audience[0] != api {
+		t.Errorf("expected audience %q got %q", api, claims.Audience)
+	}
+	if claims.ClientID != client.ID || claims.Scope != "openid email" || claims.Subject == "" || claims.JTI == "" {
+		t.Errorf("unexpected access token claims %s", payload)
+	}
+
+	// JWT access tokens are still recorded by the server.
+	resp, err := s.introspect(tokenResp.AccessToken)
+	if err != nil {
+		t.Fatalf("failed to introspect token: %v", err)
+	}
+	if !resp.Active || !resp.Audience.contains(api) {
+		t.Errorf("expected active token for %q, got %#v", api, resp)
+	}
+
+	if status, _ := requestToken("https://other.example.com"); status != http.StatusBadRequest {
+		t.Errorf("request for unregistered resource: expected status 400 got %d", status)
+	}
+}
+
+func TestClientRegistration(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, s := newTestServer(func(c *Config) {
+		c.RegistrationToken = "initialaccesstoken"
+	})
+	defer httpServer.Close()
+
+	do := func(method, path, token string, body interface{}, v interface{}) int {
+		var r io.Reader
+		if body != nil {
+			data, err := json.Marshal(body)
+			if err != nil {
+				t.Fatalf("failed to marshal body: %v", err)
+			}
+			r = bytes.NewReader(data)
+		}
+		req, err := http.NewRequest(method, httpServer.URL+path, r)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s failed: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		if v != nil && resp.StatusCode/100 == 2 {
+			if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+		}
+		return resp.StatusCode
+	}
+
+	metadata := map[string]interface{}{
+		"redirect_uris": []string{"https://app.example.com/callback"},
+		"client_name":   "Example App",
+	}
+
+	if status := do("POST", "/register", "", metadata, nil); status != http.StatusUnauthorized {
+		t.Errorf("register without initial access token: expected status 401 got %d", status)
+	}
+	badMetadata := map[string]interface{}{
+		"redirect_uris": []string{"http://app.example.com/callback"},
+	}
+	if status := do("POST", "/register", "initialaccesstoken", badMetadata, nil); status != http.StatusBadRequest {
+		t.Errorf("register with http redirect URI: expected status 400 got %d", status)
+	}
+	badAlgMetadata := map[string]interface{}{
+		"redirect_uris":                []string{"https://app.example.com/callback"},
+		"userinfo_signed_response_alg": string(jose.ES256),
+	}
+	if status := do("POST", "/register", "initialaccesstoken", badAlgMetadata, nil); status != http.StatusBadRequest {
+		t.Errorf("register with unsupported userinfo_signed_response_alg: expected status 400 got %d", status)
+	}
+
+	var reg clientRegistrationResponse
+	if status := do("POST", "/register", "initialaccesstoken", metadata, &reg); status != http.StatusCreated {
+		t.Fatalf("register: expected status 201 got %d", status)
+	}
+	if reg.ClientID == "" || reg.ClientSecret == "" || reg.RegistrationAccessToken == "" {
+		t.Fatalf("registration response missing credentials: %+v", reg)
+	}
+	if reg.TokenEndpointAuthMethod != authMethodClientSecretBasic {
+		t.Errorf("expected default auth method %q got %q", authMethodClientSecretBasic, reg.TokenEndpointAuthMethod)
+	}
+	client, err := s.storage.GetClient(reg.ClientID)
+	if err != nil {
+		t.Fatalf("registered client not stored: %v", err)
+	}
+	if client.Name != "Example App" {
+		t.Errorf("expected client name %q got %q", "Example App", client.Name)
+	}
+
+	// The registered client can use its credentials.
+	oauth2Config := &oauth2.Config{
+		ClientID:     reg.ClientID,
+		ClientSecret: reg.ClientSecret,
+		Endpoint:     oauth2.Endpoint{TokenURL: httpServer.URL + "/token"},
+	}
+	if _, err := oauth2Config.Exchange(ctx, "unknowncode"); err == nil || strings.Contains(err.Error(), errInvalidClient) {
+		t.Errorf("expected registered client to authenticate, got %v", err)
+	}
+
+	configPath := "/register/" + reg.ClientID
+	if status := do("GET", configPath, "initialaccesstoken", nil, nil); status != http.StatusUnauthorized {
+		t.Errorf("read with initial access token: expected status 401 got %d", status)
+	}
+	var read clientRegistrationResponse
+	if status := do("GET", configPath, reg.RegistrationAccessToken, nil, &read); status != http.StatusOK {
+		t.Fatalf("read: expected status 200 got %d", status)
+	}
+	if read.ClientSecret != reg.ClientSecret {
+		t.Errorf("read returned different client secret")
+	}
+
+	update := map[string]interface{}{
+		"client_id":     reg.ClientID,
+		"redirect_uris": []string{"https://app.example.com/callback2"},
+		"client_name":   "Renamed App",
+	}
+	var updated clientRegistrationResponse
+	if status := do("PUT", configPath, reg.RegistrationAccessToken, update, &updated); status != http.StatusOK {
+		t.Fatalf("update: expected status 200 got %d", status)
+	}
+	if updated.ClientName != "Renamed App" || updated.ClientSecret != reg.ClientSecret {
+		t.Errorf("unexpected update response: %+v", updated)
+	}
+	update["client_id"] = "otherclient"
+	if status := do("PUT", configPath, reg.RegistrationAccessToken, update, nil); status != http.StatusBadRequest {
+		t.Errorf("update with mismatched client_id: expected status 400 got %d", status)
+	}
+
+	if status := do("DELETE", configPath, reg.RegistrationAccessToken, nil, nil); status != http.StatusNoContent {
+		t.Fatalf("delete: expected status 204 got %d", status)
+	}
+	if _, err := s.storage.GetClient(reg.ClientID); err != storage.ErrNotFound {
+		t.Errorf("expected client to be deleted, got %v", err)
+	}
+	if status := do("GET", configPath, reg.RegistrationAccessToken, nil, nil); status != http.StatusUnauthorized {
+		t.Errorf("read deleted client: expected status 401 got %d", status)
+	}
+}
+
+func TestLogout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, s := newTestServer(func(c *Config) {
+		c.Connectors = append(c.Connectors, Connector{
+			ID:          "password",
+			DisplayName: "Password",
+			Connector:   mock.NewPasswordConnector("kilgore", "trout"),
+		})
+		c.PasswordConnector = "password"
+	})
+	defer httpServer.Close()
+
+	client := storage.Client{
+		ID:                     "testclient",
+		Secret:                 "testclientsecret",
+		AllowPasswordGrant:     true,
+		JWTAccessTokens:        true,
+		PostLogoutRedirectURIs: []string{"https://app.example.com/logged-out"},
+	}
+	if err := s.storage.CreateClient(client); err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+
+	oauth2Config := &oauth2.Config{
+		ClientID:     client.ID,
+		ClientSecret: client.Secret,
+		Endpoint:     oauth2.Endpoint{TokenURL: httpServer.URL + "/token"},
+		Scopes:       []string{"openid"},
+	}
+	token, err := oauth2Config.PasswordCredentialsToken(ctx, "kilgore", "trout")
+	if err != nil {
+		t.Fatalf("failed to get token: %v", err)
+	}
+	idToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		t.Fatalf("no id_token in response")
+	}
+
+	httpClient := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	logout := func(post bool, v url.Values) *http.Response {
+		var (
+			resp *http.Response
+			err  error
+		)
+		if post {
+			resp, err = httpClient.PostForm(httpServer.URL+"/logout", v)
+		} else {
+			resp, err = httpClient.Get(httpServer.URL + "/logout?" + v.Encode())
+		}
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	tests := []struct {
+		name     string
+		post     bool
+		params   url.Values
+		status   int
+		location string
+	}{
+		{
+			name:   "no parameters",
+			params: url.Values{},
+			status: http.StatusOK,
+		},
+		{
+			name: "hint without a session requires confirmation",
+			params: url.Values{
+				"id_token_hint":            {idToken},
+				"post_logout_redirect_uri": {"https://app.example.com/logged-out"},
+				"state":                    {"foo"},
+			},
+			status: http.StatusOK,
+		},
+		{
+			name: "registered redirect",
+			post: true,
+			params: url.Values{
+				"id_token_hint":            {idToken},
+				"post_logout_redirect_uri": {"https://app.example.com/logged-out"},
+				"state":                    {"foo"},
+			},
+			status:   http.StatusSeeOther,
+			location: "https://app.example.com/logged-out?state=foo",
+		},
+		{
+			name: "client_id instead of hint requires confirmation",
+			params: url.Values{
+				"client_id":                {client.ID},
+				"post_logout_redirect_uri": {"https://app.example.com/logged-out"},
+			},
+			status: http.StatusOK,
+		},
+		{
+			name: "confirmed client_id instead of hint",
+			post: true,
+			params: url.Values{
+				"client_id":                {client.ID},
+				"post_logout_redirect_uri": {"https://app.example.com/logged-out"},
+			},
+			status:   http.StatusSeeOther,
+			location: "https://app.example.com/logged-out",
+		},
+		{
+			name: "unregistered redirect",
+			params: url.Values{
+				"id_token_hint":            {idToken},
+				"post_logout_redirect_uri": {"https://evil.example.com"},
+			},
+			status: http.StatusBadRequest,
+		},
+		{
+			name: "redirect without client",
+			params: url.Values{
+				"post_logout_redirect_uri": {"https://app.example.com/logged-out"},
+			},
+			status: http.StatusBadRequest,
+		},
+		{
+			name: "mismatched client_id",
+			params: url.Values{
+				"id_token_hint": {idToken},
+				"client_id":     {"otherclient"},
+			},
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "invalid hint",
+			params: url.Values{"id_token_hint": {idToken + "x"}},
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "access token as hint",
+			params: url.Values{"id_token_hint": {token.AccessToken}},
+			status: http.StatusBadRequest,
+		},
+	}
+	for _, tc := range tests {
+		resp := logout(tc.post, tc.params)
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s: expected status %d got %d", tc.name, tc.status, resp.StatusCode)
+			continue
+		}
+		if location := resp.Header.Get("Location"); location != tc.location {
+			t.Errorf("%s: expected location %q got %q", tc.name, tc.location, location)
+		}
+	}
+}
+
+func TestBackchannelLogout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, s := newTestServer(nil)
+	defer httpServer.Close()
+	s.backchannelRetryDelay = time.Millisecond
+
+	type delivery struct {
+		client string
+		token  string
+	}
+	deliveries := make(chan delivery, 10)
+	var mu sync.Mutex
+	failures := make(map[string]int)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := strings.TrimPrefix(r.URL.Path, "/")
+		// Fail the first attempt for each client to exercise retries.
+		mu.Lock()
+		failures[client]++
+		attempt := failures[client]
+		mu.Unlock()
+		if attempt == 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		deliveries <- delivery{client, r.PostFormValue("logout_token")}
+	}))
+	defer receiver.Close()
+
+	redirectURL := "https://app.example.com/callback"
+	clients := []storage.Client{
+		{
+			ID:                   "testclient",
+			Secret:               "testclientsecret",
+			RedirectURIs:         []string{redirectURL},
+			BackchannelLogoutURI: receiver.URL + "/testclient",
+		},
+		{
+			ID:                   "otherclient",
+			Secret:               "otherclientsecret",
+			RedirectURIs:         []string{redirectURL},
+			BackchannelLogoutURI: receiver.URL + "/otherclient",
+		},
+		{
+			// Never logged into, so must not be notified.
+			ID:                   "unusedclient",
+			Secret:               "unusedclientsecret",
+			BackchannelLogoutURI: receiver.URL + "/unusedclient",
+		},
+		{
+			// Hold refresh tokens for the same user ID, but from another connector
+			// or session, so must not be notified.
+			ID:                   "otherconnectorclient",
+			BackchannelLogoutURI: receiver.URL + "/otherconnectorclient",
+		},
+		{
+			ID:                   "othersessionclient",
+			BackchannelLogoutURI: receiver.URL + "/othersessionclient",
+		},
+	}
+	for _, client := range clients {
+		if err := s.storage.CreateClient(client); err != nil {
+			t.Fatalf("failed to create client: %v", err)
+		}
+	}
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	browser := &http.Client{
+		Jar: jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if strings.HasPrefix(req.URL.String(), redirectURL) {
+				return http.ErrUseLastResponse
+			}
+			return nil
+		},
+	}
+	// Log into both clients in the same browser session.
+	idTokens := make(map[string]string)
+	for _, client := range clients[:2] {
+		v := url.Values{
+			"client_id":     {client.ID},
+			"redirect_uri":  {redirectURL},
+			"response_type": {"code"},
+			"scope":         {"openid offline_access"},
+			"state":         {"foo"},
+		}
+		resp, err := browser.Get(httpServer.URL + "/auth?" + v.Encode())
+		if err != nil {
+			t.Fatalf("get failed: %v", err)
+		}
+		resp.Body.Close()
+		u, err := resp.Location()
+		if err != nil {
+			t.Fatalf("expected redirect with code, got status %d", resp.StatusCode)
+		}
+		oauth2Config := &oauth2.Config{
+			ClientID:     client.ID,
+			ClientSecret: client.Secret,
+			Endpoint:     oauth2.Endpoint{TokenURL: httpServer.URL + "/token"},
+			RedirectURL:  redirectURL,
+		}
+		token, err := oauth2Config.Exchange(ctx, u.Query().Get("code"))
+		if err != nil {
+			t.Fatalf("failed to exchange code: %v", err)
+		}
+		idTokens[client.ID], _ = token.Extra("id_token").(string)
+	}
+
+	var idClaims idTokenClaims
+	if err := unverifiedClaims(idTokens["testclient"], &idClaims); err != nil {
+		t.Fatalf("failed to decode ID token: %v", err)
+	}
+	refreshTokens := []storage.Refresh{
+		{
+			RefreshToken: storage.NewNonce(),
+			ClientID:     "otherconnectorclient",
+			ConnectorID:  "ldap",
+			Identity:     storage.Identity{UserID: idClaims.Subject, SessionID: idClaims.SessionID},
+		},
+		{
+			RefreshToken: storage.NewNonce(),
+			ClientID:     "othersessionclient",
+			ConnectorID:  "mock",
+			Identity:     storage.Identity{UserID: idClaims.Subject, SessionID: "othersession"},
+		},
+	}
+	for _, refresh := range refreshTokens {
+		if err := s.storage.CreateRefresh(refresh); err != nil {
+			t.Fatalf("failed to create refresh token: %v", err)
+		}
+	}
+
+	// An unexpired ID Token for the browser's session logs out without
+	// confirmation.
+	resp, err := browser.Get(httpServer.URL + "/logout?" + url.Values{"id_token_hint": {idTokens["testclient"]}}.Encode())
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("failed to read body: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "You have been logged out.") {
+		t.Fatalf("logout: expected to be logged out, got status %d: %s", resp.StatusCode, body)
+	}
+
+	notified := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		var d delivery
+		select {
+		case d = <-deliveries:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for logout tokens, got %v", notified)
+		}
+		notified[d.client] = true
+
+		var header struct {
+			Type string `json:"typ"`
+		}
+		if err := unverifiedHeader(d.token, &header); err != nil {
+			t.Fatalf("failed to decode logout token header: %v", err)
+		}
+		if header.Type != jwtTypeLogoutToken {
+			t.Errorf("expected typ %q got %q", jwtTypeLogoutToken, header.Type)
+		}
+		jws, err := jose.ParseSigned(d.token)
+		if err != nil {
+			t.Fatalf("failed to parse logout token: %v", err)
+		}
+		payload, err := s.verifySignedByServer(jws)
+		if err != nil {
+			t.Fatalf("failed to verify logout token: %v", err)
+		}
+		var claims logoutTokenClaims
+		if err := json.Unmarshal(payload, &claims); err != nil {
+			t.Fatalf("failed to decode logout token: %v", err)
+		}
+		if !claims.Audience.contains(d.client) {
+			t.Errorf("logout token for %q has audience %v", d.client, claims.Audience)
+		}
+		if claims.Subject == "" || claims.JTI == "" {
+			t.Errorf("logout token missing sub or jti: %+v", claims)
+		}
+		if _, ok := claims.Events[backchannelLogoutEvent]; !ok {
+			t.Errorf("logout token missing backchannel logout event: %+v", claims)
+		}
+	}
+	if !notified["testclient"] || !notified["otherclient"] {
+		t.Errorf("expected both logged in clients to be notified, got %v", notified)
+	}
+	select {
+	case d := <-deliveries:
+		t.Errorf("unexpected logout token delivered to %q", d.client)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The outcome of each delivery is recorded on the client.
+	for _, id := range []string{"testclient", "otherclient"} {
+		status := waitForLogoutStatus(t, s, id)
+		if status.Attempts != 2 || status.Error != "" {
+			t.Errorf("%s: expected delivery on the second attempt, got %+v", id, status)
+		}
+	}
+	for _, id := range []string{"unusedclient", "otherconnectorclient", "othersessionclient"} {
+		if client, err := s.storage.GetClient(id); err != nil {
+			t.Fatalf("failed to get client: %v", err)
+		} else if client.BackchannelLogoutStatus != nil {
+			t.Errorf("%s: expected no delivery recorded, got %+v", id, client.BackchannelLogoutStatus)
+		}
+	}
+}
+
+// waitForLogoutStatus waits for the server to record a back-channel logout
+// delivery to a client.
+func waitForLogoutStatus(t *testing.T, s *Server, clientID string) storage.BackchannelLogoutStatus {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		client, err := s.storage.GetClient(clientID)
+		if err != nil {
+			t.Fatalf("failed to get client: %v", err)
+		}
+		if client.BackchannelLogoutStatus != nil {
+			return *client.BackchannelLogoutStatus
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for logout delivery to %q", clientID)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBackchannelLogoutSession(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, s := newTestServer(nil)
+	defer httpServer.Close()
+
+	logoutTokens := make(chan string, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logoutTokens <- r.PostFormValue("logout_token")
+	}))
+	defer receiver.Close()
+
+	redirectURL := "https://app.example.com/callback"
+	client := storage.Client{
+		ID:                               "testclient",
+		Secret:                           "testclientsecret",
+		RedirectURIs:                     []string{redirectURL},
+		BackchannelLogoutURI:             receiver.URL,
+		BackchannelLogoutSessionRequired: true,
+	}
+	if err := s.storage.CreateClient(client); err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	browser := &http.Client{
+		Jar: jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if strings.HasPrefix(req.URL.String(), redirectURL) {
+				return http.ErrUseLastResponse
+			}
+			return nil
+		},
+	}
+	v := url.Values{
+		"client_id":     {client.ID},
+		"redirect_uri":  {redirectURL},
+		"response_type": {"code"},
+		"scope":         {"openid"},
+		"state":         {"foo"},
+	}
+	resp, err := browser.Get(httpServer.URL + "/auth?" + v.Encode())
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	resp.Body.Close()
+	u, err := resp.Location()
+	if err != nil {
+		t.Fatalf("expected redirect with code, got status %d", resp.StatusCode)
+	}
+	oauth2Config := &oauth2.Config{
+		ClientID:     client.ID,
+		ClientSecret: client.Secret,
+		Endpoint:     oauth2.Endpoint{TokenURL: httpServer.URL + "/token"},
+		RedirectURL:  redirectURL,
+	}
+	token, err := oauth2Config.Exchange(ctx, u.Query().Get("code"))
+	if err != nil {
+		t.Fatalf("failed to exchange code: %v", err)
+	}
+	idToken, _ := token.Extra("id_token").(string)
+	var idClaims idTokenClaims
+	if err := unverifiedClaims(idToken, &idClaims); err != nil {
+		t.Fatalf("failed to decode ID token: %v", err)
+	}
+	if idClaims.SessionID == "" {
+		t.Fatalf("expected ID token issued in a session to have a sid claim")
+	}
+
+	// The ID token's sid identifies the session ended by the logout.
+	resp, err = browser.PostForm(httpServer.URL+"/logout", url.Values{})
+	if err != nil {
+		t.Fatalf("post failed: %v", err)
+	}
+	resp.Body.Close()
+	var logoutToken string
+	select {
+	case logoutToken = <-logoutTokens:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for logout token")
+	}
+	var claims logoutTokenClaims
+	if err := unverifiedClaims(logoutToken, &claims); err != nil {
+		t.Fatalf("failed to decode logout token: %v", err)
+	}
+	if claims.SessionID != idClaims.SessionID || claims.Subject != idClaims.Subject {
+		t.Errorf("expected logout token for sid %q and sub %q, got %+v", idClaims.SessionID, idClaims.Subject, claims)
+	}
+	if status := waitForLogoutStatus(t, s, client.ID); status.Attempts != 1 || status.Error != "" {
+		t.Errorf("expected delivery on the first attempt, got %+v", status)
+	}
+}
+
+func TestLogoutHintRequiresSession(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, s := newTestServer(func(c *Config) {
+		c.IDTokensValidFor = time.Minute
+	})
+	defer httpServer.Close()
+
+	logoutTokens := make(chan string, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logoutTokens <- r.PostFormValue("logout_token")
+	}))
+	defer receiver.Close()
+
+	redirectURL := "https://app.example.com/callback"
+	client := storage.Client{
+		ID:                   "testclient",
+		Secret:               "testclientsecret",
+		RedirectURIs:         []string{redirectURL},
+		BackchannelLogoutURI: receiver.URL,
+	}
+	if err := s.storage.CreateClient(client); err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+
+	// login starts a session in a new browser and returns the browser and the
+	// ID Token issued in the session.
+	login := func() (*http.Client, string) {
+		jar, err := cookiejar.New(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		browser := &http.Client{
+			Jar: jar,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if strings.HasPrefix(req.URL.String(), redirectURL) {
+					return http.ErrUseLastResponse
+				}
+				return nil
+			},
+		}
+		v := url.Values{
+			"client_id":     {client.ID},
+			"redirect_uri":  {redirectURL},
+			"response_type": {"code"},
+			"scope":         {"openid"},
+			"state":         {"foo"},
+		}
+		resp, err := browser.Get(httpServer.URL + "/auth?" + v.Encode())
+		if err != nil {
+			t.Fatalf("get failed: %v", err)
+		}
+		resp.Body.Close()
+		u, err := resp.Location()
+		if err != nil {
+			t.Fatalf("expected redirect with code, got status %d", resp.StatusCode)
+		}
+		oauth2Config := &oauth2.Config{
+			ClientID:     client.ID,
+			ClientSecret: client.Secret,
+			Endpoint:     oauth2.Endpoint{TokenURL: httpServer.URL + "/token"},
+			RedirectURL:  redirectURL,
+		}
+		token, err := oauth2Config.Exchange(ctx, u.Query().Get("code"))
+		if err != nil {
+			t.Fatalf("failed to exchange code: %v", err)
+		}
+		idToken, _ := token.Extra("id_token").(string)
+		return browser, idToken
+	}
+	logout := func(browser *http.Client, idToken string) string {
+		resp, err := browser.Get(httpServer.URL + "/logout?" + url.Values{"id_token_hint": {idToken}}.Encode())
+		if err != nil {
+			t.Fatalf("get failed: %v", err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("failed to read body: %v", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("logout: expected status 200 got %d: %s", resp.StatusCode, body)
+		}
+		return string(body)
+	}
+
+	browser, idToken := login()
+	_, otherIDToken := login()
+
+	// A hint for another session of the same end user doesn't end this one.
+	if body := logout(browser, otherIDToken); !strings.Contains(body, "Do you want to log out?") {
+		t.Errorf("hint for another session: expected confirmation, got %s", body)
+	}
+
+	// Neither does an expired hint for this session.
+	now := time.Now().Add(2 * time.Minute)
+	s.now = func() time.Time { return now }
+	if body := logout(browser, idToken); !strings.Contains(body, "Do you want to log out?") {
+		t.Errorf("expired hint: expected confirmation, got %s", body)
+	}
+
+	select {
+	case <-logoutTokens:
+		t.Errorf("expected no logout token before the end user confirmed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Confirming the logout ends the session.
+	resp, err := browser.PostForm(httpServer.URL+"/logout", url.Values{"id_token_hint": {idToken}})
+	if err != nil {
+		t.Fatalf("post failed: %v", err)
+	}
+	resp.Body.Close()
+	select {
+	case <-logoutTokens:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for logout token")
+	}
+}
+
+// countingConnector counts the logins which go through a callback connector.
+type countingConnector struct {
+	connector.CallbackConnector
+
+	mu     sync.Mutex
+	logins int
+}
+
+func (c *countingConnector) Close() error { return nil }
+
+func (c *countingConnector) LoginURL(callbackURL, state string) (string, error) {
+	c.mu.Lock()
+	c.logins++
+	c.mu.Unlock()
+	return c.CallbackConnector.LoginURL(callbackURL, state)
+}
+
+func (c *countingConnector) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.logins
+}
+
+func TestSessions(t *testing.T) {
+	now := time.Now()
+	var nowMu sync.Mutex
+	advance := func(d time.Duration) {
+		nowMu.Lock()
+		now = now.Add(d)
+		nowMu.Unlock()
+	}
+
+	conn := &countingConnector{CallbackConnector: mock.New().(connector.CallbackConnector)}
+	httpServer, s := newTestServer(func(c *Config) {
+		c.Connectors = []Connector{{ID: "mock", DisplayName: "Mock", Connector: conn}}
+		c.SessionIdleTimeout = time.Hour
+		c.SessionAbsoluteTimeout = 3 * time.Hour
+		c.Now = func() time.Time {
+			nowMu.Lock()
+			defer nowMu.Unlock()
+			return now
+		}
+	})
+	defer httpServer.Close()
+
+	redirectURL := "https://app.example.com/callback"
+	for _, id := range []string{"client1", "client2"} {
+		client := storage.Client{ID: id, Secret: id + "secret", RedirectURIs: []string{redirectURL}}
+		if err := s.storage.CreateClient(client); err != nil {
+			t.Fatalf("failed to create client: %v", err)
+		}
+	}
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	browser := &http.Client{
+		Jar: jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if strings.HasPrefix(req.URL.String(), redirectURL) {
+				return http.ErrUseLastResponse
+			}
+			return nil
+		},
+	}
+	authorize := func(clientID string) {
+		v := url.Values{
+			"client_id":     {clientID},
+			"redirect_uri":  {redirectURL},
+			"response_type": {"code"},
+			"scope":         {"openid"},
+			"state":         {"foo"},
+		}
+		resp, err := browser.Get(httpServer.URL + "/auth?" + v.Encode())
+		if err != nil {
+			t.Fatalf("get failed: %v", err)
+		}
+		resp.Body.Close()
+		u, err := resp.Location()
+		if err != nil || u.Query().Get("code") == "" {
+			t.Fatalf("%s: expected redirect with code, got status %d", clientID, resp.StatusCode)
+		}
+	}
+	sessionCookie := func() string {
+		u, _ := url.Parse(httpServer.URL)
+		for _, c := range jar.Cookies(u) {
+			if c.Name == sessionCookieName {
+				return c.Value
+			}
+		}
+		return ""
+	}
+
+	authorize("client1")
+	if n := conn.count(); n != 1 {
+		t.Fatalf("expected 1 connector login got %d", n)
+	}
+	sessionID := sessionCookie()
+	if sessionID == "" {
+		t.Fatalf("no session cookie set")
+	}
+
+	// A second client reuses the session.
+	advance(30 * time.Minute)
+	authorize("client2")
+	if n := conn.count(); n != 1 {
+		t.Errorf("expected session to be reused, got %d connector logins", n)
+	}
+	session, err := s.storage.GetSession(sessionID)
+	if err != nil {
+		t.Fatalf("failed to get session: %v", err)
+	}
+	if !reflect.DeepEqual(session.Clients, []string{"client1", "client2"}) {
+		t.Errorf("expected session clients [client1 client2] got %v", session.Clients)
+	}
+
+	// Using the session extends its idle timeout.
+	advance(45 * time.Minute)
+	authorize("client1")
+	if n := conn.count(); n != 1 {
+		t.Errorf("expected session to be reused within idle timeout, got %d connector logins", n)
+	}
+
+	// But not its absolute timeout.
+	for i := 0; i < 4; i++ {
+		advance(45 * time.Minute)
+		authorize("client1")
+	}
+	if n := conn.count(); n != 2 {
+		t.Errorf("expected login after absolute timeout, got %d connector logins", n)
+	}
+
+	// Idle sessions expire.
+	advance(2 * time.Hour)
+	authorize("client1")
+	if n := conn.count(); n != 3 {
+		t.Errorf("expected login after idle timeout, got %d connector logins", n)
+	}
+
+	// Following a link to the logout page only asks the end user to confirm.
+	sessionID = sessionCookie()
+	resp, err := browser.Get(httpServer.URL + "/logout")
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("failed to read body: %v", err)
+	}
+	if !strings.Contains(string(body), `<form method="post"`) {
+		t.Errorf("expected logout confirmation form, got %s", body)
+	}
+	if _, err := s.storage.GetSession(sessionID); err != nil {
+		t.Errorf("expected session to be kept until logout is confirmed, got %v", err)
+	}
+
+	// Confirming the logout ends the session.
+	resp, err = browser.PostForm(httpServer.URL+"/logout", url.Values{})
+	if err != nil {
+		t.Fatalf("post failed: %v", err)
+	}
+	resp.Body.Close()
+	if _, err := s.storage.GetSession(sessionID); err != storage.ErrNotFound {
+		t.Errorf("expected session to be deleted by logout, got %v", err)
+	}
+	if sessionCookie() != "" {
+		t.Errorf("expected session cookie to be cleared by logout")
+	}
+	authorize("client1")
+	if n := conn.count(); n != 4 {
+		t.Errorf("expected login after logout, got %d connector logins", n)
+	}
+}
+
+func TestConsent(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, s := newTestServer(nil)
+	defer httpServer.Close()
+	s.skipApproval = false
+
+	redirectURL := "https://app.example.com/callback"
+	client := storage.Client{
+		ID:           "testclient",
+		Secret:       "testclientsecret",
+		RedirectURIs: []string{redirectURL},
+		// Anyone can register a client, so its name must be escaped.
+		Name: `<script>alert(1)</script>`,
+	}
+	if err := s.storage.CreateClient(client); err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	browser := &http.Client{
+		Jar: jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if strings.HasPrefix(req.URL.String(), redirectURL) {
+				return http.ErrUseLastResponse
+			}
+			return nil
+		},
+	}
+
+	// authorize returns the auth request ID if the end user is prompted for
+	// approval, or an empty string if the server redirects straight back to the
+	// client.
+	authorize := func(scopes string, extra url.Values) string {
+		v := url.Values{
+			"client_id":     {client.ID},
+			"redirect_uri":  {redirectURL},
+			"response_type": {"code"},
+			"scope":         {scopes},
+			"state":         {"foo"},
+		}
+		for k, vals := range extra {
+			v[k] = vals
+		}
+		resp, err := browser.Get(httpServer.URL + "/auth?" + v.Encode())
+		if err != nil {
+			t.Fatalf("get failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK && resp.Request.URL.Path == "/approval" {
+			return resp.Request.URL.Query().Get("state")
+		}
+		if u, err := resp.Location(); err != nil || u.Query().Get("code") == "" {
+			t.Fatalf("expected approval prompt or redirect with code, got status %d", resp.StatusCode)
+		}
+		return ""
+	}
+	approve := func(state string) string {
+		resp, err := browser.PostForm(httpServer.URL+"/approval", url.Values{"state": {state}, "approval": {"approve"}})
+		if err != nil {
+			t.Fatalf("post failed: %v", err)
+		}
+		resp.Body.Close()
+		u, err := resp.Location()
+		if err != nil {
+			t.Fatalf("no redirect after approval: %v", err)
+		}
+		return u.Query().Get("code")
+	}
+
+	state := authorize("openid offline_access", nil)
+	if state == "" {
+		t.Fatalf("expected approval prompt on first authorization")
+	}
+	code := approve(state)
+	oauth2Config := &oauth2.Config{
+		ClientID:     client.ID,
+		ClientSecret: client.Secret,
+		Endpoint:     oauth2.Endpoint{TokenURL: httpServer.URL + "/token"},
+		RedirectURL:  redirectURL,
+	}
+	token, err := oauth2Config.Exchange(ctx, code)
+	if err != nil {
+		t.Fatalf("failed to exchange code: %v", err)
+	}
+
+	if authorize("openid", nil) != "" {
+		t.Errorf("expected approval to be skipped for previously approved scopes")
+	}
+	for _, extra := range []url.Values{{"prompt": {"consent"}}, {"approval_prompt": {"force"}}} {
+		if authorize("openid", extra) == "" {
+			t.Errorf("expected approval prompt with %v", extra)
+		}
+	}
+	state = authorize("openid email", nil)
+	if state == "" {
+		t.Fatalf("expected approval prompt for additional scopes")
+	}
+	approve(state)
+	if authorize("openid email offline_access", nil) != "" {
+		t.Errorf("expected approval to be skipped once additional scopes are approved")
+	}
+
+	// Withdraw consent.
+	resp, err := browser.Get(httpServer.URL + "/consent")
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(body), "&lt;script&gt;alert(1)&lt;/script&gt;") {
+		t.Errorf("consent page doesn't list client with an escaped name:\n%s", body)
+	}
+	if strings.Contains(string(body), client.Name) {
+		t.Errorf("consent page renders client name unescaped:\n%s", body)
+	}
+	match := regexp.MustCompile(`name="csrf_token" value="([^"]+)"`).FindSubmatch(body)
+	if match == nil {
+		t.Fatalf("consent page has no CSRF token:\n%s", body)
+	}
+
+	// Forms without the session's token are rejected.
+	for _, token := range []string{"", "invalid"} {
+		resp, err = browser.PostForm(httpServer.URL+"/consent", url.Values{"client_id": {client.ID}, "csrf_token": {token}})
+		if err != nil {
+			t.Fatalf("post failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("withdraw consent with token %q: expected status 403 got %d", token, resp.StatusCode)
+		}
+	}
+	if _, err := s.storage.GetConsent("mock", "0-385-28089-0", client.ID); err != nil {
+		t.Errorf("expected consent to be kept after forged request, got %v", err)
+	}
+
+	resp, err = browser.PostForm(httpServer.URL+"/consent", url.Values{"client_id": {client.ID}, "csrf_token": {string(match[1])}})
+	if err != nil {
+		t.Fatalf("post failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("withdraw consent: expected status 200 got %d", resp.StatusCode)
+	}
+	if _, err := s.storage.GetRefresh(token.RefreshToken); err != storage.ErrNotFound {
+		t.Errorf("expected refresh token to be revoked with consent, got %v", err)
+	}
+	if authorize("openid", nil) == "" {
+		t.Errorf("expected approval prompt after withdrawing consent")
+	}
+
+	// The consent page requires a session.
+	resp, err = http.Get(httpServer.URL + "/consent")
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("consent page without session: expected status 401 got %d", resp.StatusCode)
+	}
+}
+
+func TestAuthorizationPrompts(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	now := time.Now().Truncate(time.Second)
+	var nowMu sync.Mutex
+	advance := func(d time.Duration) {
+		nowMu.Lock()
+		now = now.Add(d)
+		nowMu.Unlock()
+	}
+	conn := &countingConnector{CallbackConnector: mock.New().(connector.CallbackConnector)}
+	httpServer, s := newTestServer(func(c *Config) {
+		c.Connectors = []Connector{{ID: "mock", DisplayName: "Mock", Connector: conn}}
+		c.Now = func() time.Time {
+			nowMu.Lock()
+			defer nowMu.Unlock()
+			return now
+		}
+	})
+	defer httpServer.Close()
+
+	redirectURL := "https://app.example.com/callback"
+	client := storage.Client{ID: "testclient", Secret: "testclientsecret", RedirectURIs: []string{redirectURL}}
+	if err := s.storage.CreateClient(client); err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	oauth2Config := &oauth2.Config{
+		ClientID:     client.ID,
+		ClientSecret: client.Secret,
+		Endpoint:     oauth2.Endpoint{TokenURL: httpServer.URL + "/token"},
+		RedirectURL:  redirectURL,
+	}
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	browser := &http.Client{
+		Jar: jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if strings.HasPrefix(req.URL.String(), redirectURL) {
+				return http.ErrUseLastResponse
+			}
+			return nil
+		},
+	}
+	// authorize returns the query of the redirect back to the client.
+	authorize := func(extra url.Values) url.Values {
+		v := url.Values{
+			"client_id":     {client.ID},
+			"redirect_uri":  {redirectURL},
+			"response_type": {"code"},
+			"scope":         {"openid"},
+			"state":         {"foo"},
+		}
+		for k, vals := range extra {
+			v[k] = vals
+		}
+		resp, err := browser.Get(httpServer.URL + "/auth?" + v.Encode())
+		if err != nil {
+			t.Fatalf("get failed: %v", err)
+		}
+		resp.Body.Close()
+		u, err := resp.Location()
+		if err != nil {
+			t.Fatalf("no redirect to client, got status %d", resp.StatusCode)
+		}
+		if state := u.Query().Get("state"); state != "foo" {
+			t.Errorf("expected state %q got %q", "foo", state)
+		}
+		return u.Query()
+	}
+	expectErr := func(q url.Values, errType string) {
+		if got := q.Get("error"); got != errType {
+			t.Errorf("expected error %q got %q", errType, got)
+		}
+	}
+
+	// No session yet.
+	expectErr(authorize(url.Values{"prompt": {"none"}}), errLoginRequired)
+	if n := conn.count(); n != 0 {
+		t.Errorf("prompt=none must not login through a connector, got %d logins", n)
+	}
+
+	q := authorize(url.Values{"acr_values": {"urn:acr:gold urn:acr:silver"}})
+	token, err := oauth2Config.Exchange(ctx, q.Get("code"))
+	if err != nil {
+		t.Fatalf("failed to exchange code: %v", err)
+	}
+	var claims idTokenClaims
+	if err := unverifiedClaims(token.Extra("id_token").(string), &claims); err != nil {
+		t.Fatalf("failed to decode id token: %v", err)
+	}
+	if claims.AuthTime != now.Unix() {
+		t.Errorf("expected auth_time %d got %d", now.Unix(), claims.AuthTime)
+	}
+	if claims.ACR != "urn:acr:gold" {
+		t.Errorf("expected acr %q got %q", "urn:acr:gold", claims.ACR)
+	}
+
+	// The session satisfies prompt=none and a recent enough max_age.
+	advance(2 * time.Minute)
+	if q := authorize(url.Values{"prompt": {"none"}}); q.Get("code") == "" {
+		t.Errorf("expected code for prompt=none with a session, got error %q", q.Get("error"))
+	}
+	authorize(url.Values{"max_age": {"300"}})
+	if n := conn.count(); n != 1 {
+		t.Errorf("expected session to satisfy max_age, got %d logins", n)
+	}
+
+	// But not an older max_age.
+	expectErr(authorize(url.Values{"prompt": {"none"}, "max_age": {"60"}}), errLoginRequired)
+	authorize(url.Values{"max_age": {"60"}})
+	if n := conn.count(); n != 2 {
+		t.Errorf("expected login for max_age, got %d logins", n)
+	}
+
+	for _, prompt := range []string{"login", "select_account"} {
+		before := conn.count()
+		authorize(url.Values{"prompt": {prompt}})
+		if n := conn.count(); n != before+1 {
+			t.Errorf("expected login for prompt=%s", prompt)
+		}
+	}
+
+	// prompt=none fails if the end user must approve the client.
+	s.skipApproval = false
+	expectErr(authorize(url.Values{"prompt": {"none"}}), errConsentRequired)
+}
+
+func TestLoginHint(t *testing.T) {
+	httpServer, s := newTestServer(func(c *Config) {
+		c.Connectors = []Connector{{
+			ID:          "password",
+			DisplayName: "Password",
+			Connector:   mock.NewPasswordConnector("kilgore", "trout"),
+		}}
+	})
+	defer httpServer.Close()
+
+	redirectURL := "https://app.example.com/callback"
+	client := storage.Client{ID: "testclient", Secret: "testclientsecret", RedirectURIs: []string{redirectURL}}
+	if err := s.storage.CreateClient(client); err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+
+	v := url.Values{
+		"client_id":     {client.ID},
+		"redirect_uri":  {redirectURL},
+		"response_type": {"code"},
+		"scope":         {"openid"},
+		"login_hint":    {"kilgore"},
+	}
+	resp, err := http.Get(httpServer.URL + "/auth?" + v.Encode())
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(body), `name="username" value="kilgore"`) {
+		t.Errorf("expected login form to be pre-filled with the login hint:\n%s", body)
+	}
+
+	// Hints are escaped when rendered.
+	hint := url.Values{}
+	for k, vs := range v {
+		hint[k] = vs
+	}
+	hint.Set("login_hint", `"><script>alert(1)</script>`)
+	hintResp, err := http.Get(httpServer.URL + "/auth?" + hint.Encode())
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	hintBody, err := ioutil.ReadAll(hintResp.Body)
+	hintResp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(hintBody), "<script>") {
+		t.Errorf("expected login hint to be escaped:\n%s", hintBody)
+	}
+	if !strings.Contains(string(hintBody), `value="&#34;&gt;&lt;script&gt;`) {
+		t.Errorf("expected escaped login hint in the username field:\n%s", hintBody)
+	}
+
+	// The form's fields are accepted by the connector.
+	loginURL := resp.Request.URL.String()
+	httpClient := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if strings.HasPrefix(req.URL.String(), redirectURL) {
+				return http.ErrUseLastResponse
+			}
+			return nil
+		},
+	}
+	form := url.Values{
+		"username": {"kilgore"},
+		"password": {"trout"},
+		"state":    {resp.Request.URL.Query().Get("state")},
+	}
+	resp, err = httpClient.PostForm(loginURL, form)
+	if err != nil {
+		t.Fatalf("post failed: %v", err)
+	}
+	resp.Body.Close()
+	u, err := resp.Location()
+	if err != nil || u.Query().Get("code") == "" {
+		t.Errorf("expected login to redirect with a code, got status %d", resp.StatusCode)
+	}
+}
+
+func TestRequestObject(t *testing.T) {
+	httpServer, s := newTestServer(nil)
+	defer httpServer.Close()
+
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	// Serve request objects by reference.
+	requestObjects := make(map[string]string)
+	fetched := make(map[string]bool)
+	var requestObjectsMu sync.Mutex
+	requestURIServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestObjectsMu.Lock()
+		fetched[r.URL.Path] = true
+		requestObjectsMu.Unlock()
+		if r.URL.Path == "/large" {
+			w.Write(make([]byte, maxRequestObjectSize+1))
+			return
+		}
+		requestObjectsMu.Lock()
+		token, ok := requestObjects[r.URL.Path]
+		requestObjectsMu.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/oauth-authz-req+jwt")
+		io.WriteString(w, token)
+	}))
+	defer requestURIServer.Close()
+	s.httpClient = requestURIServer.Client()
+
+	redirectURL := "https://app.example.com/callback"
+	client := storage.Client{
+		ID:           "testclient",
+		Secret:       "testclientsecret",
+		RedirectURIs: []string{redirectURL},
+		RequestURIs: []string{
+			requestURIServer.URL + "/valid",
+			requestURIServer.URL + "/both",
+			requestURIServer.URL + "/missing",
+			requestURIServer.URL + "/large",
+			"http://app.example.com/request.jwt",
+		},
+		JWKS: &jose.JSONWebKeySet{
+			Keys: []jose.JSONWebKey{{Key: &clientKey.PublicKey, Algorithm: string(jose.ES256), Use: "sig"}},
+		},
+	}
+	if err := s.storage.CreateClient(client); err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+
+	newRequestObject := func(key *ecdsa.PrivateKey, claims map[string]interface{}) string {
+		signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key}, nil)
+		if err != nil {
+			t.Fatalf("failed to create signer: %v", err)
+		}
+		payload, err := json.Marshal(claims)
+		if err != nil {
+			t.Fatalf("failed to marshal claims: %v", err)
+		}
+		jws, err := signer.Sign(payload)
+		if err != nil {
+			t.Fatalf("failed to sign request object: %v", err)
+		}
+		token, err := jws.CompactSerialize()
+		if err != nil {
+			t.Fatalf("failed to serialize request object: %v", err)
+		}
+		return token
+	}
+	validClaims := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss":           client.ID,
+			"aud":           s.issuerURL.String(),
+			"exp":           time.Now().Add(time.Minute).Unix(),
+			"jti":           storage.NewNonce(),
+			"client_id":     client.ID,
+			"redirect_uri":  redirectURL,
+			"response_type": "code",
+			"scope":         "openid",
+			"state":         "fromobject",
+			"max_age":       3600,
+		}
+	}
+
+	serveRequestObject := func(path, token string) string {
+		requestObjectsMu.Lock()
+		requestObjects[path] = token
+		requestObjectsMu.Unlock()
+		return requestURIServer.URL + path
+	}
+
+	// Parameters of the request object take precedence over query parameters.
+	used := newRequestObject(clientKey, validClaims())
+	u := authRedirect(t, httpServer, redirectURL, url.Values{
+		"client_id":     {client.ID},
+		"response_type": {"code"},
+		"state":         {"fromquery"},
+		"request":       {used},
+	})
+	if u.Query().Get("code") == "" || u.Query().Get("state") != "fromobject" {
+		t.Errorf("expected code with state from request object, got %s", u)
+	}
+
+	u = authRedirect(t, httpServer, redirectURL, url.Values{
+		"client_id":   {client.ID},
+		"request_uri": {serveRequestObject("/valid", newRequestObject(clientKey, validClaims()))},
+	})
+	if u.Query().Get("code") == "" || u.Query().Get("state") != "fromobject" {
+		t.Errorf("expected code for request_uri, got %s", u)
+	}
+
+	tests := []struct {
+		name string
+		v    url.Values
+	}{
+		{
+			name: "wrong key",
+			v:    url.Values{"request": {newRequestObject(otherKey, validClaims())}},
+		},
+		{
+			name: "expired",
+			v: url.Values{"request": {newRequestObject(clientKey, func() map[string]interface{} {
+				c := validClaims()
+				c["exp"] = time.Now().Add(-time.Minute).Unix()
+				return c
+			}())}},
+		},
+		{
+			name: "no expiry",
+			v: url.Values{"request": {newRequestObject(clientKey, func() map[string]interface{} {
+				c := validClaims()
+				delete(c, "exp")
+				return c
+			}())}},
+		},
+		{
+			name: "expiry too far in the future",
+			v: url.Values{"request": {newRequestObject(clientKey, func() map[string]interface{} {
+				c := validClaims()
+				c["exp"] = time.Now().Add(requestObjectMaxLifetime + time.Minute).Unix()
+				return c
+			}())}},
+		},
+		{
+			name: "no jti",
+			v: url.Values{"request": {newRequestObject(clientKey, func() map[string]interface{} {
+				c := validClaims()
+				delete(c, "jti")
+				return c
+			}())}},
+		},
+		{
+			name: "replayed",
+			v:    url.Values{"request": {used}},
+		},
+		{
+			name: "wrong issuer",
+			v: url.Values{"request": {newRequestObject(clientKey, func() map[string]interface{} {
+				c := validClaims()
+				c["iss"] = "otherclient"
+				return c
+			}())}},
+		},
+		{
+			name: "no issuer",
+			v: url.Values{"request": {newRequestObject(clientKey, func() map[string]interface{} {
+				c := validClaims()
+				delete(c, "iss")
+				return c
+			}())}},
+		},
+		{
+			name: "no audience",
+			v: url.Values{"request": {newRequestObject(clientKey, func() map[string]interface{} {
+				c := validClaims()
+				delete(c, "aud")
+				return c
+			}())}},
+		},
+		{
+			name: "wrong audience",
+			v: url.Values{"request": {newRequestObject(clientKey, func() map[string]interface{} {
+				c := validClaims()
+				c["aud"] = "https://other.example.com"
+				return c
+			}())}},
+		},
+		{
+			name: "request and request_uri",
+			v: url.Values{
+				"request":     {newRequestObject(clientKey, validClaims())},
+				"request_uri": {serveRequestObject("/both", newRequestObject(clientKey, validClaims()))},
+			},
+		},
+		{
+			name: "unknown request_uri",
+			v:    url.Values{"request_uri": {requestURIServer.URL + "/missing"}},
+		},
+		{
+			name: "unregistered request_uri",
+			v:    url.Values{"request_uri": {serveRequestObject("/unregistered", newRequestObject(clientKey, validClaims()))}},
+		},
+		{
+			name: "oversized request object",
+			v:    url.Values{"request_uri": {requestURIServer.URL + "/large"}},
+		},
+		{
+			name: "http request_uri",
+			v:    url.Values{"request_uri": {"http://app.example.com/request.jwt"}},
+		},
+		{
+			name: "unsigned",
+			v:    url.Values{"request": {"eyJhbGciOiJub25lIn0.eyJzdGF0ZSI6ImZvbyJ9."}},
+		},
+	}
+	noRedirect := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.v.Set("client_id", client.ID)
+			resp, err := noRedirect.Get(httpServer.URL + "/auth?" + tc.v.Encode())
+			if err != nil {
+				t.Fatalf("get failed: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("expected status %d got %d", http.StatusBadRequest, resp.StatusCode)
+			}
+		})
+	}
+	requestObjectsMu.Lock()
+	defer requestObjectsMu.Unlock()
+	if fetched["/unregistered"] {
+		t.Errorf("expected unregistered request_uri not to be fetched")
+	}
+}
+
+func TestPushedAuthRequest(t *testing.T) {
+	now := time.Now()
+	var nowMu sync.Mutex
+	httpServer, s := newTestServer(func(c *Config) {
+		c.Now = func() time.Time {
+			nowMu.Lock()
+			defer nowMu.Unlock()
+			return now
+		}
+	})
+	defer httpServer.Close()
+
+	redirectURL := "https://app.example.com/callback"
+	client := storage.Client{
+		ID:           "testclient",
+		Secret:       "testclientsecret",
+		RedirectURIs: []string{redirectURL},
+
+		RequirePushedAuthorizationRequests: true,
+	}
+	if err := s.storage.CreateClient(client); err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+
+	push := func(secret string, v url.Values) (*http.Response, parResponse) {
+		req, err := http.NewRequest("POST", httpServer.URL+"/par", strings.NewReader(v.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(client.ID, secret)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("post failed: %v", err)
+		}
+		defer resp.Body.Close()
+		var par parResponse
+		if resp.StatusCode == http.StatusCreated {
+			if err := json.NewDecoder(resp.Body).Decode(&par); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+		}
+		return resp, par
+	}
+	params := url.Values{
+		"response_type": {"code"},
+		"redirect_uri":  {redirectURL},
+		"scope":         {"openid"},
+		"state":         {"foo"},
+	}
+	noRedirect := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	authStatus := func(v url.Values) int {
+		resp, err := noRedirect.Get(httpServer.URL + "/auth?" + v.Encode())
+		if err != nil {
+			t.Fatalf("get failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// The client must push its requests.
+	direct := url.Values{"client_id": {client.ID}}
+	for k, v := range params {
+		direct[k] = v
+	}
+	if status := authStatus(direct); status != http.StatusBadRequest {
+		t.Errorf("expected direct authorization request to fail with %d got %d", http.StatusBadRequest, status)
+	}
+
+	resp, par := push(client.Secret, params)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected status %d got %d", http.StatusCreated, resp.StatusCode)
+	}
+	if !strings.HasPrefix(par.RequestURI, parRequestURIPrefix) || par.ExpiresIn != 60 {
+		t.Errorf("unexpected response %#v", par)
+	}
+	v := url.Values{"client_id": {client.ID}, "request_uri": {par.RequestURI}}
+	u := authRedirect(t, httpServer, redirectURL, v)
+	if u.Query().Get("code") == "" || u.Query().Get("state") != "foo" {
+		t.Errorf("expected code and state, got %s", u)
+	}
+	if status := authStatus(v); status != http.StatusBadRequest {
+		t.Errorf("expected reused request_uri to fail with %d got %d", http.StatusBadRequest, status)
+	}
+
+	_, par = push(client.Secret, params)
+	if status := authStatus(url.Values{"client_id": {"otherclient"}, "request_uri": {par.RequestURI}}); status != http.StatusBadRequest {
+		t.Errorf("expected mismatched client_id to fail with %d got %d", http.StatusBadRequest, status)
+	}
+
+	_, par = push(client.Secret, params)
+	nowMu.Lock()
+	now = now.Add(2 * time.Minute)
+	nowMu.Unlock()
+	if status := authStatus(url.Values{"client_id": {client.ID}, "request_uri": {par.RequestURI}}); status != http.StatusBadRequest {
+		t.Errorf("expected expired request_uri to fail with %d got %d", http.StatusBadRequest, status)
+	}
+
+	if resp, _ := push("wrongsecret", params); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected bad client credentials to fail with %d got %d", http.StatusUnauthorized, resp.StatusCode)
+	}
+	invalid := url.Values{"response_type": {"code"}, "redirect_uri": {redirectURL}, "scope": {"email"}}
+	if resp, _ := push(client.Secret, invalid); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected invalid parameters to fail with %d got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func TestAuthRequestExpiry(t *testing.T) {
+	now := time.Now()
+	var nowMu sync.Mutex
+	httpServer, s := newTestServer(func(c *Config) {
+		c.Now = func() time.Time {
+			nowMu.Lock()
+			defer nowMu.Unlock()
+			return now
+		}
+	})
+	defer httpServer.Close()
+
+	redirectURL := "https://app.example.com/callback"
+	client := storage.Client{
+		ID:           "testclient",
+		Secret:       "testclientsecret",
+		RedirectURIs: []string{redirectURL},
+	}
+	if err := s.storage.CreateClient(client); err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+
+	v := url.Values{
+		"client_id":     {client.ID},
+		"response_type": {"code"},
+		"redirect_uri":  {redirectURL},
+		"scope":         {"openid"},
+		"state":         {"foo"},
+	}
+	noRedirect := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := noRedirect.Get(httpServer.URL + "/auth?" + v.Encode())
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	resp.Body.Close()
+	login, err := resp.Location()
+	if err != nil {
+		t.Fatalf("no redirect to login: %v", err)
+	}
+
+	authReq, err := s.storage.GetAuthRequest(login.Query().Get("state"))
+	if err != nil {
+		t.Fatalf("failed to get auth request: %v", err)
+	}
+	if want := now.Add(authRequestValidFor); !authReq.Expiry.Equal(want) {
+		t.Errorf("expected auth request to expire at %s got %s", want, authReq.Expiry)
+	}
+
+	nowMu.Lock()
+	now = now.Add(authRequestValidFor + time.Minute)
+	nowMu.Unlock()
+
+	httpClient := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if strings.HasPrefix(req.URL.String(), redirectURL) {
+				t.Errorf("expected expired auth request not to redirect to the client")
+				return http.ErrUseLastResponse
+			}
+			return nil
+		},
+	}
+	resp, err = httpClient.Get(login.String())
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected expired auth request to fail with %d got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func TestResponseMode(t *testing.T) {
+	httpServer, s := newTestServer(nil)
+	defer httpServer.Close()
+
+	redirectURL := "https://app.example.com/callback"
+	client := storage.Client{ID: "testclient", Secret: "testclientsecret", RedirectURIs: []string{redirectURL}}
+	if err := s.storage.CreateClient(client); err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	httpClient := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if strings.HasPrefix(req.URL.String(), redirectURL) {
+				return http.ErrUseLastResponse
+			}
+			return nil
+		},
+	}
+	authorize := func(responseType, responseMode string, extra url.Values) (*http.Response, string) {
+		v := url.Values{
+			"client_id":     {client.ID},
+			"redirect_uri":  {redirectURL},
+			"response_type": {responseType},
+			"response_mode": {responseMode},
+			"scope":         {"openid"},
+			"state":         {`"><script>alert(1)</script>`},
+			"nonce":         {"bar"},
+		}
+		for k, vals := range extra {
+			v[k] = vals
+		}
+		resp, err := httpClient.Get(httpServer.URL + "/auth?" + v.Encode())
+		if err != nil {
+			t.Fatalf("get failed: %v", err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, string(body)
+	}
+	location := func(resp *http.Response) *url.URL {
+		u, err := resp.Location()
+		if err != nil {
+			t.Fatalf("no redirect to client, got status %d", resp.StatusCode)
+		}
+		return u
+	}
+
+	// Code responses default to the query, and responses with tokens to the fragment.
+	resp, _ := authorize("code", "", nil)
+	if u := location(resp); u.Query().Get("code") == "" || u.Fragment != "" {
+		t.Errorf("expected code in query, got %s", u)
+	}
+	resp, _ = authorize("code id_token", "", nil)
+	if u := location(resp); u.Query().Get("code") != "" || !strings.Contains(u.Fragment, "code=") {
+		t.Errorf("expected code in fragment, got %s", u)
+	}
+	resp, _ = authorize("code", "fragment", nil)
+	if u := location(resp); u.Query().Get("code") != "" || !strings.Contains(u.Fragment, "code=") {
+		t.Errorf("expected code in fragment, got %s", u)
+	}
+
+	for _, responseType := range []string{"code", "code id_token"} {
+		resp, body := authorize(responseType, "form_post", nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: expected status %d got %d", responseType, http.StatusOK, resp.StatusCode)
+			continue
+		}
+		if !strings.Contains(body, `action="`+redirectURL+`"`) || !strings.Contains(body, `name="code"`) {
+			t.Errorf("%s: expected form posting the code to the client:\n%s", responseType, body)
+		}
+		if strings.Contains(body, "<script>") || !strings.Contains(body, `name="state" value="&#34;&gt;&lt;script&gt;`) {
+			t.Errorf("%s: expected state to be escaped:\n%s", responseType, body)
+		}
+	}
+
+	// Errors use the response mode too.
+	resp, body := authorize("code", "form_post", url.Values{"prompt": {"none"}})
+	if !strings.Contains(body, `name="error" value="login_required"`) {
+		t.Errorf("expected form posting the error to the client:\n%s", body)
+	}
+
+	for _, tc := range []struct{ responseType, responseMode string }{
+		{"code id_token", "query"},
+		{"token", "query"},
+		{"code", "web_message"},
+	} {
+		resp, _ = authorize(tc.responseType, tc.responseMode, nil)
+		if _, err := resp.Location(); err == nil {
+			t.Errorf("expected response_type %q with response_mode %q to fail", tc.responseType, tc.responseMode)
+		}
+	}
+}
+
+// upstreamConnector is a callback connector whose upstream user can be changed
+// or removed between refreshes.
+type upstreamConnector struct {
+	connector.CallbackConnector
+
+	mu       sync.Mutex
+	username string
+	removed  bool
+	down     bool
+}
+
+func (c *upstreamConnector) Close() error { return nil }
+
+func (c *upstreamConnector) Groups(identity storage.Identity) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return []string{c.username + "-group"}, nil
+}
+
+func (c *upstreamConnector) Refresh(identity storage.Identity) (storage.Identity, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case c.down:
+		return identity, errors.New("upstream unavailable")
+	case c.removed:
+		return identity, connector.ErrRevoked
+	}
+	identity.Username = c.username
+	return identity, nil
+}
+
+func (c *upstreamConnector) update(f func(c *upstreamConnector)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f(c)
+}
+
+func TestRefreshReauthentication(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	conn := &upstreamConnector{CallbackConnector: mock.New().(connector.CallbackConnector), username: "kilgore"}
+	httpServer, s := newTestServer(func(c *Config) {
+		c.Connectors = []Connector{{ID: "upstream", DisplayName: "Upstream", Connector: conn}}
+	})
+	defer httpServer.Close()
+
+	redirectURL := "https://app.example.com/callback"
+	client := storage.Client{ID: "testclient", Secret: "testclientsecret", RedirectURIs: []string{redirectURL}}
+	if err := s.storage.CreateClient(client); err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	oauth2Config := &oauth2.Config{
+		ClientID:     client.ID,
+		ClientSecret: client.Secret,
+		Endpoint:     oauth2.Endpoint{TokenURL: httpServer.URL + "/token"},
+		RedirectURL:  redirectURL,
+	}
+
+	u := authRedirect(t, httpServer, redirectURL, url.Values{
+		"client_id":     {client.ID},
+		"redirect_uri":  {redirectURL},
+		"response_type": {"code"},
+		"scope":         {"openid profile groups offline_access"},
+	})
+	token, err := oauth2Config.Exchange(ctx, u.Query().Get("code"))
+	if err != nil {
+		t.Fatalf("failed to exchange code: %v", err)
+	}
+
+	refreshToken := func() (*oauth2.Token, error) {
+		token.Expiry = time.Now().Add(-time.Minute)
+		newToken, err := oauth2Config.TokenSource(ctx, token).Token()
+		if err == nil {
+			token = newToken
+		}
+		return newToken, err
+	}
+	idTokenClaimsOf := func(token *oauth2.Token) idTokenClaims {
+		var claims idTokenClaims
+		if err := unverifiedClaims(token.Extra("id_token").(string), &claims); err != nil {
+			t.Fatalf("failed to decode id token: %v", err)
+		}
+		return claims
+	}
+
+	// Changes upstream are reflected in refreshed tokens.
+	conn.update(func(c *upstreamConnector) { c.username = "trout" })
+	newToken, err := refreshToken()
+	if err != nil {
+		t.Fatalf("failed to refresh token: %v", err)
+	}
+	claims := idTokenClaimsOf(newToken)
+	if claims.Name != "trout" || !reflect.DeepEqual(claims.Groups, []string{"trout-group"}) {
+		t.Errorf("expected refreshed name and groups, got %q %q", claims.Name, claims.Groups)
+	}
+
+	// Temporary failures don't revoke the token.
+	conn.update(func(c *upstreamConnector) { c.down = true })
+	if _, err := refreshToken(); err == nil {
+		t.Errorf("expected refresh to fail while upstream is down")
+	}
+	conn.update(func(c *upstreamConnector) { c.down = false })
+	if _, err := refreshToken(); err != nil {
+		t.Fatalf("failed to refresh token after upstream recovered: %v", err)
+	}
+
+	conn.update(func(c *upstreamConnector) { c.removed = true })
+	if _, err := refreshToken(); err == nil {
+		t.Errorf("expected refresh to fail after the user was removed upstream")
+	}
+	if _, err := s.storage.GetRefresh(token.RefreshToken); err != storage.ErrNotFound {
+		t.Errorf("expected refresh token to be revoked, got %v", err)
+	}
+}
+
+func TestRefreshTokenReuse(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	now := time.Now()
+	var nowMu sync.Mutex
+	advance := func(d time.Duration) {
+		nowMu.Lock()
+		now = now.Add(d)
+		nowMu.Unlock()
+	}
+	httpServer, s := newTestServer(func(c *Config) {
+		c.RefreshTokenReuseInterval = 5 * time.Second
+		c.Now = func() time.Time {
+			nowMu.Lock()
+			defer nowMu.Unlock()
+			return now
+		}
+	})
+	defer httpServer.Close()
+
+	redirectURL := "https://app.example.com/callback"
+	client := storage.Client{ID: "testclient", Secret: "testclientsecret", RedirectURIs: []string{redirectURL}}
+	if err := s.storage.CreateClient(client); err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	oauth2Config := &oauth2.Config{
+		ClientID:     client.ID,
+		ClientSecret: client.Secret,
+		Endpoint:     oauth2.Endpoint{TokenURL: httpServer.URL + "/token"},
+		RedirectURL:  redirectURL,
+	}
+	newRefreshToken := func() string {
+		u := authRedirect(t, httpServer, redirectURL, url.Values{
+			"client_id":     {client.ID},
+			"redirect_uri":  {redirectURL},
+			"response_type": {"code"},
+			"scope":         {"openid offline_access"},
+		})
+		token, err := oauth2Config.Exchange(ctx, u.Query().Get("code"))
+		if err != nil {
+			t.Fatalf("failed to exchange code: %v", err)
+		}
+		return token.RefreshToken
+	}
+	// refresh returns the new refresh token, or an empty string if the request
+	// was rejected.
+	refresh := func(refreshToken string) string {
+		req, err := http.NewRequest("POST", httpServer.URL+"/token", strings.NewReader(url.Values{
+			"grant_type":    {"refresh_token"},
+			"refresh_token": {refreshToken},
+		}.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(client.ID, client.Secret)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("post failed: %v", err)
+		}
+		defer resp.Body.Close()
+		var body struct {
+			RefreshToken string `json:"refresh_token"`
+			Error        string `json:"error"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		if body.RefreshToken == "" && body.Error == "" {
+			t.Errorf("expected a refresh token or an error")
+		}
+		return body.RefreshToken
+	}
+	revoked := func(refreshToken string) bool {
+		_, err := s.storage.GetRefresh(refreshToken)
+		return err == storage.ErrNotFound
+	}
+
+	a := newRefreshToken()
+	b := refresh(a)
+	if b == "" {
+		t.Fatalf("failed to refresh token")
+	}
+
+	// The client retries before receiving b.
+	advance(time.Second)
+	c := refresh(a)
+	if c == "" || c == b {
+		t.Fatalf("expected retry within the reuse interval to issue a new token, got %q", c)
+	}
+	if !revoked(b) {
+		t.Errorf("expected token replaced by retry to be revoked")
+	}
+	d := refresh(c)
+	if d == "" {
+		t.Fatalf("failed to refresh token")
+	}
+
+	// Once its successor has been used, a token can't be retried.
+	if refresh(a) != "" {
+		t.Errorf("expected retry after the successor was used to fail")
+	}
+	if !revoked(d) {
+		t.Errorf("expected token family to be revoked")
+	}
+
+	// Or once the reuse interval has passed.
+	a = newRefreshToken()
+	b = refresh(a)
+	advance(10 * time.Second)
+	if refresh(a) != "" {
+		t.Errorf("expected reuse after the reuse interval to fail")
+	}
+	if !revoked(b) {
+		t.Errorf("expected token family to be revoked")
+	}
+	if refresh(b) != "" {
+		t.Errorf("expected revoked token to be rejected")
+	}
+}
+
+func TestRefreshTokenExpiry(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	now := time.Now()
+	var nowMu sync.Mutex
+	advance := func(d time.Duration) {
+		nowMu.Lock()
+		now = now.Add(d)
+		nowMu.Unlock()
+	}
+	httpServer, s := newTestServer(func(c *Config) {
+		c.RefreshTokenIdleTimeout = time.Hour
+		c.RefreshTokenAbsoluteLifetime = 3 * time.Hour
+		c.Now = func() time.Time {
+			nowMu.Lock()
+			defer nowMu.Unlock()
+			return now
+		}
+	})
+	defer httpServer.Close()
+
+	redirectURL := "https://app.example.com/callback"
+	client := storage.Client{ID: "testclient", Secret: "testclientsecret", RedirectURIs: []string{redirectURL}}
+	shortLived := storage.Client{
+		ID:                      "shortlived",
+		Secret:                  "shortlivedsecret",
+		RedirectURIs:            []string{redirectURL},
+		RefreshTokenIdleTimeout: 10 * time.Minute,
+	}
+	for _, c := range []storage.Client{client, shortLived} {
+		if err := s.storage.CreateClient(c); err != nil {
+			t.Fatalf("failed to create client: %v", err)
+		}
+	}
+	newRefreshToken := func(client storage.Client) string {
+		oauth2Config := &oauth2.Config{
+			ClientID:     client.ID,
+			ClientSecret: client.Secret,
+			Endpoint:     oauth2.Endpoint{TokenURL: httpServer.URL + "/token"},
+			RedirectURL:  redirectURL,
+		}
+		u := authRedirect(t, httpServer, redirectURL, url.Values{
+			"client_id":     {client.ID},
+			"redirect_uri":  {redirectURL},
+			"response_type": {"code"},
+			"scope":         {"openid offline_access"},
+		})
+		token, err := oauth2Config.Exchange(ctx, u.Query().Get("code"))
+		if err != nil {
+			t.Fatalf("failed to exchange code: %v", err)
+		}
+		return token.RefreshToken
+	}
+	// refresh returns the new refresh token, or an empty string if the request
+	// was rejected.
+	refresh := func(client storage.Client, refreshToken string) string {
+		req, err := http.NewRequest("POST", httpServer.URL+"/token", strings.NewReader(url.Values{
+			"grant_type":    {"refresh_token"},
+			"refresh_token": {refreshToken},
+		}.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(client.ID, client.Secret)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("post failed: %v", err)
+		}
+		defer resp.Body.Close()
+		var body struct {
+			RefreshToken string `json:"refresh_token"`
+			Error        string `json:"error"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		if body.RefreshToken == "" && body.Error != errInvalidGrant {
+			t.Errorf("expected a refresh token or an invalid_grant error, got %q", body.Error)
+		}
+		return body.RefreshToken
+	}
+
+	// Using a token resets the idle timeout.
+	token := newRefreshToken(client)
+	for i := 0; i < 2; i++ {
+		advance(50 * time.Minute)
+		if token = refresh(client, token); token == "" {
+			t.Fatalf("expected refresh within the idle timeout to succeed")
+		}
+	}
+	stored, err := s.storage.GetRefresh(token)
+	if err != nil {
+		t.Fatalf("failed to get refresh token: %v", err)
+	}
+	if want := now.Add(time.Hour); !stored.Expiry.Equal(want) {
+		t.Errorf("expected refresh token to expire at %v, got %v", want, stored.Expiry)
+	}
+	advance(70 * time.Minute)
+	if refresh(client, token) != "" {
+		t.Errorf("expected refresh after the idle timeout to fail")
+	}
+	if _, err := s.storage.GetRefresh(token); err != storage.ErrNotFound {
+		t.Errorf("expected expired refresh token to be revoked, got %v", err)
+	}
+
+	// Tokens can't be used after the absolute lifetime, however often they're
+	// refreshed.
+	token = newRefreshToken(client)
+	for i := 0; i < 3; i++ {
+		advance(50 * time.Minute)
+		if token = refresh(client, token); token == "" {
+			t.Fatalf("expected refresh within the absolute lifetime to succeed")
+		}
+	}
+	advance(50 * time.Minute)
+	if refresh(client, token) != "" {
+		t.Errorf("expected refresh after the absolute lifetime to fail")
+	}
+
+	// Clients can override the server's lifetimes.
+	token = newRefreshToken(shortLived)
+	advance(20 * time.Minute)
+	if refresh(shortLived, token) != "" {
+		t.Errorf("expected refresh after the client's idle timeout to fail")
+	}
+}
+
+func TestClaimMappings(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, s := newTestServer(func(c *Config) {
+		c.Connectors = append(c.Connectors, Connector{
+			ID:          "password",
+			DisplayName: "Password",
+			Connector:   mock.NewPasswordConnector("kilgore", "trout"),
+			ClaimMappings: []ClaimMapping{
+				{Claim: "preferred_username", Attribute: "login"},
+				{Claim: "given_name", Attribute: "givenName", Scope: "profile"},
+				{Claim: "locale", Attribute: "locale", Scope: "openid"},
+				{Claim: "nickname", Attribute: "missing"},
+			},
+		})
+		c.PasswordConnector = "password"
+	})
+	defer httpServer.Close()
+
+	client := storage.Client{ID: "testclient", Secret: "testclientsecret", AllowPasswordGrant: true}
+	if err := s.storage.CreateClient(client); err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	login := func(scopes ...string) (idTokenClaims map[string]interface{}, accessToken string) {
+		oauth2Config := &oauth2.Config{
+			ClientID:     client.ID,
+			ClientSecret: client.Secret,
+			Endpoint:     oauth2.Endpoint{TokenURL: httpServer.URL + "/token"},
+			Scopes:       scopes,
+		}
+		token, err := oauth2Config.PasswordCredentialsToken(ctx, "kilgore", "trout")
+		if err != nil {
+			t.Fatalf("failed to get token: %v", err)
+		}
+		idToken, ok := token.Extra("id_token").(string)
+		if !ok {
+			t.Fatalf("no id token found")
+		}
+		jws, err := jose.ParseSigned(idToken)
+		if err != nil {
+			t.Fatalf("failed to parse id token: %v", err)
+		}
+		payload, err := jws.Verify(&testKey.PublicKey)
+		if err != nil {
+			t.Fatalf("failed to verify id token: %v", err)
+		}
+		if err := json.Unmarshal(payload, &idTokenClaims); err != nil {
+			t.Fatalf("failed to unmarshal claims: %v", err)
+		}
+		return idTokenClaims, token.AccessToken
+	}
+
+	claims, _ := login("openid")
+	if claims["locale"] != "en-US" {
+		t.Errorf("expected locale claim for the openid scope, got %v", claims["locale"])
+	}
+	if _, ok := claims["preferred_username"]; ok {
+		t.Errorf("expected profile claims to require the profile scope")
+	}
+
+	claims, accessToken := login("openid", "profile")
+	if claims["preferred_username"] != "kilgore" || claims["given_name"] != "Kilgore" {
+		t.Errorf("expected mapped profile claims, got %v", claims)
+	}
+	if _, ok := claims["nickname"]; ok {
+		t.Errorf("expected claims for missing attributes to be omitted")
+	}
+	if claims["sub"] != "0-385-28089-0" || claims["name"] != "Kilgore Trout" {
+		t.Errorf("expected standard claims to be preserved, got %v", claims)
+	}
+
+	req, err := http.NewRequest("GET", httpServer.URL+"/userinfo", nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	defer resp.Body.Close()
+	var userInfo map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&userInfo); err != nil {
+		t.Fatalf("failed to decode user info: %v", err)
+	}
+	if userInfo["preferred_username"] != "kilgore" || userInfo["locale"] != "en-US" {
+		t.Errorf("expected mapped claims in user info, got %v", userInfo)
+	}
+
+	rr := httptest.NewRecorder()
+	s.handleDiscovery(rr, httptest.NewRequest("GET", "/.well-known/openid-configuration", nil))
+	var d discovery
+	if err := json.Unmarshal(rr.Body.Bytes(), &d); err != nil {
+		t.Fatalf("failed to decode discovery: %v", err)
+	}
+	supported := make(map[string]bool)
+	for _, claim := range d.Claims {
+		supported[claim] = true
+	}
+	if !supported["preferred_username"] || !supported["given_name"] || !supported["groups"] || supported["family_name"] {
+		t.Errorf("expected claims_supported to list mapped claims, got %q", d.Claims)
+	}
+
+	// Claims set by the server can't be overridden.
+	_, err = newServer(Config{
+		Issuer:  httpServer.URL,
+		Storage: memory.New(),
+		Connectors: []Connector{{
+			ID:            "mock",
+			Connector:     mock.New(),
+			ClaimMappings: []ClaimMapping{{Claim: "email", Attribute: "login"}},
+		}},
+	}, staticRotationStrategy(testKey))
+	if err == nil {
+		t.Errorf("expected mapping a reserved claim to fail")
+	}
+}
+
+// anonymousConnector accepts any password but doesn't identify the end user.
+type anonymousConnector struct{}
+
+func (anonymousConnector) Close() error { return nil }
+
+func (anonymousConnector) Login(username, password string) (storage.Identity, bool, error) {
+	return storage.Identity{Username: username}, true, nil
+}
+
+func TestPasswordGrantRequiresUserID(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	httpServer, s := newTestServer(func(c *Config) {
+		c.Connectors = append(c.Connectors, Connector{
+			ID:          "anonymous",
+			DisplayName: "Anonymous",
+			Connector:   anonymousConnector{},
+		})
+		c.PasswordConnector = "anonymous"
+	})
+	defer httpServer.Close()
+
+	client := storage.Client{ID: "testclient", Secret: "testclientsecret", AllowPasswordGrant: true}
+	if err := s.storage.CreateClient(client); err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	oauth2Config := &oauth2.Config{
+		ClientID:     client.ID,
+		ClientSecret: client.Secret,
+		Endpoint:     oauth2.Endpoint{TokenURL: httpServer.URL + "/token"},
+		Scopes:       []string{"openid"},
+	}
+	if _, err := oauth2Config.PasswordCredentialsToken(ctx, "kilgore", "trout"); err == nil {
+		t.Errorf("expected password grant to fail for an identity without a user ID")
+	}
+}
@@ -0,0 +1,219 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/ericchiang/poke/storage"
+)
+
+// Sessions let an end user who has logged in through a connector authorize other
+// clients without logging in again. The session ID is held by the browser in a
+// cookie, and the session expires if unused for the idle timeout or once it
+// reaches the absolute timeout, whichever is first.
+
+const sessionCookieName = "poke_session"
+
+// newSessionID returns a random session ID. Session IDs are bearer credentials
+// for the end user's login, so they're longer than other IDs. Hex encoding keeps
+// them valid Kubernetes names.
+func newSessionID() string {
+	buff := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, buff); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buff)
+}
+
+// sessionSID returns the "sid" claim identifying a session to clients. It's a
+// hash of the session ID so the session cookie's value is never revealed.
+func sessionSID(sessionID string) string {
+	h := sha256.Sum256([]byte(sessionID))
+	return base64.RawURLEncoding.EncodeToString(h[:16])
+}
+
+// session returns the end user's active session, if the request has one.
+func (s *Server) session(r *http.Request) (storage.Session, bool) {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil || cookie.Value == "" {
+		return storage.Session{}, false
+	}
+	session, err := s.storage.GetSession(cookie.Value)
+	if err != nil {
+		if err != storage.ErrNotFound {
+			log.Printf("Failed to get session: %v", err)
+		}
+		return storage.Session{}, false
+	}
+
+	now := s.now()
+	if !now.Before(session.Expiry) || now.After(session.LastUsed.Add(s.sessionIdleTimeout)) {
+		if err := s.storage.DeleteSession(session.ID); err != nil && err != storage.ErrNotFound {
+			log.Printf("Failed to delete expired session: %v", err)
+		}
+		return storage.Session{}, false
+	}
+	if _, ok := s.connectors[session.ConnectorID]; !ok {
+		// The connector has been removed from the server's config.
+		return storage.Session{}, false
+	}
+	return session, true
+}
+
+// startSession creates a session for an end user who has just logged in through
+// a connector and sets the session cookie. Any previous session is replaced. The
+// returned identity records the session's "sid".
+func (s *Server) startSession(w http.ResponseWriter, r *http.Request, identity storage.Identity, connectorID string) (storage.Identity, error) {
+	if old, ok := s.session(r); ok {
+		if err := s.storage.DeleteSession(old.ID); err != nil && err != storage.ErrNotFound {
+			log.Printf("Failed to delete previous session: %v", err)
+		}
+	}
+
+	now := s.now()
+	session := storage.Session{
+		ID:          newSessionID(),
+		ConnectorID: connectorID,
+		Identity:    identity,
+		CreatedAt:   now,
+		LastUsed:    now,
+		Expiry:      now.Add(s.sessionAbsoluteTimeout),
+	}
+	session.Identity.SessionID = sessionSID(session.ID)
+	if err := s.storage.CreateSession(session); err != nil {
+		return identity, err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    session.ID,
+		Path:     s.absPath("/"),
+		Expires:  session.Expiry,
+		Secure:   s.issuerURL.Scheme == "https",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return session.Identity, nil
+}
+
+// touchSession records that the end user used their session to authorize a
+// client, extending the session's idle timeout.
+func (s *Server) touchSession(r *http.Request, clientID string) {
+	session, ok := s.session(r)
+	if !ok {
+		return
+	}
+	err := s.storage.UpdateSession(session.ID, func(old storage.Session) (storage.Session, error) {
+		old.LastUsed = s.now()
+		for _, id := range old.Clients {
+			if id == clientID {
+				return old, nil
+			}
+		}
+		old.Clients = append(old.Clients, clientID)
+		return old, nil
+	})
+	if err != nil {
+		log.Printf("Failed to update session: %v", err)
+	}
+}
+
+// endSession deletes a session and clears the session cookie.
+func (s *Server) endSession(w http.ResponseWriter, session storage.Session) {
+	if err := s.storage.DeleteSession(session.ID); err != nil && err != storage.ErrNotFound {
+		log.Printf("Failed to delete session: %v", err)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Path:     s.absPath("/"),
+		MaxAge:   -1,
+		Secure:   s.issuerURL.Scheme == "https",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// sessionForRequest returns the end user's session if it can be used for an
+// authorization request. Clients can require the end user to login again, or to
+// have logged in recently.
+func (s *Server) sessionForRequest(r *http.Request, authReq storage.AuthRequest) (storage.Session, bool) {
+	if authReq.ForceLogin {
+		return storage.Session{}, false
+	}
+	session, ok := s.session(r)
+	if !ok {
+		return storage.Session{}, false
+	}
+	if authReq.MaxAge > 0 {
+		maxAge := time.Duration(authReq.MaxAge) * time.Second
+		if s.now().After(session.Identity.AuthTime.Add(maxAge)) {
+			return storage.Session{}, false
+		}
+	}
+	return session, true
+}
+
+// redirectToLogin sends an end user with a usable session straight to
+// approval, and any other end user to login with a connector. Groups are
+// requested again for a session since they depend on the scopes of each request.
+//
+// If the client asked for no UI to be shown, the request fails instead when
+// the end user would have to login or approve the client.
+func (s *Server) redirectToLogin(w http.ResponseWriter, r *http.Request, authReq storage.AuthRequest) {
+	session, ok := s.sessionForRequest(r, authReq)
+	if !ok {
+		if authReq.PromptNone {
+			s.authReqErr(w, r, authReq, errLoginRequired, "End user must login.")
+			return
+		}
+		s.redirectToConnectors(w, r, authReq.ID)
+		return
+	}
+
+	identity := session.Identity
+	groups, ok, err := groupsForScopes(identity, authReq.Scopes, s.connectors[session.ConnectorID].Connector)
+	if err != nil {
+		log.Printf("Failed to get groups: %v", err)
+		s.renderError(w, http.StatusInternalServerError, errServerError, "")
+		return
+	}
+	if ok {
+		identity.Groups = groups
+	} else {
+		identity.Groups = nil
+	}
+
+	if authReq.PromptNone && !s.skipApproval && !s.isDeviceAuthRequest(authReq) {
+		authReq.ConnectorID, authReq.Identity = session.ConnectorID, &identity
+		approved, err := s.hasConsent(authReq)
+		if err != nil {
+			log.Printf("Failed to get consent: %v", err)
+			s.renderError(w, http.StatusInternalServerError, errServerError, "")
+			return
+		}
+		if !approved || authReq.ForceApprovalPrompt {
+			s.authReqErr(w, r, authReq, errConsentRequired, "End user must approve the client.")
+			return
+		}
+	}
+	s.redirectToApproval(w, r, identity, session.ConnectorID, authReq.ID)
+}
+
+// authReqErr ends an authorization request which can't be completed and
+// returns the error to the client using the request's response mode.
+func (s *Server) authReqErr(w http.ResponseWriter, r *http.Request, authReq storage.AuthRequest, typ, description string) {
+	if err := s.storage.DeleteAuthRequest(authReq.ID); err != nil && err != storage.ErrNotFound {
+		log.Printf("Failed to delete authorization request: %v", err)
+	}
+	v := url.Values{"state": {authReq.State}, "error": {typ}}
+	if description != "" {
+		v.Set("error_description", description)
+	}
+	s.sendAuthResponse(w, r, authReq.RedirectURI, responseMode(authReq), v)
+}
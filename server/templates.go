@@ -1,9 +1,11 @@
 package server
 
 import (
+	"html/template"
 	"log"
 	"net/http"
-	"text/template"
+	"net/url"
+	texttemplate "text/template"
 
 	"github.com/ericchiang/poke/storage"
 )
@@ -35,7 +37,7 @@ var passwordTmpl = template.Must(template.New("password-template").Parse(`<html>
 <body>
 <p>Login</p>
 <form action="{{ .Callback }}" method="POST">
-Login: <input type="text" name="login"/><br/>
+Username: <input type="text" name="username" value="{{ .Username }}"/><br/>
 Password: <input type="password" name="password"/><br/>
 <input type="hidden" name="state" value="{{ .State }}"/>
 <input type="submit"/>
@@ -46,12 +48,13 @@ Password: <input type="password" name="password"/><br/>
 </body>
 </html>`))
 
-func renderPasswordTmpl(w http.ResponseWriter, state, callback, message string) {
+func renderPasswordTmpl(w http.ResponseWriter, state, callback, username, message string) {
 	data := struct {
 		State    string
 		Callback string
+		Username string
 		Message  string
-	}{state, callback, message}
+	}{state, callback, username, message}
 	renderTemplate(w, passwordTmpl, data)
 }
 
@@ -81,6 +84,115 @@ func renderApprovalTmpl(w http.ResponseWriter, state string, identity storage.Id
 	renderTemplate(w, approvalTmpl, data)
 }
 
+var deviceTmpl = template.Must(template.New("device-template").Parse(`<html>
+<body>
+<p>Enter the code displayed on your device</p>
+<form action="{{ .Action }}" method="POST">
+Code: <input type="text" name="user_code" value="{{ .UserCode }}"/><br/>
+<input type="submit"/>
+{{ if .Message }}
+<p>Error: {{ .Message }}</p>
+{{ end }}
+</form>
+</body>
+</html>`))
+
+func renderDeviceTmpl(w http.ResponseWriter, action, userCode, message string) {
+	data := struct {
+		Action   string
+		UserCode string
+		Message  string
+	}{action, userCode, message}
+	renderTemplate(w, deviceTmpl, data)
+}
+
+var deviceSuccessTmpl = template.Must(template.New("device-success-template").Parse(`<html>
+<body>
+<p>Device authorized. You may now close this window and return to your device.</p>
+</body>
+</html>`))
+
+func renderDeviceSuccessTmpl(w http.ResponseWriter) {
+	renderTemplate(w, deviceSuccessTmpl, nil)
+}
+
+var logoutTmpl = template.Must(template.New("logout-template").Parse(`<html>
+<body>
+{{ if .Confirm }}<p>Do you want to log out?</p>
+<form method="post" action="{{ .Action }}">
+{{ range $name, $values := .Params }}{{ range $values }}<input type="hidden" name="{{ $name }}" value="{{ . }}"/>
+{{ end }}{{ end }}<button type="submit">Log out</button>
+</form>
+{{ else }}<p>You have been logged out.</p>
+{{ end }}</body>
+</html>`))
+
+func renderLogoutTmpl(w http.ResponseWriter) {
+	renderTemplate(w, logoutTmpl, struct{ Confirm bool }{})
+}
+
+// renderLogoutConfirmTmpl asks the end user to confirm a logout by posting the
+// request's parameters back to the end session endpoint.
+func renderLogoutConfirmTmpl(w http.ResponseWriter, action string, params url.Values) {
+	data := struct {
+		Confirm bool
+		Action  string
+		Params  url.Values
+	}{true, action, params}
+	renderTemplate(w, logoutTmpl, data)
+}
+
+var consentTmpl = template.Must(template.New("consent-template").Parse(`<html>
+<body>
+<p>Applications you have approved</p>
+{{ range .Consents }}
+<form method="post">
+<p>{{ .ClientName }}: {{ .Scopes }}</p>
+<input type="hidden" name="client_id" value="{{ .ClientID }}"/>
+<input type="hidden" name="csrf_token" value="{{ $.CSRFToken }}"/>
+<button type="submit">Revoke</button>
+</form>
+{{ else }}
+<p>You haven't approved any applications.</p>
+{{ end }}
+</body>
+</html>`))
+
+type consentInfo struct {
+	ClientID   string
+	ClientName string
+	Scopes     string
+}
+
+func renderConsentTmpl(w http.ResponseWriter, consents []consentInfo, csrfToken string) {
+	data := struct {
+		Consents  []consentInfo
+		CSRFToken string
+	}{consents, csrfToken}
+	renderTemplate(w, consentTmpl, data)
+}
+
+// formPostTmpl returns an authorization response by having the browser post
+// it to the client.
+var formPostTmpl = template.Must(template.New("form-post-template").Parse(`<html>
+<head><title>Submit this form</title></head>
+<body onload="document.forms[0].submit()">
+<form method="post" action="{{ .Action }}">
+{{ range $name, $values := .Values }}{{ range $values }}<input type="hidden" name="{{ $name }}" value="{{ . }}"/>
+{{ end }}{{ end }}<noscript><button type="submit">Continue</button></noscript>
+</form>
+</body>
+</html>`))
+
+func renderFormPostTmpl(w http.ResponseWriter, action string, values url.Values) {
+	data := struct {
+		Action string
+		Values url.Values
+	}{action, values}
+	w.Header().Set("Cache-Control", "no-store")
+	renderTemplate(w, formPostTmpl, data)
+}
+
 func renderTemplate(w http.ResponseWriter, tmpl *template.Template, data interface{}) {
 	err := tmpl.Execute(w, data)
 	if err == nil {
@@ -88,7 +200,7 @@ func renderTemplate(w http.ResponseWriter, tmpl *template.Template, data interfa
 	}
 
 	switch err := err.(type) {
-	case template.ExecError:
+	case texttemplate.ExecError, *template.Error:
 		// An ExecError guarentees that Execute has not written to the underlying reader.
 		log.Printf("Error rendering template %s: %s", tmpl.Name(), err)
 
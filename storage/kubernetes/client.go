@@ -102,8 +102,11 @@ func checkHTTPErr(r *http.Response, validStatusCodes ...int) error {
 	err = &httpErr{method, url, r.Status, body}
 	log.Printf("%s", err)
 
-	if r.StatusCode == http.StatusNotFound {
+	switch r.StatusCode {
+	case http.StatusNotFound:
 		return storage.ErrNotFound
+	case http.StatusConflict:
+		return storage.ErrAlreadyExists
 	}
 	return err
 }
@@ -2,28 +2,186 @@ package kubernetes
 
 import (
 	"fmt"
-	"log"
-)
+	"time"
 
-// TODO(ericchiang): Complete this.
+	"github.com/ericchiang/poke/storage"
+)
 
 type multiErr []error
 
 func (m multiErr) Error() string {
-	return fmt.Sprintf("errors encountered: %s", m)
+	return fmt.Sprintf("errors encountered: %s", []error(m))
 }
 
-func (cli *client) gcAuthRequests() error {
+// Kubernetes has no way to expire third party resources, so every object is
+// listed and compared against its expiry.
+
+func (cli *client) GarbageCollect(now time.Time) (result storage.GCResult, err error) {
+	var errs multiErr
+	if result.AuthRequests, err = cli.gcAuthRequests(now); err != nil {
+		errs = append(errs, fmt.Errorf("auth requests: %v", err))
+	}
+	if result.AuthCodes, err = cli.gcAuthCodes(now); err != nil {
+		errs = append(errs, fmt.Errorf("auth codes: %v", err))
+	}
+	if result.DeviceRequests, err = cli.gcDeviceRequests(now); err != nil {
+		errs = append(errs, fmt.Errorf("device requests: %v", err))
+	}
+	if result.DeviceTokens, err = cli.gcDeviceTokens(now); err != nil {
+		errs = append(errs, fmt.Errorf("device tokens: %v", err))
+	}
+	if result.ClientAssertions, err = cli.gcClientAssertions(now); err != nil {
+		errs = append(errs, fmt.Errorf("client assertions: %v", err))
+	}
+	if result.AccessTokens, err = cli.gcAccessTokens(now); err != nil {
+		errs = append(errs, fmt.Errorf("access tokens: %v", err))
+	}
+	if result.Sessions, err = cli.gcSessions(now); err != nil {
+		errs = append(errs, fmt.Errorf("sessions: %v", err))
+	}
+	if result.RefreshTokens, err = cli.gcRefreshTokens(now); err != nil {
+		errs = append(errs, fmt.Errorf("refresh tokens: %v", err))
+	}
+	if len(errs) > 0 {
+		return result, errs
+	}
+	return result, nil
+}
+
+func expired(expiry, now time.Time) bool {
+	return !expiry.IsZero() && now.After(expiry)
+}
+
+// deleteAll deletes the named objects, returning how many were deleted. Objects
+// which have already been deleted aren't counted.
+func (cli *client) deleteAll(resource string, names []string) (int64, error) {
+	var (
+		n    int64
+		errs multiErr
+	)
+	for _, name := range names {
+		if err := cli.delete(resource, name); err != nil {
+			if err != storage.ErrNotFound {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		n++
+	}
+	if len(errs) > 0 {
+		return n, errs
+	}
+	return n, nil
+}
+
+func (cli *client) gcAuthRequests(now time.Time) (int64, error) {
 	var authRequests AuthRequestList
 	if err := cli.list(resourceAuthRequest, &authRequests); err != nil {
-		return err
+		return 0, err
 	}
-	for _, authRequest := range authRequests.AuthRequests {
-		if cli.now().After(authRequest.Expiry) {
-			if err := cli.delete(resourceAuthRequest, authRequest.ObjectMeta.Name); err != nil {
-				log.Printf("failed to detele auth request: %v", err)
-			}
+	var names []string
+	for _, a := range authRequests.AuthRequests {
+		if expired(a.Expiry, now) {
+			names = append(names, a.ObjectMeta.Name)
+		}
+	}
+	return cli.deleteAll(resourceAuthRequest, names)
+}
+
+func (cli *client) gcAuthCodes(now time.Time) (int64, error) {
+	var authCodes AuthCodeList
+	if err := cli.list(resourceAuthCode, &authCodes); err != nil {
+		return 0, err
+	}
+	var names []string
+	for _, a := range authCodes.AuthCodes {
+		if expired(a.Expiry, now) {
+			names = append(names, a.ObjectMeta.Name)
+		}
+	}
+	return cli.deleteAll(resourceAuthCode, names)
+}
+
+func (cli *client) gcDeviceRequests(now time.Time) (int64, error) {
+	var deviceRequests DeviceRequestList
+	if err := cli.list(resourceDeviceRequest, &deviceRequests); err != nil {
+		return 0, err
+	}
+	var names []string
+	for _, d := range deviceRequests.DeviceRequests {
+		if expired(d.Expiry, now) {
+			names = append(names, d.ObjectMeta.Name)
+		}
+	}
+	return cli.deleteAll(resourceDeviceRequest, names)
+}
+
+func (cli *client) gcDeviceTokens(now time.Time) (int64, error) {
+	var deviceTokens DeviceTokenList
+	if err := cli.list(resourceDeviceToken, &deviceTokens); err != nil {
+		return 0, err
+	}
+	var names []string
+	for _, t := range deviceTokens.DeviceTokens {
+		if expired(t.Expiry, now) {
+			names = append(names, t.ObjectMeta.Name)
+		}
+	}
+	return cli.deleteAll(resourceDeviceToken, names)
+}
+
+func (cli *client) gcClientAssertions(now time.Time) (int64, error) {
+	var assertions ClientAssertionList
+	if err := cli.list(resourceClientAssertion, &assertions); err != nil {
+		return 0, err
+	}
+	var names []string
+	for _, a := range assertions.ClientAssertions {
+		if expired(a.Expiry, now) {
+			names = append(names, a.ObjectMeta.Name)
+		}
+	}
+	return cli.deleteAll(resourceClientAssertion, names)
+}
+
+func (cli *client) gcAccessTokens(now time.Time) (int64, error) {
+	var accessTokens AccessTokenList
+	if err := cli.list(resourceAccessToken, &accessTokens); err != nil {
+		return 0, err
+	}
+	var names []string
+	for _, t := range accessTokens.AccessTokens {
+		if expired(t.Expiry, now) {
+			names = append(names, t.ObjectMeta.Name)
+		}
+	}
+	return cli.deleteAll(resourceAccessToken, names)
+}
+
+func (cli *client) gcSessions(now time.Time) (int64, error) {
+	var sessions SessionList
+	if err := cli.list(resourceSession, &sessions); err != nil {
+		return 0, err
+	}
+	var names []string
+	for _, s := range sessions.Sessions {
+		if expired(s.Expiry, now) {
+			names = append(names, s.ObjectMeta.Name)
+		}
+	}
+	return cli.deleteAll(resourceSession, names)
+}
+
+func (cli *client) gcRefreshTokens(now time.Time) (int64, error) {
+	var refreshTokens RefreshList
+	if err := cli.list(resourceRefreshToken, &refreshTokens); err != nil {
+		return 0, err
+	}
+	var names []string
+	for _, r := range refreshTokens.RefreshTokens {
+		if expired(r.Expiry, now) {
+			names = append(names, r.ObjectMeta.Name)
 		}
 	}
-	return nil
+	return cli.deleteAll(resourceRefreshToken, names)
 }
@@ -13,19 +13,31 @@ import (
 )
 
 const (
-	kindAuthCode     = "AuthCode"
-	kindAuthRequest  = "AuthRequest"
-	kindClient       = "OAuth2Client"
-	kindRefreshToken = "RefreshToken"
-	kindKeys         = "SigningKey"
+	kindAuthCode        = "AuthCode"
+	kindAuthRequest     = "AuthRequest"
+	kindClient          = "OAuth2Client"
+	kindRefreshToken    = "RefreshToken"
+	kindAccessToken     = "AccessToken"
+	kindKeys            = "SigningKey"
+	kindDeviceRequest   = "DeviceRequest"
+	kindDeviceToken     = "DeviceToken"
+	kindClientAssertion = "ClientAssertion"
+	kindSession         = "Session"
+	kindConsent         = "Consent"
 )
 
 const (
-	resourceAuthCode     = "authcodes"
-	resourceAuthRequest  = "authrequests"
-	resourceClient       = "oauth2clients"
-	resourceRefreshToken = "refreshtokens"
-	resourceKeys         = "signingkeies" // Kubernetes attempts to pluralize.
+	resourceAuthCode        = "authcodes"
+	resourceAuthRequest     = "authrequests"
+	resourceClient          = "oauth2clients"
+	resourceRefreshToken    = "refreshtokens"
+	resourceAccessToken     = "accesstokens"
+	resourceKeys            = "signingkeies" // Kubernetes attempts to pluralize.
+	resourceDeviceRequest   = "devicerequests"
+	resourceDeviceToken     = "devicetokens"
+	resourceClientAssertion = "clientassertions"
+	resourceSession         = "sessions"
+	resourceConsent         = "consents"
 )
 
 // Config values for the Kubernetes storage type.
@@ -86,22 +98,31 @@ func (cli *client) CreateAuthCode(c storage.AuthCode) error {
 }
 
 func (cli *client) CreateRefresh(r storage.Refresh) error {
-	refresh := Refresh{
-		TypeMeta: k8sapi.TypeMeta{
-			Kind:       kindRefreshToken,
-			APIVersion: cli.apiVersionForResource(resourceRefreshToken),
-		},
-		ObjectMeta: k8sapi.ObjectMeta{
-			Name:      r.RefreshToken,
-			Namespace: cli.namespace,
-		},
-		ClientID:    r.ClientID,
-		ConnectorID: r.ConnectorID,
-		Scopes:      r.Scopes,
-		Nonce:       r.Nonce,
-		Identity:    fromStorageIdentity(r.Identity),
-	}
-	return cli.post(resourceRefreshToken, refresh)
+	return cli.post(resourceRefreshToken, cli.fromStorageRefresh(r))
+}
+
+func (cli *client) CreateAccessToken(t storage.AccessToken) error {
+	return cli.post(resourceAccessToken, cli.fromStorageAccessToken(t))
+}
+
+func (cli *client) CreateDeviceRequest(d storage.DeviceRequest) error {
+	return cli.post(resourceDeviceRequest, cli.fromStorageDeviceRequest(d))
+}
+
+func (cli *client) CreateDeviceToken(t storage.DeviceToken) error {
+	return cli.post(resourceDeviceToken, cli.fromStorageDeviceToken(t))
+}
+
+func (cli *client) CreateClientAssertion(a storage.ClientAssertion) error {
+	return cli.post(resourceClientAssertion, cli.fromStorageClientAssertion(a))
+}
+
+func (cli *client) CreateSession(s storage.Session) error {
+	return cli.post(resourceSession, cli.fromStorageSession(s))
+}
+
+func (cli *client) CreateConsent(c storage.Consent) error {
+	return cli.post(resourceConsent, cli.fromStorageConsent(c))
 }
 
 func (cli *client) GetAuthRequest(id string) (storage.AuthRequest, error) {
@@ -141,22 +162,75 @@ func (cli *client) GetRefresh(id string) (storage.Refresh, error) {
 	if err := cli.get(resourceRefreshToken, id, &r); err != nil {
 		return storage.Refresh{}, err
 	}
-	return storage.Refresh{
-		RefreshToken: r.ObjectMeta.Name,
-		ClientID:     r.ClientID,
-		ConnectorID:  r.ConnectorID,
-		Scopes:       r.Scopes,
-		Nonce:        r.Nonce,
-		Identity:     toStorageIdentity(r.Identity),
-	}, nil
+	return toStorageRefresh(r), nil
+}
+
+func (cli *client) GetDeviceRequest(userCode string) (storage.DeviceRequest, error) {
+	var req DeviceRequest
+	if err := cli.get(resourceDeviceRequest, deviceRequestName(userCode), &req); err != nil {
+		return storage.DeviceRequest{}, err
+	}
+	return toStorageDeviceRequest(req), nil
+}
+
+func (cli *client) GetDeviceToken(deviceCode string) (storage.DeviceToken, error) {
+	var t DeviceToken
+	if err := cli.get(resourceDeviceToken, deviceCode, &t); err != nil {
+		return storage.DeviceToken{}, err
+	}
+	return toStorageDeviceToken(t), nil
 }
 
 func (cli *client) ListClients() ([]storage.Client, error) {
 	return nil, errors.New("not implemented")
 }
 
+func (cli *client) GetAccessToken(token string) (storage.AccessToken, error) {
+	var t AccessToken
+	if err := cli.get(resourceAccessToken, token, &t); err != nil {
+		return storage.AccessToken{}, err
+	}
+	return toStorageAccessToken(t), nil
+}
+
+func (cli *client) GetSession(id string) (storage.Session, error) {
+	var s Session
+	if err := cli.get(resourceSession, id, &s); err != nil {
+		return storage.Session{}, err
+	}
+	return toStorageSession(s), nil
+}
+
+func (cli *client) GetConsent(connectorID, userID, clientID string) (storage.Consent, error) {
+	var c Consent
+	if err := cli.get(resourceConsent, consentName(connectorID, userID, clientID), &c); err != nil {
+		return storage.Consent{}, err
+	}
+	return toStorageConsent(c), nil
+}
+
+func (cli *client) ListConsents() ([]storage.Consent, error) {
+	var list ConsentList
+	if err := cli.list(resourceConsent, &list); err != nil {
+		return nil, err
+	}
+	consents := make([]storage.Consent, len(list.Consents))
+	for i, c := range list.Consents {
+		consents[i] = toStorageConsent(c)
+	}
+	return consents, nil
+}
+
 func (cli *client) ListRefreshTokens() ([]storage.Refresh, error) {
-	return nil, errors.New("not implemented")
+	var list RefreshList
+	if err := cli.list(resourceRefreshToken, &list); err != nil {
+		return nil, err
+	}
+	tokens := make([]storage.Refresh, len(list.RefreshTokens))
+	for i, r := range list.RefreshTokens {
+		tokens[i] = toStorageRefresh(r)
+	}
+	return tokens, nil
 }
 
 func (cli *client) DeleteAuthRequest(id string) error {
@@ -175,6 +249,26 @@ func (cli *client) DeleteRefresh(id string) error {
 	return cli.delete(resourceRefreshToken, id)
 }
 
+func (cli *client) DeleteAccessToken(token string) error {
+	return cli.delete(resourceAccessToken, token)
+}
+
+func (cli *client) DeleteDeviceRequest(userCode string) error {
+	return cli.delete(resourceDeviceRequest, deviceRequestName(userCode))
+}
+
+func (cli *client) DeleteDeviceToken(deviceCode string) error {
+	return cli.delete(resourceDeviceToken, deviceCode)
+}
+
+func (cli *client) DeleteSession(id string) error {
+	return cli.delete(resourceSession, id)
+}
+
+func (cli *client) DeleteConsent(connectorID, userID, clientID string) error {
+	return cli.delete(resourceConsent, consentName(connectorID, userID, clientID))
+}
+
 func (cli *client) UpdateClient(id string, updater func(old storage.Client) (storage.Client, error)) error {
 	var c Client
 	if err := cli.get(resourceClient, id, &c); err != nil {
@@ -232,3 +326,68 @@ func (cli *client) UpdateAuthRequest(id string, updater func(a storage.AuthReque
 	newReq.ObjectMeta = req.ObjectMeta
 	return cli.put(resourceAuthRequest, id, newReq)
 }
+
+func (cli *client) UpdateDeviceToken(deviceCode string, updater func(t storage.DeviceToken) (storage.DeviceToken, error)) error {
+	var t DeviceToken
+	if err := cli.get(resourceDeviceToken, deviceCode, &t); err != nil {
+		return err
+	}
+
+	updated, err := updater(toStorageDeviceToken(t))
+	if err != nil {
+		return err
+	}
+
+	newToken := cli.fromStorageDeviceToken(updated)
+	newToken.ObjectMeta = t.ObjectMeta
+	return cli.put(resourceDeviceToken, deviceCode, newToken)
+}
+
+func (cli *client) UpdateSession(id string, updater func(s storage.Session) (storage.Session, error)) error {
+	var s Session
+	if err := cli.get(resourceSession, id, &s); err != nil {
+		return err
+	}
+
+	updated, err := updater(toStorageSession(s))
+	if err != nil {
+		return err
+	}
+
+	newSession := cli.fromStorageSession(updated)
+	newSession.ObjectMeta = s.ObjectMeta
+	return cli.put(resourceSession, id, newSession)
+}
+
+func (cli *client) UpdateRefresh(id string, updater func(r storage.Refresh) (storage.Refresh, error)) error {
+	var r Refresh
+	if err := cli.get(resourceRefreshToken, id, &r); err != nil {
+		return err
+	}
+
+	updated, err := updater(toStorageRefresh(r))
+	if err != nil {
+		return err
+	}
+
+	newRefresh := cli.fromStorageRefresh(updated)
+	newRefresh.ObjectMeta = r.ObjectMeta
+	return cli.put(resourceRefreshToken, id, newRefresh)
+}
+
+func (cli *client) UpdateConsent(connectorID, userID, clientID string, updater func(c storage.Consent) (storage.Consent, error)) error {
+	name := consentName(connectorID, userID, clientID)
+	var c Consent
+	if err := cli.get(resourceConsent, name, &c); err != nil {
+		return err
+	}
+
+	updated, err := updater(toStorageConsent(c))
+	if err != nil {
+		return err
+	}
+
+	newConsent := cli.fromStorageConsent(updated)
+	newConsent.ObjectMeta = c.ObjectMeta
+	return cli.put(resourceConsent, name, newConsent)
+}
@@ -1,6 +1,9 @@
 package kubernetes
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
 	"time"
 
 	jose "gopkg.in/square/go-jose.v2"
@@ -21,14 +24,54 @@ type Client struct {
 
 	Secret       string   `json:"secret,omitempty"`
 	RedirectURIs []string `json:"redirectURIs,omitempty"`
+
+	PostLogoutRedirectURIs []string `json:"postLogoutRedirectURIs,omitempty"`
+	BackchannelLogoutURI   string   `json:"backchannelLogoutURI,omitempty"`
+
+	BackchannelLogoutSessionRequired bool                     `json:"backchannelLogoutSessionRequired,omitempty"`
+	BackchannelLogoutStatus          *BackchannelLogoutStatus `json:"backchannelLogoutStatus,omitempty"`
+
+	RequestURIs []string `json:"requestURIs,omitempty"`
+
 	TrustedPeers []string `json:"trustedPeers,omitempty"`
 
 	Public bool `json:"public"`
 
+	TokenEndpointAuthMethod string `json:"tokenEndpointAuthMethod,omitempty"`
+
+	RequirePKCE bool `json:"requirePKCE,omitempty"`
+
+	RequirePushedAuthorizationRequests bool `json:"requirePushedAuthorizationRequests,omitempty"`
+
+	RefreshTokenIdleTimeout      time.Duration `json:"refreshTokenIdleTimeout,omitempty"`
+	RefreshTokenAbsoluteLifetime time.Duration `json:"refreshTokenAbsoluteLifetime,omitempty"`
+
+	AllowedScopes []string `json:"allowedScopes,omitempty"`
+
+	AllowPasswordGrant bool `json:"allowPasswordGrant,omitempty"`
+
+	JWKS    *jose.JSONWebKeySet `json:"jwks,omitempty"`
+	JWKSURI string              `json:"jwksURI,omitempty"`
+
+	UserInfoSignedResponseAlg string `json:"userInfoSignedResponseAlg,omitempty"`
+
+	JWTAccessTokens  bool     `json:"jwtAccessTokens,omitempty"`
+	AllowedResources []string `json:"allowedResources,omitempty"`
+
+	RegistrationAccessToken string `json:"registrationAccessToken,omitempty"`
+
 	Name    string `json:"name,omitempty"`
 	LogoURL string `json:"logoURL,omitempty"`
 }
 
+// BackchannelLogoutStatus is a mirrored struct from storage with JSON struct
+// tags.
+type BackchannelLogoutStatus struct {
+	Time     time.Time `json:"time"`
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error,omitempty"`
+}
+
 // ClientList is a list of Clients.
 type ClientList struct {
 	k8sapi.TypeMeta `json:",inline"`
@@ -37,7 +80,7 @@ type ClientList struct {
 }
 
 func (cli *client) fromStorageClient(c storage.Client) Client {
-	return Client{
+	k := Client{
 		TypeMeta: k8sapi.TypeMeta{
 			Kind:       kindClient,
 			APIVersion: cli.apiVersionForResource(resourceClient),
@@ -46,25 +89,77 @@ func (cli *client) fromStorageClient(c storage.Client) Client {
 			Name:      c.ID,
 			Namespace: cli.namespace,
 		},
-		Secret:       c.Secret,
-		RedirectURIs: c.RedirectURIs,
-		TrustedPeers: c.TrustedPeers,
-		Public:       c.Public,
-		Name:         c.Name,
-		LogoURL:      c.LogoURL,
+		Secret:                    c.Secret,
+		RedirectURIs:              c.RedirectURIs,
+		PostLogoutRedirectURIs:    c.PostLogoutRedirectURIs,
+		BackchannelLogoutURI:      c.BackchannelLogoutURI,
+		RequestURIs:               c.RequestURIs,
+		TrustedPeers:              c.TrustedPeers,
+		Public:                    c.Public,
+		TokenEndpointAuthMethod:   c.TokenEndpointAuthMethod,
+		RequirePKCE:               c.RequirePKCE,
+		AllowedScopes:             c.AllowedScopes,
+		AllowPasswordGrant:        c.AllowPasswordGrant,
+		JWKS:                      c.JWKS,
+		JWKSURI:                   c.JWKSURI,
+		UserInfoSignedResponseAlg: c.UserInfoSignedResponseAlg,
+		JWTAccessTokens:           c.JWTAccessTokens,
+		AllowedResources:          c.AllowedResources,
+		RegistrationAccessToken:   c.RegistrationAccessToken,
+		Name:                      c.Name,
+		LogoURL:                   c.LogoURL,
+
+		RequirePushedAuthorizationRequests: c.RequirePushedAuthorizationRequests,
+		RefreshTokenIdleTimeout:            c.RefreshTokenIdleTimeout,
+		RefreshTokenAbsoluteLifetime:       c.RefreshTokenAbsoluteLifetime,
+		BackchannelLogoutSessionRequired:   c.BackchannelLogoutSessionRequired,
+	}
+	if status := c.BackchannelLogoutStatus; status != nil {
+		k.BackchannelLogoutStatus = &BackchannelLogoutStatus{
+			Time:     status.Time,
+			Attempts: status.Attempts,
+			Error:    status.Error,
+		}
 	}
+	return k
 }
 
 func toStorageClient(c Client) storage.Client {
-	return storage.Client{
-		ID:           c.ObjectMeta.Name,
-		Secret:       c.Secret,
-		RedirectURIs: c.RedirectURIs,
-		TrustedPeers: c.TrustedPeers,
-		Public:       c.Public,
-		Name:         c.Name,
-		LogoURL:      c.LogoURL,
+	s := storage.Client{
+		ID:                        c.ObjectMeta.Name,
+		Secret:                    c.Secret,
+		RedirectURIs:              c.RedirectURIs,
+		PostLogoutRedirectURIs:    c.PostLogoutRedirectURIs,
+		BackchannelLogoutURI:      c.BackchannelLogoutURI,
+		RequestURIs:               c.RequestURIs,
+		TrustedPeers:              c.TrustedPeers,
+		Public:                    c.Public,
+		TokenEndpointAuthMethod:   c.TokenEndpointAuthMethod,
+		RequirePKCE:               c.RequirePKCE,
+		AllowedScopes:             c.AllowedScopes,
+		AllowPasswordGrant:        c.AllowPasswordGrant,
+		JWKS:                      c.JWKS,
+		JWKSURI:                   c.JWKSURI,
+		UserInfoSignedResponseAlg: c.UserInfoSignedResponseAlg,
+		JWTAccessTokens:           c.JWTAccessTokens,
+		AllowedResources:          c.AllowedResources,
+		RegistrationAccessToken:   c.RegistrationAccessToken,
+		Name:                      c.Name,
+		LogoURL:                   c.LogoURL,
+
+		RequirePushedAuthorizationRequests: c.RequirePushedAuthorizationRequests,
+		RefreshTokenIdleTimeout:            c.RefreshTokenIdleTimeout,
+		RefreshTokenAbsoluteLifetime:       c.RefreshTokenAbsoluteLifetime,
+		BackchannelLogoutSessionRequired:   c.BackchannelLogoutSessionRequired,
+	}
+	if status := c.BackchannelLogoutStatus; status != nil {
+		s.BackchannelLogoutStatus = &storage.BackchannelLogoutStatus{
+			Time:     status.Time,
+			Attempts: status.Attempts,
+			Error:    status.Error,
+		}
 	}
+	return s
 }
 
 // Identity is a mirrored struct from storage with JSON struct tags.
@@ -75,6 +170,13 @@ type Identity struct {
 	EmailVerified bool     `json:"emailVerified"`
 	Groups        []string `json:"groups,omitempty"`
 
+	Claims map[string]interface{} `json:"claims,omitempty"`
+
+	AuthTime time.Time `json:"authTime"`
+	ACR      string    `json:"acr,omitempty"`
+
+	SessionID string `json:"sessionID,omitempty"`
+
 	ConnectorData []byte `json:"connectorData,omitempty"`
 }
 
@@ -85,6 +187,10 @@ func fromStorageIdentity(i storage.Identity) Identity {
 		Email:         i.Email,
 		EmailVerified: i.EmailVerified,
 		Groups:        i.Groups,
+		Claims:        i.Claims,
+		AuthTime:      i.AuthTime,
+		ACR:           i.ACR,
+		SessionID:     i.SessionID,
 		ConnectorData: i.ConnectorData,
 	}
 }
@@ -96,6 +202,10 @@ func toStorageIdentity(i Identity) storage.Identity {
 		Email:         i.Email,
 		EmailVerified: i.EmailVerified,
 		Groups:        i.Groups,
+		Claims:        i.Claims,
+		AuthTime:      i.AuthTime,
+		ACR:           i.ACR,
+		SessionID:     i.SessionID,
 		ConnectorData: i.ConnectorData,
 	}
 }
@@ -110,21 +220,34 @@ type AuthRequest struct {
 	ResponseTypes []string `json:"responseTypes,omitempty"`
 	Scopes        []string `json:"scopes,omitempty"`
 	RedirectURI   string   `json:"redirectURI"`
+	ResponseMode  string   `json:"responseMode,omitempty"`
 
 	Nonce string `json:"nonce,omitempty"`
 	State string `json:"state,omitempty"`
 
+	CodeChallenge       string `json:"codeChallenge,omitempty"`
+	CodeChallengeMethod string `json:"codeChallengeMethod,omitempty"`
+
 	// The client has indicated that the end user must be shown an approval prompt
 	// on all requests. The server cannot cache their initial action for subsequent
 	// attempts.
 	ForceApprovalPrompt bool `json:"forceApprovalPrompt,omitempty"`
 
+	ForceLogin bool `json:"forceLogin,omitempty"`
+	MaxAge     int  `json:"maxAge,omitempty"`
+	PromptNone bool `json:"promptNone,omitempty"`
+
+	LoginHint string   `json:"loginHint,omitempty"`
+	ACRValues []string `json:"acrValues,omitempty"`
+
 	// The identity of the end user. Generally nil until the user authenticates
 	// with a backend.
 	Identity *Identity `json:"identity,omitempty"`
 	// The connector used to login the user. Set when the user authenticates.
 	ConnectorID string `json:"connectorID,omitempty"`
 
+	Pushed bool `json:"pushed,omitempty"`
+
 	Expiry time.Time `json:"expiry"`
 }
 
@@ -142,10 +265,19 @@ func toStorageAuthRequest(req AuthRequest) storage.AuthRequest {
 		ResponseTypes:       req.ResponseTypes,
 		Scopes:              req.Scopes,
 		RedirectURI:         req.RedirectURI,
+		ResponseMode:        req.ResponseMode,
 		Nonce:               req.Nonce,
 		State:               req.State,
+		CodeChallenge:       req.CodeChallenge,
+		CodeChallengeMethod: req.CodeChallengeMethod,
 		ForceApprovalPrompt: req.ForceApprovalPrompt,
+		ForceLogin:          req.ForceLogin,
+		MaxAge:              req.MaxAge,
+		PromptNone:          req.PromptNone,
+		LoginHint:           req.LoginHint,
+		ACRValues:           req.ACRValues,
 		ConnectorID:         req.ConnectorID,
+		Pushed:              req.Pushed,
 		Expiry:              req.Expiry,
 	}
 	if req.Identity != nil {
@@ -169,10 +301,19 @@ func (cli *client) fromStorageAuthRequest(a storage.AuthRequest) AuthRequest {
 		ResponseTypes:       a.ResponseTypes,
 		Scopes:              a.Scopes,
 		RedirectURI:         a.RedirectURI,
+		ResponseMode:        a.ResponseMode,
 		Nonce:               a.Nonce,
 		State:               a.State,
+		CodeChallenge:       a.CodeChallenge,
+		CodeChallengeMethod: a.CodeChallengeMethod,
 		ForceApprovalPrompt: a.ForceApprovalPrompt,
+		ForceLogin:          a.ForceLogin,
+		MaxAge:              a.MaxAge,
+		PromptNone:          a.PromptNone,
+		LoginHint:           a.LoginHint,
+		ACRValues:           a.ACRValues,
 		ConnectorID:         a.ConnectorID,
+		Pushed:              a.Pushed,
 		Expiry:              a.Expiry,
 	}
 	if a.Identity != nil {
@@ -195,6 +336,9 @@ type AuthCode struct {
 	Nonce string `json:"nonce,omitempty"`
 	State string `json:"state,omitempty"`
 
+	CodeChallenge       string `json:"codeChallenge,omitempty"`
+	CodeChallengeMethod string `json:"codeChallengeMethod,omitempty"`
+
 	Identity    Identity `json:"identity,omitempty"`
 	ConnectorID string   `json:"connectorID,omitempty"`
 
@@ -225,6 +369,9 @@ func (cli *client) fromStorageAuthCode(a storage.AuthCode) AuthCode {
 		Scopes:      a.Scopes,
 		Identity:    fromStorageIdentity(a.Identity),
 		Expiry:      a.Expiry,
+
+		CodeChallenge:       a.CodeChallenge,
+		CodeChallengeMethod: a.CodeChallengeMethod,
 	}
 }
 
@@ -238,6 +385,9 @@ func toStorageAuthCode(a AuthCode) storage.AuthCode {
 		Scopes:      a.Scopes,
 		Identity:    toStorageIdentity(a.Identity),
 		Expiry:      a.Expiry,
+
+		CodeChallenge:       a.CodeChallenge,
+		CodeChallengeMethod: a.CodeChallengeMethod,
 	}
 }
 
@@ -254,6 +404,14 @@ type Refresh struct {
 
 	Identity    Identity `json:"identity,omitempty"`
 	ConnectorID string   `json:"connectorID,omitempty"`
+
+	FamilyID   string    `json:"familyID,omitempty"`
+	RotatedAt  time.Time `json:"rotatedAt,omitempty"`
+	ReplacedBy string    `json:"replacedBy,omitempty"`
+
+	CreatedAt time.Time `json:"createdAt,omitempty"`
+	LastUsed  time.Time `json:"lastUsed,omitempty"`
+	Expiry    time.Time `json:"expiry,omitempty"`
 }
 
 // RefreshList is a list of refresh tokens.
@@ -263,6 +421,262 @@ type RefreshList struct {
 	RefreshTokens   []Refresh `json:"items"`
 }
 
+func (cli *client) fromStorageRefresh(r storage.Refresh) Refresh {
+	return Refresh{
+		TypeMeta: k8sapi.TypeMeta{
+			Kind:       kindRefreshToken,
+			APIVersion: cli.apiVersionForResource(resourceRefreshToken),
+		},
+		ObjectMeta: k8sapi.ObjectMeta{
+			Name:      r.RefreshToken,
+			Namespace: cli.namespace,
+		},
+		ClientID:    r.ClientID,
+		ConnectorID: r.ConnectorID,
+		Scopes:      r.Scopes,
+		Nonce:       r.Nonce,
+		Identity:    fromStorageIdentity(r.Identity),
+		FamilyID:    r.FamilyID,
+		RotatedAt:   r.RotatedAt,
+		ReplacedBy:  r.ReplacedBy,
+		CreatedAt:   r.CreatedAt,
+		LastUsed:    r.LastUsed,
+		Expiry:      r.Expiry,
+	}
+}
+
+func toStorageRefresh(r Refresh) storage.Refresh {
+	return storage.Refresh{
+		RefreshToken: r.ObjectMeta.Name,
+		ClientID:     r.ClientID,
+		ConnectorID:  r.ConnectorID,
+		Scopes:       r.Scopes,
+		Nonce:        r.Nonce,
+		Identity:     toStorageIdentity(r.Identity),
+		FamilyID:     r.FamilyID,
+		RotatedAt:    r.RotatedAt,
+		ReplacedBy:   r.ReplacedBy,
+		CreatedAt:    r.CreatedAt,
+		LastUsed:     r.LastUsed,
+		Expiry:       r.Expiry,
+	}
+}
+
+// AccessToken is a mirrored struct from storage with JSON struct tags and
+// Kubernetes type metadata.
+type AccessToken struct {
+	k8sapi.TypeMeta   `json:",inline"`
+	k8sapi.ObjectMeta `json:"metadata,omitempty"`
+
+	ClientID    string   `json:"clientID"`
+	ConnectorID string   `json:"connectorID,omitempty"`
+	Scopes      []string `json:"scopes,omitempty"`
+	Resource    string   `json:"resource,omitempty"`
+
+	Identity Identity `json:"identity,omitempty"`
+
+	Expiry time.Time `json:"expiry"`
+}
+
+// AccessTokenList is a list of access tokens.
+type AccessTokenList struct {
+	k8sapi.TypeMeta `json:",inline"`
+	k8sapi.ListMeta `json:"metadata,omitempty"`
+	AccessTokens    []AccessToken `json:"items"`
+}
+
+func (cli *client) fromStorageAccessToken(t storage.AccessToken) AccessToken {
+	return AccessToken{
+		TypeMeta: k8sapi.TypeMeta{
+			Kind:       kindAccessToken,
+			APIVersion: cli.apiVersionForResource(resourceAccessToken),
+		},
+		ObjectMeta: k8sapi.ObjectMeta{
+			Name:      t.Token,
+			Namespace: cli.namespace,
+		},
+		ClientID:    t.ClientID,
+		ConnectorID: t.ConnectorID,
+		Scopes:      t.Scopes,
+		Resource:    t.Resource,
+		Identity:    fromStorageIdentity(t.Identity),
+		Expiry:      t.Expiry,
+	}
+}
+
+func toStorageAccessToken(t AccessToken) storage.AccessToken {
+	return storage.AccessToken{
+		Token:       t.ObjectMeta.Name,
+		ClientID:    t.ClientID,
+		ConnectorID: t.ConnectorID,
+		Scopes:      t.Scopes,
+		Resource:    t.Resource,
+		Identity:    toStorageIdentity(t.Identity),
+		Expiry:      t.Expiry,
+	}
+}
+
+// Session is a mirrored struct from storage with JSON struct tags and
+// Kubernetes type metadata.
+type Session struct {
+	k8sapi.TypeMeta   `json:",inline"`
+	k8sapi.ObjectMeta `json:"metadata,omitempty"`
+
+	ConnectorID string   `json:"connectorID"`
+	Identity    Identity `json:"identity"`
+
+	Clients []string `json:"clients,omitempty"`
+
+	CreatedAt time.Time `json:"createdAt"`
+	LastUsed  time.Time `json:"lastUsed"`
+	Expiry    time.Time `json:"expiry"`
+}
+
+// SessionList is a list of Sessions.
+type SessionList struct {
+	k8sapi.TypeMeta `json:",inline"`
+	k8sapi.ListMeta `json:"metadata,omitempty"`
+	Sessions        []Session `json:"items"`
+}
+
+func (cli *client) fromStorageSession(s storage.Session) Session {
+	return Session{
+		TypeMeta: k8sapi.TypeMeta{
+			Kind:       kindSession,
+			APIVersion: cli.apiVersionForResource(resourceSession),
+		},
+		ObjectMeta: k8sapi.ObjectMeta{
+			Name:      s.ID,
+			Namespace: cli.namespace,
+		},
+		ConnectorID: s.ConnectorID,
+		Identity:    fromStorageIdentity(s.Identity),
+		Clients:     s.Clients,
+		CreatedAt:   s.CreatedAt,
+		LastUsed:    s.LastUsed,
+		Expiry:      s.Expiry,
+	}
+}
+
+func toStorageSession(s Session) storage.Session {
+	return storage.Session{
+		ID:          s.ObjectMeta.Name,
+		ConnectorID: s.ConnectorID,
+		Identity:    toStorageIdentity(s.Identity),
+		Clients:     s.Clients,
+		CreatedAt:   s.CreatedAt,
+		LastUsed:    s.LastUsed,
+		Expiry:      s.Expiry,
+	}
+}
+
+// DeviceRequest is a mirrored struct from storage with JSON struct tags and
+// Kubernetes type metadata.
+type DeviceRequest struct {
+	k8sapi.TypeMeta   `json:",inline"`
+	k8sapi.ObjectMeta `json:"metadata,omitempty"`
+
+	DeviceCode string   `json:"deviceCode"`
+	ClientID   string   `json:"clientID"`
+	Scopes     []string `json:"scopes,omitempty"`
+
+	Expiry time.Time `json:"expiry"`
+}
+
+// DeviceRequestList is a list of DeviceRequests.
+type DeviceRequestList struct {
+	k8sapi.TypeMeta `json:",inline"`
+	k8sapi.ListMeta `json:"metadata,omitempty"`
+	DeviceRequests  []DeviceRequest `json:"items"`
+}
+
+// User codes are upper case, but Kubernetes only allows lower case letters
+// for names.
+func deviceRequestName(userCode string) string {
+	return strings.ToLower(userCode)
+}
+
+func (cli *client) fromStorageDeviceRequest(d storage.DeviceRequest) DeviceRequest {
+	return DeviceRequest{
+		TypeMeta: k8sapi.TypeMeta{
+			Kind:       kindDeviceRequest,
+			APIVersion: cli.apiVersionForResource(resourceDeviceRequest),
+		},
+		ObjectMeta: k8sapi.ObjectMeta{
+			Name:      deviceRequestName(d.UserCode),
+			Namespace: cli.namespace,
+		},
+		DeviceCode: d.DeviceCode,
+		ClientID:   d.ClientID,
+		Scopes:     d.Scopes,
+		Expiry:     d.Expiry,
+	}
+}
+
+func toStorageDeviceRequest(d DeviceRequest) storage.DeviceRequest {
+	return storage.DeviceRequest{
+		UserCode:   strings.ToUpper(d.ObjectMeta.Name),
+		DeviceCode: d.DeviceCode,
+		ClientID:   d.ClientID,
+		Scopes:     d.Scopes,
+		Expiry:     d.Expiry,
+	}
+}
+
+// DeviceToken is a mirrored struct from storage with JSON struct tags and
+// Kubernetes type metadata.
+type DeviceToken struct {
+	k8sapi.TypeMeta   `json:",inline"`
+	k8sapi.ObjectMeta `json:"metadata,omitempty"`
+
+	ClientID string `json:"clientID"`
+	Status   string `json:"status"`
+	Token    string `json:"token,omitempty"`
+
+	LastRequestTime time.Time     `json:"lastRequestTime"`
+	PollInterval    time.Duration `json:"pollInterval"`
+
+	Expiry time.Time `json:"expiry"`
+}
+
+// DeviceTokenList is a list of DeviceTokens.
+type DeviceTokenList struct {
+	k8sapi.TypeMeta `json:",inline"`
+	k8sapi.ListMeta `json:"metadata,omitempty"`
+	DeviceTokens    []DeviceToken `json:"items"`
+}
+
+func (cli *client) fromStorageDeviceToken(t storage.DeviceToken) DeviceToken {
+	return DeviceToken{
+		TypeMeta: k8sapi.TypeMeta{
+			Kind:       kindDeviceToken,
+			APIVersion: cli.apiVersionForResource(resourceDeviceToken),
+		},
+		ObjectMeta: k8sapi.ObjectMeta{
+			Name:      t.DeviceCode,
+			Namespace: cli.namespace,
+		},
+		ClientID:        t.ClientID,
+		Status:          t.Status,
+		Token:           t.Token,
+		LastRequestTime: t.LastRequestTime,
+		PollInterval:    t.PollInterval,
+		Expiry:          t.Expiry,
+	}
+}
+
+func toStorageDeviceToken(t DeviceToken) storage.DeviceToken {
+	return storage.DeviceToken{
+		DeviceCode:      t.ObjectMeta.Name,
+		ClientID:        t.ClientID,
+		Status:          t.Status,
+		Token:           t.Token,
+		LastRequestTime: t.LastRequestTime,
+		PollInterval:    t.PollInterval,
+		Expiry:          t.Expiry,
+	}
+}
+
 // Keys is a mirrored struct from storage with JSON struct tags and Kubernetes
 // type metadata.
 type Keys struct {
@@ -307,3 +721,101 @@ func toStorageKeys(keys Keys) storage.Keys {
 		NextRotation:     keys.NextRotation,
 	}
 }
+
+// ClientAssertion is a mirrored struct from storage with JSON struct tags and
+// Kubernetes type metadata.
+type ClientAssertion struct {
+	k8sapi.TypeMeta   `json:",inline"`
+	k8sapi.ObjectMeta `json:"metadata,omitempty"`
+
+	ClientID string `json:"clientID"`
+	JTI      string `json:"jti"`
+
+	Expiry time.Time `json:"expiry"`
+}
+
+// ClientAssertionList is a list of ClientAssertions.
+type ClientAssertionList struct {
+	k8sapi.TypeMeta  `json:",inline"`
+	k8sapi.ListMeta  `json:"metadata,omitempty"`
+	ClientAssertions []ClientAssertion `json:"items"`
+}
+
+// JTIs can hold arbitrary characters, so client assertions are named by a hash
+// of the client ID and JTI. This also makes the name unique per client.
+func clientAssertionName(clientID, jti string) string {
+	h := sha256.Sum256([]byte(clientID + "\x00" + jti))
+	return hex.EncodeToString(h[:])
+}
+
+func (cli *client) fromStorageClientAssertion(a storage.ClientAssertion) ClientAssertion {
+	return ClientAssertion{
+		TypeMeta: k8sapi.TypeMeta{
+			Kind:       kindClientAssertion,
+			APIVersion: cli.apiVersionForResource(resourceClientAssertion),
+		},
+		ObjectMeta: k8sapi.ObjectMeta{
+			Name:      clientAssertionName(a.ClientID, a.JTI),
+			Namespace: cli.namespace,
+		},
+		ClientID: a.ClientID,
+		JTI:      a.JTI,
+		Expiry:   a.Expiry,
+	}
+}
+
+// Consent is a mirrored struct from storage with JSON struct tags and Kubernetes
+// type metadata.
+type Consent struct {
+	k8sapi.TypeMeta   `json:",inline"`
+	k8sapi.ObjectMeta `json:"metadata,omitempty"`
+
+	ConnectorID string   `json:"connectorID"`
+	UserID      string   `json:"userID"`
+	ClientID    string   `json:"clientID"`
+	Scopes      []string `json:"scopes,omitempty"`
+
+	LastUpdated time.Time `json:"lastUpdated"`
+}
+
+// ConsentList is a list of Consents.
+type ConsentList struct {
+	k8sapi.TypeMeta `json:",inline"`
+	k8sapi.ListMeta `json:"metadata,omitempty"`
+	Consents        []Consent `json:"items"`
+}
+
+// User IDs can hold arbitrary characters, so consents are named by a hash of
+// the connector ID, user ID and client ID.
+func consentName(connectorID, userID, clientID string) string {
+	h := sha256.Sum256([]byte(connectorID + "\x00" + userID + "\x00" + clientID))
+	return hex.EncodeToString(h[:])
+}
+
+func (cli *client) fromStorageConsent(c storage.Consent) Consent {
+	return Consent{
+		TypeMeta: k8sapi.TypeMeta{
+			Kind:       kindConsent,
+			APIVersion: cli.apiVersionForResource(resourceConsent),
+		},
+		ObjectMeta: k8sapi.ObjectMeta{
+			Name:      consentName(c.ConnectorID, c.UserID, c.ClientID),
+			Namespace: cli.namespace,
+		},
+		ConnectorID: c.ConnectorID,
+		UserID:      c.UserID,
+		ClientID:    c.ClientID,
+		Scopes:      c.Scopes,
+		LastUpdated: c.LastUpdated,
+	}
+}
+
+func toStorageConsent(c Consent) storage.Consent {
+	return storage.Consent{
+		ConnectorID: c.ConnectorID,
+		UserID:      c.UserID,
+		ClientID:    c.ClientID,
+		Scopes:      c.Scopes,
+		LastUpdated: c.LastUpdated,
+	}
+}
@@ -4,6 +4,7 @@ package memory
 import (
 	"errors"
 	"sync"
+	"time"
 
 	"github.com/ericchiang/poke/storage"
 )
@@ -18,7 +19,13 @@ func New() storage.Storage {
 		clients:       make(map[string]storage.Client),
 		authCodes:     make(map[string]storage.AuthCode),
 		refreshTokens: make(map[string]storage.Refresh),
+		accessTokens:  make(map[string]storage.AccessToken),
 		authReqs:      make(map[string]storage.AuthRequest),
+		deviceReqs:    make(map[string]storage.DeviceRequest),
+		deviceTokens:  make(map[string]storage.DeviceToken),
+		assertions:    make(map[assertionKey]storage.ClientAssertion),
+		sessions:      make(map[string]storage.Session),
+		consents:      make(map[consentKey]storage.Consent),
 	}
 }
 
@@ -37,21 +44,99 @@ type memStorage struct {
 	clients       map[string]storage.Client
 	authCodes     map[string]storage.AuthCode
 	refreshTokens map[string]storage.Refresh
+	accessTokens  map[string]storage.AccessToken
 	authReqs      map[string]storage.AuthRequest
+	deviceReqs    map[string]storage.DeviceRequest
+	deviceTokens  map[string]storage.DeviceToken
+	assertions    map[assertionKey]storage.ClientAssertion
+	sessions      map[string]storage.Session
+	consents      map[consentKey]storage.Consent
 
 	keys storage.Keys
 }
 
+// Client assertions are unique per client, not globally.
+type assertionKey struct {
+	clientID string
+	jti      string
+}
+
+// Consents are unique per end user and client.
+type consentKey struct {
+	connectorID string
+	userID      string
+	clientID    string
+}
+
+func keyForConsent(c storage.Consent) consentKey {
+	return consentKey{c.ConnectorID, c.UserID, c.ClientID}
+}
+
 func (s *memStorage) tx(f func()) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	f()
 }
 
-var errAlreadyExists = errors.New("already exists")
-
 func (s *memStorage) Close() error { return nil }
 
+func (s *memStorage) GarbageCollect(now time.Time) (result storage.GCResult, err error) {
+	expired := func(expiry time.Time) bool {
+		return !expiry.IsZero() && now.After(expiry)
+	}
+	s.tx(func() {
+		for id, a := range s.authReqs {
+			if expired(a.Expiry) {
+				delete(s.authReqs, id)
+				result.AuthRequests++
+			}
+		}
+		for id, c := range s.authCodes {
+			if expired(c.Expiry) {
+				delete(s.authCodes, id)
+				result.AuthCodes++
+			}
+		}
+		for userCode, d := range s.deviceReqs {
+			if expired(d.Expiry) {
+				delete(s.deviceReqs, userCode)
+				result.DeviceRequests++
+			}
+		}
+		for deviceCode, t := range s.deviceTokens {
+			if expired(t.Expiry) {
+				delete(s.deviceTokens, deviceCode)
+				result.DeviceTokens++
+			}
+		}
+		for key, a := range s.assertions {
+			if expired(a.Expiry) {
+				delete(s.assertions, key)
+				result.ClientAssertions++
+			}
+		}
+		for token, t := range s.accessTokens {
+			if expired(t.Expiry) {
+				delete(s.accessTokens, token)
+				result.AccessTokens++
+			}
+		}
+		for id, session := range s.sessions {
+			if expired(session.Expiry) {
+				delete(s.sessions, id)
+				result.Sessions++
+			}
+		}
+		for id, r := range s.refreshTokens {
+			if expired(r.Expiry) {
+				delete(s.refreshTokens, id)
+				result.RefreshTokens++
+			}
+		}
+	})
+	return result, nil
+}
+
 func (s *memStorage) CreateClient(c storage.Client) error {
 	s.tx(func() { s.clients[c.ID] = c })
 	return nil
@@ -67,11 +152,55 @@ func (s *memStorage) CreateRefresh(r storage.Refresh) error {
 	return nil
 }
 
+func (s *memStorage) CreateAccessToken(t storage.AccessToken) error {
+	s.tx(func() { s.accessTokens[t.Token] = t })
+	return nil
+}
+
 func (s *memStorage) CreateAuthRequest(a storage.AuthRequest) error {
 	s.tx(func() { s.authReqs[a.ID] = a })
 	return nil
 }
 
+func (s *memStorage) CreateDeviceRequest(d storage.DeviceRequest) error {
+	s.tx(func() { s.deviceReqs[d.UserCode] = d })
+	return nil
+}
+
+func (s *memStorage) CreateDeviceToken(t storage.DeviceToken) error {
+	s.tx(func() { s.deviceTokens[t.DeviceCode] = t })
+	return nil
+}
+
+func (s *memStorage) CreateSession(session storage.Session) error {
+	s.tx(func() { s.sessions[session.ID] = session })
+	return nil
+}
+
+func (s *memStorage) CreateConsent(c storage.Consent) (err error) {
+	s.tx(func() {
+		key := keyForConsent(c)
+		if _, ok := s.consents[key]; ok {
+			err = storage.ErrAlreadyExists
+			return
+		}
+		s.consents[key] = c
+	})
+	return
+}
+
+func (s *memStorage) CreateClientAssertion(a storage.ClientAssertion) (err error) {
+	s.tx(func() {
+		key := assertionKey{a.ClientID, a.JTI}
+		if _, ok := s.assertions[key]; ok {
+			err = storage.ErrAlreadyExists
+			return
+		}
+		s.assertions[key] = a
+	})
+	return
+}
+
 func (s *memStorage) GetClient(id string) (client storage.Client, err error) {
 	s.tx(func() {
 		var ok bool
@@ -109,6 +238,28 @@ func (s *memStorage) GetAuthRequest(id string) (req storage.AuthRequest, err err
 	return
 }
 
+func (s *memStorage) GetDeviceRequest(userCode string) (req storage.DeviceRequest, err error) {
+	s.tx(func() {
+		var ok bool
+		if req, ok = s.deviceReqs[userCode]; !ok {
+			err = storage.ErrNotFound
+			return
+		}
+	})
+	return
+}
+
+func (s *memStorage) GetDeviceToken(deviceCode string) (tok storage.DeviceToken, err error) {
+	s.tx(func() {
+		var ok bool
+		if tok, ok = s.deviceTokens[deviceCode]; !ok {
+			err = storage.ErrNotFound
+			return
+		}
+	})
+	return
+}
+
 func (s *memStorage) ListClients() (clients []storage.Client, err error) {
 	s.tx(func() {
 		for _, client := range s.clients {
@@ -138,6 +289,45 @@ func (s *memStorage) DeleteClient(id string) (err error) {
 	return
 }
 
+func (s *memStorage) GetAccessToken(token string) (tok storage.AccessToken, err error) {
+	s.tx(func() {
+		var ok bool
+		if tok, ok = s.accessTokens[token]; !ok {
+			err = storage.ErrNotFound
+		}
+	})
+	return
+}
+
+func (s *memStorage) GetSession(id string) (session storage.Session, err error) {
+	s.tx(func() {
+		var ok bool
+		if session, ok = s.sessions[id]; !ok {
+			err = storage.ErrNotFound
+		}
+	})
+	return
+}
+
+func (s *memStorage) GetConsent(connectorID, userID, clientID string) (c storage.Consent, err error) {
+	s.tx(func() {
+		var ok bool
+		if c, ok = s.consents[consentKey{connectorID, userID, clientID}]; !ok {
+			err = storage.ErrNotFound
+		}
+	})
+	return
+}
+
+func (s *memStorage) ListConsents() (consents []storage.Consent, err error) {
+	s.tx(func() {
+		for _, c := range s.consents {
+			consents = append(consents, c)
+		}
+	})
+	return
+}
+
 func (s *memStorage) DeleteRefresh(token string) (err error) {
 	s.tx(func() {
 		if _, ok := s.refreshTokens[token]; !ok {
@@ -171,6 +361,62 @@ func (s *memStorage) DeleteAuthRequest(id string) (err error) {
 	return
 }
 
+func (s *memStorage) DeleteAccessToken(token string) (err error) {
+	s.tx(func() {
+		if _, ok := s.accessTokens[token]; !ok {
+			err = storage.ErrNotFound
+			return
+		}
+		delete(s.accessTokens, token)
+	})
+	return
+}
+
+func (s *memStorage) DeleteSession(id string) (err error) {
+	s.tx(func() {
+		if _, ok := s.sessions[id]; !ok {
+			err = storage.ErrNotFound
+			return
+		}
+		delete(s.sessions, id)
+	})
+	return
+}
+
+func (s *memStorage) DeleteConsent(connectorID, userID, clientID string) (err error) {
+	s.tx(func() {
+		key := consentKey{connectorID, userID, clientID}
+		if _, ok := s.consents[key]; !ok {
+			err = storage.ErrNotFound
+			return
+		}
+		delete(s.consents, key)
+	})
+	return
+}
+
+func (s *memStorage) DeleteDeviceRequest(userCode string) (err error) {
+	s.tx(func() {
+		if _, ok := s.deviceReqs[userCode]; !ok {
+			err = storage.ErrNotFound
+			return
+		}
+		delete(s.deviceReqs, userCode)
+	})
+	return
+}
+
+func (s *memStorage) DeleteDeviceToken(deviceCode string) (err error) {
+	s.tx(func() {
+		if _, ok := s.deviceTokens[deviceCode]; !ok {
+			err = storage.ErrNotFound
+			return
+		}
+		delete(s.deviceTokens, deviceCode)
+	})
+	return
+}
+
 func (s *memStorage) GetAuthCode(id string) (c storage.AuthCode, err error) {
 	s.tx(func() {
 		var ok bool
@@ -242,3 +488,60 @@ func (s *memStorage) UpdateAuthRequest(id string, updater func(old storage.AuthR
 	})
 	return
 }
+
+func (s *memStorage) UpdateDeviceToken(deviceCode string, updater func(old storage.DeviceToken) (storage.DeviceToken, error)) (err error) {
+	s.tx(func() {
+		tok, ok := s.deviceTokens[deviceCode]
+		if !ok {
+			err = storage.ErrNotFound
+			return
+		}
+		if tok, err = updater(tok); err == nil {
+			s.deviceTokens[deviceCode] = tok
+		}
+	})
+	return
+}
+
+func (s *memStorage) UpdateSession(id string, updater func(old storage.Session) (storage.Session, error)) (err error) {
+	s.tx(func() {
+		session, ok := s.sessions[id]
+		if !ok {
+			err = storage.ErrNotFound
+			return
+		}
+		if session, err = updater(session); err == nil {
+			s.sessions[id] = session
+		}
+	})
+	return
+}
+
+func (s *memStorage) UpdateRefresh(token string, updater func(old storage.Refresh) (storage.Refresh, error)) (err error) {
+	s.tx(func() {
+		refresh, ok := s.refreshTokens[token]
+		if !ok {
+			err = storage.ErrNotFound
+			return
+		}
+		if refresh, err = updater(refresh); err == nil {
+			s.refreshTokens[token] = refresh
+		}
+	})
+	return
+}
+
+func (s *memStorage) UpdateConsent(connectorID, userID, clientID string, updater func(old storage.Consent) (storage.Consent, error)) (err error) {
+	s.tx(func() {
+		key := consentKey{connectorID, userID, clientID}
+		c, ok := s.consents[key]
+		if !ok {
+			err = storage.ErrNotFound
+			return
+		}
+		if c, err = updater(c); err == nil {
+			s.consents[key] = c
+		}
+	})
+	return
+}
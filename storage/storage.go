@@ -25,6 +25,10 @@ var (
 // ErrNotFound is the error returned by storages if a resource cannot be found.
 var ErrNotFound = errors.New("not found")
 
+// ErrAlreadyExists is the error returned by storages if a resource ID is taken
+// during a create operation.
+var ErrAlreadyExists = errors.New("ID already exists")
+
 // Kubernetes only allows lower case letters for names.
 //
 // TODO(ericchiang): refactor ID creation onto the storage.
@@ -72,8 +76,8 @@ func Open(driverName string, config map[string]string) (Storage, error) {
 // Storage is the storage interface used by the server. Implementations, at minimum
 // require compare-and-swap atomic actions.
 //
-// Implementations are expected to perform their own garbage collection of
-// expired objects (expect keys which are handled by rotation).
+// Expired objects are removed by GarbageCollect, except keys which are handled
+// by rotation.
 type Storage interface {
 	Close() error
 
@@ -81,6 +85,16 @@ type Storage interface {
 	CreateClient(c Client) error
 	CreateAuthCode(c AuthCode) error
 	CreateRefresh(r Refresh) error
+	CreateAccessToken(t AccessToken) error
+	CreateDeviceRequest(d DeviceRequest) error
+	CreateDeviceToken(t DeviceToken) error
+	CreateSession(s Session) error
+	CreateConsent(c Consent) error
+
+	// CreateClientAssertion records a client assertion which has been used to
+	// authenticate. It MUST return ErrAlreadyExists if the client has already used
+	// an assertion with the same JTI.
+	CreateClientAssertion(a ClientAssertion) error
 
 	// TODO(ericchiang): return (T, bool, error) so we can indicate not found
 	// requests that way.
@@ -89,20 +103,56 @@ type Storage interface {
 	GetClient(id string) (Client, error)
 	GetKeys() (Keys, error)
 	GetRefresh(id string) (Refresh, error)
+	GetAccessToken(token string) (AccessToken, error)
+	GetDeviceRequest(userCode string) (DeviceRequest, error)
+	GetDeviceToken(deviceCode string) (DeviceToken, error)
+	GetSession(id string) (Session, error)
+	GetConsent(connectorID, userID, clientID string) (Consent, error)
 
 	ListClients() ([]Client, error)
 	ListRefreshTokens() ([]Refresh, error)
+	ListConsents() ([]Consent, error)
 
 	// Delete methods MUST be atomic.
 	DeleteAuthRequest(id string) error
 	DeleteAuthCode(code string) error
 	DeleteClient(id string) error
 	DeleteRefresh(id string) error
+	DeleteAccessToken(token string) error
+	DeleteDeviceRequest(userCode string) error
+	DeleteDeviceToken(deviceCode string) error
+	DeleteSession(id string) error
+	DeleteConsent(connectorID, userID, clientID string) error
 
 	// Update functions are assumed to be a performed within a single object transaction.
 	UpdateClient(id string, updater func(old Client) (Client, error)) error
 	UpdateKeys(updater func(old Keys) (Keys, error)) error
 	UpdateAuthRequest(id string, updater func(a AuthRequest) (AuthRequest, error)) error
+	UpdateDeviceToken(deviceCode string, updater func(t DeviceToken) (DeviceToken, error)) error
+	UpdateSession(id string, updater func(s Session) (Session, error)) error
+	UpdateRefresh(id string, updater func(r Refresh) (Refresh, error)) error
+	UpdateConsent(connectorID, userID, clientID string, updater func(c Consent) (Consent, error)) error
+
+	// GarbageCollect deletes all objects with an expiry before the provided time.
+	// Objects with a zero expiry never expire.
+	GarbageCollect(now time.Time) (GCResult, error)
+}
+
+// GCResult is the number of objects of each kind deleted by garbage collection.
+type GCResult struct {
+	AuthRequests     int64
+	AuthCodes        int64
+	DeviceRequests   int64
+	DeviceTokens     int64
+	ClientAssertions int64
+	AccessTokens     int64
+	Sessions         int64
+	RefreshTokens    int64
+}
+
+// IsEmpty returns whether no objects were deleted.
+func (g GCResult) IsEmpty() bool {
+	return g == GCResult{}
 }
 
 // Client is an OAuth2 client.
@@ -115,17 +165,134 @@ type Client struct {
 	Secret       string
 	RedirectURIs []string
 
+	// PostLogoutRedirectURIs are the URIs the end user may be sent to after
+	// logging out through the end session endpoint.
+	//
+	// See: https://openid.net/specs/openid-connect-rpinitiated-1_0.html
+	PostLogoutRedirectURIs []string
+
+	// BackchannelLogoutURI, if set, receives a logout token when an end user
+	// logged into the client logs out.
+	//
+	// See: https://openid.net/specs/openid-connect-backchannel-1_0.html
+	BackchannelLogoutURI string
+	// BackchannelLogoutSessionRequired makes the server only send the client
+	// logout tokens which identify the end user's session with a "sid" claim.
+	BackchannelLogoutSessionRequired bool
+	// BackchannelLogoutStatus is the outcome of the most recent logout token
+	// delivered to the client. Set by the server.
+	BackchannelLogoutStatus *BackchannelLogoutStatus
+
+	// RequestURIs are the URIs the server may fetch request objects from when
+	// the client passes them by reference.
+	//
+	// See: https://tools.ietf.org/html/rfc9101#section-5.2
+	RequestURIs []string
+
 	// TrustedPeers are a list of peers which can issue tokens on this client's behalf.
 	// Clients inherently trust themselves.
 	TrustedPeers []string
 
 	// Public clients must use either use a redirectURL 127.0.0.1:X or "urn:ietf:wg:oauth:2.0:oob"
+	//
+	// Public clients don't authenticate to the token endpoint, and must use PKCE
+	// for the authorization code flow.
 	Public bool
 
+	// TokenEndpointAuthMethod is the only method the client may use to
+	// authenticate to the token endpoint: "client_secret_basic",
+	// "client_secret_post", "client_secret_jwt" or "private_key_jwt". If empty,
+	// the client may use either "client_secret_basic" or "client_secret_post",
+	// as clients could before the method was recorded. Ignored for public
+	// clients, which always use "none".
+	TokenEndpointAuthMethod string
+
+	// RequirePKCE forces the client to send a PKCE code challenge with every
+	// authorization request.
+	//
+	// See: https://tools.ietf.org/html/rfc7636
+	RequirePKCE bool
+
+	// RequirePushedAuthorizationRequests forces the client to push the
+	// parameters of every authorization request to the server first.
+	//
+	// See: https://tools.ietf.org/html/rfc9126
+	RequirePushedAuthorizationRequests bool
+
+	// RefreshTokenIdleTimeout and RefreshTokenAbsoluteLifetime override the
+	// server's refresh token lifetimes for this client when non-zero.
+	RefreshTokenIdleTimeout      time.Duration
+	RefreshTokenAbsoluteLifetime time.Duration
+
+	// AllowedScopes are the scopes the client may request for itself using the
+	// client_credentials grant. Tokens issued through that grant have the client
+	// as their subject.
+	AllowedScopes []string
+
+	// AllowPasswordGrant lets the client exchange an end user's username and
+	// password directly for tokens. This is intended for trusted clients, such as
+	// CLI tools, which can't open a browser.
+	AllowPasswordGrant bool
+
+	// JWKS and JWKSURI hold the public keys the client uses to sign client
+	// assertions when authenticating with the "private_key_jwt" method. At most
+	// one should be set.
+	//
+	// See: https://openid.net/specs/openid-connect-core-1_0.html#ClientAuthentication
+	JWKS    *jose.JSONWebKeySet
+	JWKSURI string
+
+	// UserInfoSignedResponseAlg, if set, makes the user info endpoint return a
+	// JWT signed by the server instead of plain JSON. It must match the
+	// algorithm of the server's signing key, since the response is signed with
+	// that key.
+	UserInfoSignedResponseAlg string
+
+	// JWTAccessTokens makes the server issue access tokens for this client as
+	// JWTs resource servers can validate locally, instead of opaque values.
+	//
+	// See: https://tools.ietf.org/html/rfc9068
+	JWTAccessTokens bool
+
+	// AllowedResources are the APIs the client may request access tokens for
+	// using the "resource" parameter. Each becomes the audience of the token.
+	//
+	// See: https://tools.ietf.org/html/rfc8707
+	AllowedResources []string
+
+	// RegistrationAccessToken authenticates requests to read, update or delete
+	// a client created through dynamic client registration. Empty for clients
+	// which weren't registered dynamically.
+	//
+	// See: https://tools.ietf.org/html/rfc7592
+	RegistrationAccessToken string
+
 	Name    string
 	LogoURL string
 }
 
+// BackchannelLogoutStatus is the outcome of delivering a logout token to a
+// client's back-channel logout URI.
+type BackchannelLogoutStatus struct {
+	// When delivery finished, and how many requests were made.
+	Time     time.Time
+	Attempts int
+	// Error of the last request. Empty if the logout token was delivered.
+	Error string
+}
+
+// ClientAssertion is a record of a JWT a client used to authenticate or to sign
+// a request object. It's kept until the JWT expires to prevent it from being
+// replayed.
+type ClientAssertion struct {
+	ClientID string
+	// The "jti" claim of the assertion.
+	JTI string
+
+	// Expiry of the assertion. After this time the record may be deleted.
+	Expiry time.Time
+}
+
 // Identity represents the ID Token claims supported by the server.
 type Identity struct {
 	UserID        string
@@ -135,6 +302,21 @@ type Identity struct {
 
 	Groups []string
 
+	// Claims holds additional attributes of the end user provided by the
+	// connector, such as their given name. Keys are specific to the connector and
+	// values must be serializable as JSON. Servers choose which attributes to
+	// issue as claims.
+	Claims map[string]interface{}
+
+	// AuthTime is when the end user authenticated through the connector. Zero if
+	// unknown.
+	AuthTime time.Time
+	// ACR is the authentication context class reference requested by the client.
+	ACR string
+	// SessionID identifies the end user's login session to clients, as the "sid"
+	// claim. Empty if the identity wasn't authenticated through a session.
+	SessionID string
+
 	// ConnectorData holds data used by the connector for subsequent requests after initial
 	// authentication, such as access tokens for upstream provides.
 	//
@@ -152,20 +334,48 @@ type AuthRequest struct {
 	Scopes        []string
 	RedirectURI   string
 
+	// How the response is returned to the redirect URI: "query", "fragment" or
+	// "form_post". Empty for the default mode of the response types.
+	ResponseMode string
+
 	Nonce string
 	State string
 
+	// PKCE code challenge and the method used to derive it from the code verifier.
+	// Empty if the client didn't use PKCE.
+	CodeChallenge       string
+	CodeChallengeMethod string
+
 	// The client has indicated that the end user must be shown an approval prompt
 	// on all requests. The server cannot cache their initial action for subsequent
 	// attempts.
 	ForceApprovalPrompt bool
 
+	// The client has indicated that the end user must authenticate again even if
+	// they have a session.
+	ForceLogin bool
+	// The maximum number of seconds since the end user last authenticated. Zero
+	// if the client didn't restrict it.
+	MaxAge int
+	// The client has indicated that no login or approval UI may be shown. The
+	// request fails if the end user needs to do either.
+	PromptNone bool
+
+	// Hint about the login the end user might use, passed on to connectors.
+	LoginHint string
+	// Requested authentication context class references, in order of preference.
+	ACRValues []string
+
 	// The identity of the end user. Generally nil until the user authenticates
 	// with a backend.
 	Identity *Identity
 	// The connector used to login the user. Set when the user authenticates.
 	ConnectorID string
 
+	// Pushed is set for requests the client pushed to the server before
+	// redirecting the end user. The end user hasn't started these requests.
+	Pushed bool
+
 	Expiry time.Time
 }
 
@@ -181,6 +391,11 @@ type AuthCode struct {
 
 	Scopes []string
 
+	// PKCE code challenge carried over from the authorization request. Must be
+	// matched by a code verifier when the code is exchanged.
+	CodeChallenge       string
+	CodeChallengeMethod string
+
 	Identity Identity
 
 	Expiry time.Time
@@ -203,6 +418,124 @@ type Refresh struct {
 	Nonce string
 
 	Identity Identity
+
+	// FamilyID identifies the lineage of refresh tokens rotated from the same
+	// initial token. If a rotated token is used again, every token in the family
+	// is revoked.
+	FamilyID string
+	// RotatedAt is when the token was exchanged for its successor, ReplacedBy.
+	// Both are empty for the active token of a family.
+	RotatedAt  time.Time
+	ReplacedBy string
+
+	// CreatedAt is when the family's initial token was issued, and LastUsed when
+	// this token was issued. Expiry is computed from both using the lifetimes in
+	// effect at the time. A zero Expiry means the token doesn't expire.
+	CreatedAt time.Time
+	LastUsed  time.Time
+	Expiry    time.Time
+}
+
+// AccessToken is an OAuth2 access token issued by the server. Resource servers
+// validate opaque access tokens through token introspection. For JWT access
+// tokens, Token holds the "jti" claim.
+type AccessToken struct {
+	// The actual access token.
+	Token string
+
+	ClientID    string
+	ConnectorID string
+
+	Scopes []string
+
+	// The API the token was issued for, if the client requested one.
+	Resource string
+
+	// The end user the token was issued for.
+	Identity Identity
+
+	Expiry time.Time
+}
+
+// DeviceRequest represents an OAuth2 device authorization request. It holds the
+// state of a device flow until the end user enters the user code.
+//
+// See: https://tools.ietf.org/html/rfc8628
+type DeviceRequest struct {
+	// The code the end user types into the verification page. Used as the ID of
+	// the request.
+	UserCode string
+
+	// The code the device uses to poll the token endpoint.
+	DeviceCode string
+
+	ClientID string
+	Scopes   []string
+
+	Expiry time.Time
+}
+
+// Device token statuses.
+const (
+	DeviceTokenPending  = "pending"
+	DeviceTokenComplete = "complete"
+	DeviceTokenDenied   = "denied"
+)
+
+// DeviceToken is the state of a device flow as seen by the polling device.
+type DeviceToken struct {
+	DeviceCode string
+	ClientID   string
+
+	// Status is DeviceTokenPending until the end user authorizes the device,
+	// then DeviceTokenComplete, or DeviceTokenDenied if the end user refuses.
+	Status string
+
+	// Token is the serialized token response returned to the device once the
+	// flow is complete.
+	Token string
+
+	// The last time the device polled the token endpoint, and how often it's
+	// allowed to poll.
+	LastRequestTime time.Time
+	PollInterval    time.Duration
+
+	Expiry time.Time
+}
+
+// Session is an end user's login session with the server. It lets the end user
+// authorize additional clients without logging in through a connector again.
+type Session struct {
+	// The session ID, held by the end user's browser in a cookie.
+	ID string
+
+	// The connector used to login the user and the identity it returned.
+	ConnectorID string
+	Identity    Identity
+
+	// Clients the end user has authorized during the session.
+	Clients []string
+
+	CreatedAt time.Time
+	LastUsed  time.Time
+
+	// Expiry is when the session ends, however recently it was used. After this
+	// time the session may be deleted.
+	Expiry time.Time
+}
+
+// Consent records the scopes an end user has approved for a client, so the end
+// user doesn't have to approve the client again. Consents are unique per end
+// user and client.
+type Consent struct {
+	// The end user is identified by their user ID for a connector.
+	ConnectorID string
+	UserID      string
+
+	ClientID string
+	Scopes   []string
+
+	LastUpdated time.Time
 }
 
 // VerificationKey is a rotated signing key which can still be used to verify
@@ -227,29 +560,41 @@ type Keys struct {
 	NextRotation time.Time
 }
 
-// Sign creates a JWT using the signing key.
-func (k Keys) Sign(payload []byte) (jws string, err error) {
-	if k.SigningKey == nil {
-		return "", fmt.Errorf("no key to sign payload with")
+// SignatureAlgorithm returns the algorithm used to sign with a private key.
+func SignatureAlgorithm(jwk *jose.JSONWebKey) (alg jose.SignatureAlgorithm, err error) {
+	if jwk == nil {
+		return alg, errors.New("no signing key")
 	}
-	signingKey := jose.SigningKey{Key: k.SigningKey}
-
-	switch key := k.SigningKey.Key.(type) {
+	switch key := jwk.Key.(type) {
 	case *rsa.PrivateKey:
 		// TODO(ericchiang): Allow different cryptographic hashes.
-		signingKey.Algorithm = jose.RS256
+		return jose.RS256, nil
 	case *ecdsa.PrivateKey:
 		switch key.Params() {
 		case elliptic.P256().Params():
-			signingKey.Algorithm = jose.ES256
+			return jose.ES256, nil
 		case elliptic.P384().Params():
-			signingKey.Algorithm = jose.ES384
+			return jose.ES384, nil
 		case elliptic.P521().Params():
-			signingKey.Algorithm = jose.ES512
+			return jose.ES512, nil
 		default:
-			return "", errors.New("unsupported ecdsa curve")
+			return alg, errors.New("unsupported ecdsa curve")
 		}
+	default:
+		return alg, fmt.Errorf("unsupported signing key type %T", key)
+	}
+}
+
+// Sign creates a JWT using the signing key.
+func (k Keys) Sign(payload []byte) (jws string, err error) {
+	if k.SigningKey == nil {
+		return "", fmt.Errorf("no key to sign payload with")
+	}
+	alg, err := SignatureAlgorithm(k.SigningKey)
+	if err != nil {
+		return "", err
 	}
+	signingKey := jose.SigningKey{Algorithm: alg, Key: k.SigningKey}
 
 	signer, err := jose.NewSigner(signingKey, &jose.SignerOptions{})
 	if err != nil {
@@ -17,6 +17,13 @@ var neverExpire = time.Now().Add(time.Hour * 24 * 365 * 100)
 func RunTestSuite(t *testing.T, s storage.Storage) {
 	t.Run("UpdateAuthRequest", func(t *testing.T) { testUpdateAuthRequest(t, s) })
 	t.Run("CreateRefresh", func(t *testing.T) { testCreateRefresh(t, s) })
+	t.Run("CreateAccessToken", func(t *testing.T) { testCreateAccessToken(t, s) })
+	t.Run("CreateAuthCode", func(t *testing.T) { testCreateAuthCode(t, s) })
+	t.Run("DeviceFlow", func(t *testing.T) { testDeviceFlow(t, s) })
+	t.Run("ClientAssertionReplay", func(t *testing.T) { testClientAssertionReplay(t, s) })
+	t.Run("Session", func(t *testing.T) { testSession(t, s) })
+	t.Run("Consent", func(t *testing.T) { testConsent(t, s) })
+	t.Run("GarbageCollection", func(t *testing.T) { testGarbageCollection(t, s) })
 }
 
 func testUpdateAuthRequest(t *testing.T, s storage.Storage) {
@@ -54,6 +61,40 @@ func testUpdateAuthRequest(t *testing.T, s storage.Storage) {
 	}
 }
 
+func testCreateAuthCode(t *testing.T, s storage.Storage) {
+	code := storage.AuthCode{
+		ID:                  storage.NewNonce(),
+		ClientID:            "client_id",
+		RedirectURI:         "https://localhost:80/callback",
+		ConnectorID:         "connID",
+		Nonce:               "foobar",
+		Scopes:              []string{"openid", "email"},
+		CodeChallenge:       "rualUr8LB3NGquOSnZBtsK0-VAMHhfmlzpiiNV_qPCE",
+		CodeChallengeMethod: "S256",
+		Identity:            storage.Identity{Email: "foobar"},
+		Expiry:              neverExpire,
+	}
+	if err := s.CreateAuthCode(code); err != nil {
+		t.Fatalf("create auth code: %v", err)
+	}
+	got, err := s.GetAuthCode(code.ID)
+	if err != nil {
+		t.Fatalf("get auth code: %v", err)
+	}
+	// Time values may lose precision in storage.
+	got.Expiry = code.Expiry
+	if !reflect.DeepEqual(got, code) {
+		t.Errorf("auth code returned did not match expected, wanted=%#v got=%#v", code, got)
+	}
+
+	if err := s.DeleteAuthCode(code.ID); err != nil {
+		t.Fatalf("delete auth code: %v", err)
+	}
+	if _, err := s.GetAuthCode(code.ID); err != storage.ErrNotFound {
+		t.Errorf("after deleting auth code expected storage.ErrNotFound, got %v", err)
+	}
+}
+
 func testCreateRefresh(t *testing.T, s storage.Storage) {
 	id := storage.NewNonce()
 	refresh := storage.Refresh{
@@ -61,6 +102,11 @@ func testCreateRefresh(t *testing.T, s storage.Storage) {
 		ClientID:     "client_id",
 		ConnectorID:  "client_secret",
 		Scopes:       []string{"openid", "email", "profile"},
+		Identity: storage.Identity{
+			UserID: "1",
+			Claims: map[string]interface{}{"given_name": "Kilgore", "locale": "en-US"},
+		},
+		FamilyID: id,
 	}
 	if err := s.CreateRefresh(refresh); err != nil {
 		t.Fatalf("create refresh token: %v", err)
@@ -73,6 +119,36 @@ func testCreateRefresh(t *testing.T, s storage.Storage) {
 		t.Errorf("refresh returned did not match expected")
 	}
 
+	successor := storage.NewNonce()
+	err = s.UpdateRefresh(id, func(old storage.Refresh) (storage.Refresh, error) {
+		old.RotatedAt = neverExpire
+		old.ReplacedBy = successor
+		return old, nil
+	})
+	if err != nil {
+		t.Fatalf("update refresh: %v", err)
+	}
+	if gotRefresh, err = s.GetRefresh(id); err != nil {
+		t.Fatalf("get refresh: %v", err)
+	}
+	if !gotRefresh.RotatedAt.Equal(neverExpire) || gotRefresh.ReplacedBy != successor {
+		t.Errorf("refresh rotation not preserved, got rotated at=%v replaced by=%q", gotRefresh.RotatedAt, gotRefresh.ReplacedBy)
+	}
+
+	tokens, err := s.ListRefreshTokens()
+	if err != nil {
+		t.Fatalf("list refresh tokens: %v", err)
+	}
+	found := false
+	for _, token := range tokens {
+		if token.RefreshToken == id {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("refresh token not found in list")
+	}
+
 	if err := s.DeleteRefresh(id); err != nil {
 		t.Fatalf("failed to delete refresh request: %v", err)
 	}
@@ -82,3 +158,379 @@ func testCreateRefresh(t *testing.T, s storage.Storage) {
 	}
 
 }
+
+func testCreateAccessToken(t *testing.T, s storage.Storage) {
+	tok := storage.AccessToken{
+		Token:       storage.NewNonce(),
+		ClientID:    "client_id",
+		ConnectorID: "connID",
+		Scopes:      []string{"openid", "email"},
+		Resource:    "https://api.example.com",
+		Identity:    storage.Identity{UserID: "1", Email: "foobar", Groups: []string{"admins"}},
+		Expiry:      neverExpire,
+	}
+	if err := s.CreateAccessToken(tok); err != nil {
+		t.Fatalf("create access token: %v", err)
+	}
+	got, err := s.GetAccessToken(tok.Token)
+	if err != nil {
+		t.Fatalf("get access token: %v", err)
+	}
+	got.Expiry = tok.Expiry
+	if !reflect.DeepEqual(got, tok) {
+		t.Errorf("access token returned did not match expected, wanted=%#v got=%#v", tok, got)
+	}
+	if _, err := s.GetAccessToken(storage.NewNonce()); err != storage.ErrNotFound {
+		t.Errorf("get unknown access token: expected storage.ErrNotFound, got %v", err)
+	}
+
+	if err := s.DeleteAccessToken(tok.Token); err != nil {
+		t.Fatalf("delete access token: %v", err)
+	}
+	if _, err := s.GetAccessToken(tok.Token); err != storage.ErrNotFound {
+		t.Errorf("after deleting access token expected storage.ErrNotFound, got %v", err)
+	}
+}
+
+func testDeviceFlow(t *testing.T, s storage.Storage) {
+	req := storage.DeviceRequest{
+		UserCode:   "BCDF-GHJK",
+		DeviceCode: storage.NewNonce(),
+		ClientID:   "client_id",
+		Scopes:     []string{"openid", "email"},
+		Expiry:     neverExpire,
+	}
+	if err := s.CreateDeviceRequest(req); err != nil {
+		t.Fatalf("create device request: %v", err)
+	}
+	gotReq, err := s.GetDeviceRequest(req.UserCode)
+	if err != nil {
+		t.Fatalf("get device request: %v", err)
+	}
+	gotReq.Expiry = req.Expiry
+	if !reflect.DeepEqual(gotReq, req) {
+		t.Errorf("device request returned did not match expected, wanted=%#v got=%#v", req, gotReq)
+	}
+
+	tok := storage.DeviceToken{
+		DeviceCode:   req.DeviceCode,
+		ClientID:     req.ClientID,
+		Status:       storage.DeviceTokenPending,
+		PollInterval: 5 * time.Second,
+		Expiry:       neverExpire,
+	}
+	if err := s.CreateDeviceToken(tok); err != nil {
+		t.Fatalf("create device token: %v", err)
+	}
+	if err := s.UpdateDeviceToken(tok.DeviceCode, func(old storage.DeviceToken) (storage.DeviceToken, error) {
+		old.Status = storage.DeviceTokenComplete
+		old.Token = `{"access_token":"foo"}`
+		return old, nil
+	}); err != nil {
+		t.Fatalf("update device token: %v", err)
+	}
+	gotTok, err := s.GetDeviceToken(tok.DeviceCode)
+	if err != nil {
+		t.Fatalf("get device token: %v", err)
+	}
+	if gotTok.Status != storage.DeviceTokenComplete || gotTok.Token != `{"access_token":"foo"}` {
+		t.Errorf("device token was not updated, got %#v", gotTok)
+	}
+
+	if err := s.DeleteDeviceRequest(req.UserCode); err != nil {
+		t.Fatalf("delete device request: %v", err)
+	}
+	if _, err := s.GetDeviceRequest(req.UserCode); err != storage.ErrNotFound {
+		t.Errorf("after deleting device request expected storage.ErrNotFound, got %v", err)
+	}
+	if err := s.DeleteDeviceToken(tok.DeviceCode); err != nil {
+		t.Fatalf("delete device token: %v", err)
+	}
+	if _, err := s.GetDeviceToken(tok.DeviceCode); err != storage.ErrNotFound {
+		t.Errorf("after deleting device token expected storage.ErrNotFound, got %v", err)
+	}
+}
+
+func testClientAssertionReplay(t *testing.T, s storage.Storage) {
+	a := storage.ClientAssertion{
+		ClientID: "client_id",
+		JTI:      storage.NewNonce(),
+		Expiry:   neverExpire,
+	}
+	if err := s.CreateClientAssertion(a); err != nil {
+		t.Fatalf("create client assertion: %v", err)
+	}
+	if err := s.CreateClientAssertion(a); err != storage.ErrAlreadyExists {
+		t.Errorf("expected replayed assertion to return ErrAlreadyExists, got %v", err)
+	}
+
+	// The same JTI may be used by a different client.
+	a.ClientID = "other_client_id"
+	if err := s.CreateClientAssertion(a); err != nil {
+		t.Errorf("create client assertion for another client: %v", err)
+	}
+}
+
+func testSession(t *testing.T, s storage.Storage) {
+	now := time.Now()
+	session := storage.Session{
+		ID:          storage.NewNonce(),
+		ConnectorID: "connID",
+		Identity:    storage.Identity{UserID: "1", Email: "foobar", Groups: []string{"admins"}},
+		CreatedAt:   now,
+		LastUsed:    now,
+		Expiry:      neverExpire,
+	}
+	if err := s.CreateSession(session); err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+
+	lastUsed := now.Add(time.Minute)
+	err := s.UpdateSession(session.ID, func(old storage.Session) (storage.Session, error) {
+		old.Clients = append(old.Clients, "client_id")
+		old.LastUsed = lastUsed
+		return old, nil
+	})
+	if err != nil {
+		t.Fatalf("update session: %v", err)
+	}
+
+	got, err := s.GetSession(session.ID)
+	if err != nil {
+		t.Fatalf("get session: %v", err)
+	}
+	if !got.CreatedAt.Equal(now) || !got.LastUsed.Equal(lastUsed) {
+		t.Errorf("session times not preserved, got created=%v last used=%v", got.CreatedAt, got.LastUsed)
+	}
+	got.CreatedAt, got.LastUsed, got.Expiry = session.CreatedAt, session.LastUsed, session.Expiry
+	session.Clients = []string{"client_id"}
+	if !reflect.DeepEqual(got, session) {
+		t.Errorf("session returned did not match expected, wanted=%#v got=%#v", session, got)
+	}
+
+	if err := s.DeleteSession(session.ID); err != nil {
+		t.Fatalf("delete session: %v", err)
+	}
+	if _, err := s.GetSession(session.ID); err != storage.ErrNotFound {
+		t.Errorf("expected ErrNotFound after deleting session, got %v", err)
+	}
+}
+
+func testConsent(t *testing.T, s storage.Storage) {
+	c := storage.Consent{
+		ConnectorID: "connID",
+		UserID:      storage.NewNonce(),
+		ClientID:    "client_id",
+		Scopes:      []string{"openid"},
+		LastUpdated: time.Now(),
+	}
+	if err := s.CreateConsent(c); err != nil {
+		t.Fatalf("create consent: %v", err)
+	}
+	if err := s.CreateConsent(c); err != storage.ErrAlreadyExists {
+		t.Errorf("expected ErrAlreadyExists creating a duplicate consent, got %v", err)
+	}
+
+	err := s.UpdateConsent(c.ConnectorID, c.UserID, c.ClientID, func(old storage.Consent) (storage.Consent, error) {
+		old.Scopes = append(old.Scopes, "email")
+		return old, nil
+	})
+	if err != nil {
+		t.Fatalf("update consent: %v", err)
+	}
+
+	got, err := s.GetConsent(c.ConnectorID, c.UserID, c.ClientID)
+	if err != nil {
+		t.Fatalf("get consent: %v", err)
+	}
+	got.LastUpdated = c.LastUpdated
+	c.Scopes = []string{"openid", "email"}
+	if !reflect.DeepEqual(got, c) {
+		t.Errorf("consent returned did not match expected, wanted=%#v got=%#v", c, got)
+	}
+	if _, err := s.GetConsent(c.ConnectorID, c.UserID, "other_client"); err != storage.ErrNotFound {
+		t.Errorf("expected ErrNotFound for another client's consent, got %v", err)
+	}
+
+	consents, err := s.ListConsents()
+	if err != nil {
+		t.Fatalf("list consents: %v", err)
+	}
+	found := false
+	for _, consent := range consents {
+		if consent.UserID == c.UserID && consent.ClientID == c.ClientID {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("consent not found in list")
+	}
+
+	if err := s.DeleteConsent(c.ConnectorID, c.UserID, c.ClientID); err != nil {
+		t.Fatalf("delete consent: %v", err)
+	}
+	if _, err := s.GetConsent(c.ConnectorID, c.UserID, c.ClientID); err != storage.ErrNotFound {
+		t.Errorf("expected ErrNotFound after deleting consent, got %v", err)
+	}
+}
+
+// found converts the error returned by a get into whether the object exists.
+func found(err error) (bool, error) {
+	switch err {
+	case nil:
+		return true, nil
+	case storage.ErrNotFound:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+func testGarbageCollection(t *testing.T, s storage.Storage) {
+	tests := []struct {
+		name string
+		// create stores an object of the kind with the given ID and expiry.
+		create func(id string, expiry time.Time) error
+		// exists reports whether the object with the given ID is still stored.
+		exists func(id string) (bool, error)
+		// deleted returns the count for the kind in a GC result.
+		deleted func(r *storage.GCResult) *int64
+	}{
+		{
+			name: "AuthRequests",
+			create: func(id string, expiry time.Time) error {
+				return s.CreateAuthRequest(storage.AuthRequest{ID: id, ClientID: "client_id", Expiry: expiry})
+			},
+			exists: func(id string) (bool, error) {
+				_, err := s.GetAuthRequest(id)
+				return found(err)
+			},
+			deleted: func(r *storage.GCResult) *int64 { return &r.AuthRequests },
+		},
+		{
+			name: "AuthCodes",
+			create: func(id string, expiry time.Time) error {
+				return s.CreateAuthCode(storage.AuthCode{ID: id, ClientID: "client_id", Expiry: expiry})
+			},
+			exists: func(id string) (bool, error) {
+				_, err := s.GetAuthCode(id)
+				return found(err)
+			},
+			deleted: func(r *storage.GCResult) *int64 { return &r.AuthCodes },
+		},
+		{
+			name: "DeviceRequests",
+			create: func(id string, expiry time.Time) error {
+				return s.CreateDeviceRequest(storage.DeviceRequest{UserCode: id, DeviceCode: id, ClientID: "client_id", Expiry: expiry})
+			},
+			exists: func(id string) (bool, error) {
+				_, err := s.GetDeviceRequest(id)
+				return found(err)
+			},
+			deleted: func(r *storage.GCResult) *int64 { return &r.DeviceRequests },
+		},
+		{
+			name: "DeviceTokens",
+			create: func(id string, expiry time.Time) error {
+				return s.CreateDeviceToken(storage.DeviceToken{DeviceCode: id, ClientID: "client_id", Status: storage.DeviceTokenPending, Expiry: expiry})
+			},
+			exists: func(id string) (bool, error) {
+				_, err := s.GetDeviceToken(id)
+				return found(err)
+			},
+			deleted: func(r *storage.GCResult) *int64 { return &r.DeviceTokens },
+		},
+		{
+			name: "ClientAssertions",
+			create: func(id string, expiry time.Time) error {
+				return s.CreateClientAssertion(storage.ClientAssertion{ClientID: "client_id", JTI: id, Expiry: expiry})
+			},
+			exists: func(id string) (bool, error) {
+				// Assertions can't be read back, so check by recording them again.
+				switch err := s.CreateClientAssertion(storage.ClientAssertion{ClientID: "client_id", JTI: id, Expiry: neverExpire}); err {
+				case storage.ErrAlreadyExists:
+					return true, nil
+				case nil:
+					return false, nil
+				default:
+					return false, err
+				}
+			},
+			deleted: func(r *storage.GCResult) *int64 { return &r.ClientAssertions },
+		},
+		{
+			name: "AccessTokens",
+			create: func(id string, expiry time.Time) error {
+				return s.CreateAccessToken(storage.AccessToken{Token: id, ClientID: "client_id", Expiry: expiry})
+			},
+			exists: func(id string) (bool, error) {
+				_, err := s.GetAccessToken(id)
+				return found(err)
+			},
+			deleted: func(r *storage.GCResult) *int64 { return &r.AccessTokens },
+		},
+		{
+			name: "Sessions",
+			create: func(id string, expiry time.Time) error {
+				return s.CreateSession(storage.Session{ID: id, Expiry: expiry})
+			},
+			exists: func(id string) (bool, error) {
+				_, err := s.GetSession(id)
+				return found(err)
+			},
+			deleted: func(r *storage.GCResult) *int64 { return &r.Sessions },
+		},
+		{
+			name: "RefreshTokens",
+			create: func(id string, expiry time.Time) error {
+				return s.CreateRefresh(storage.Refresh{RefreshToken: id, ClientID: "client_id", Expiry: expiry})
+			},
+			exists: func(id string) (bool, error) {
+				_, err := s.GetRefresh(id)
+				return found(err)
+			},
+			deleted: func(r *storage.GCResult) *int64 { return &r.RefreshTokens },
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			now := time.Now()
+			// Remove objects left by other tests so the result below is exact.
+			if _, err := s.GarbageCollect(now); err != nil {
+				t.Fatalf("garbage collect: %v", err)
+			}
+
+			expiredID, validID, noExpiryID := storage.NewNonce(), storage.NewNonce(), storage.NewNonce()
+			for id, expiry := range map[string]time.Time{
+				expiredID:  now.Add(-time.Minute),
+				validID:    neverExpire,
+				noExpiryID: {},
+			} {
+				if err := tc.create(id, expiry); err != nil {
+					t.Fatalf("create: %v", err)
+				}
+			}
+
+			result, err := s.GarbageCollect(now)
+			if err != nil {
+				t.Fatalf("garbage collect: %v", err)
+			}
+			var want storage.GCResult
+			*tc.deleted(&want) = 1
+			if result != want {
+				t.Errorf("expected garbage collection result %+v got %+v", want, result)
+			}
+
+			for id, want := range map[string]bool{expiredID: false, validID: true, noExpiryID: true} {
+				got, err := tc.exists(id)
+				if err != nil {
+					t.Fatalf("get: %v", err)
+				}
+				if got != want {
+					t.Errorf("expected object %s to exist=%t after garbage collection, got %t", id, want, got)
+				}
+			}
+		})
+	}
+}